@@ -0,0 +1,306 @@
+// Package graceful runs a raw TCP accept loop that shuts down cleanly on
+// SIGINT/SIGTERM instead of being killed mid-conversation.
+//
+// Shutdown sequence:
+//  1. Stop accepting (close the listener)
+//  2. Wake connections that are idle, i.e. blocked waiting for the next
+//     message, so their handler can say goodbye and return
+//  3. Let active connections finish their current message
+//  4. After DrainTimeout, force-close whatever is left
+//
+// Handlers cooperate by calling Idle before blocking on a read and Active
+// once the first byte of a message has arrived:
+//
+//	for srv.Idle(conn) {
+//		if _, err := reader.Peek(1); err != nil { ... }
+//		srv.Active(conn)
+//		// read and answer one message
+//	}
+//	// Idle returned false: send a protocol goodbye and return
+//
+// A second signal during the drain skips straight to force-closing.
+//
+// MaxConns and MaxConnsPerIP bound how many connections are handled at
+// once, so a client holding sockets open (slowloris) can exhaust its own
+// share but not the server. Connections over a limit never reach handle:
+// they go to Reject, which can write a refusal, and are closed.
+package graceful
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Report summarizes a shutdown
+type Report struct {
+	Drained int           // Connections whose handler returned before the deadline
+	Forced  int           // Connections closed at the deadline
+	Elapsed time.Duration // From signal to last connection gone
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%d drained, %d force-closed in %v", r.Drained, r.Forced, r.Elapsed.Round(time.Millisecond))
+}
+
+// Reasons passed to Server.Reject
+const (
+	RejectMaxConns = "max_conns" // MaxConns connections already open
+	RejectPerIP    = "per_ip"    // MaxConnsPerIP open from this address
+)
+
+// rejectTimeout bounds the time Reject gets to write its refusal
+const rejectTimeout = time.Second
+
+// AdmissionStats counts connections let in and turned away
+type AdmissionStats struct {
+	Open             int `json:"open"`
+	Peak             int `json:"peak"`
+	Accepted         int `json:"accepted"`
+	RejectedMaxConns int `json:"rejected_max_conns"`
+	RejectedPerIP    int `json:"rejected_per_ip"`
+}
+
+type connState struct {
+	idle bool
+	ip   string
+}
+
+// Server tracks the connections of one listener
+type Server struct {
+	DrainTimeout time.Duration
+
+	// Admission limits, 0 = unlimited. Set before Serve.
+	MaxConns      int
+	MaxConnsPerIP int
+	// Reject, if set, is called for each connection over a limit before
+	// it is closed, with a short deadline already set on conn
+	Reject func(conn net.Conn, reason string)
+
+	mu        sync.Mutex
+	conns     map[net.Conn]*connState
+	perIP     map[string]int
+	admission AdmissionStats
+	slots     chan struct{} // Semaphore of MaxConns slots
+	shutdown  chan struct{}
+	wg        sync.WaitGroup
+}
+
+func New(drainTimeout time.Duration) *Server {
+	return &Server{
+		DrainTimeout: drainTimeout,
+		conns:        make(map[net.Conn]*connState),
+		perIP:        make(map[string]int),
+		shutdown:     make(chan struct{}),
+	}
+}
+
+// Serve accepts connections and runs handle for each in its own goroutine
+// until SIGINT or SIGTERM, then drains and returns the report.
+// handle is responsible for closing its connection.
+func (s *Server) Serve(listener net.Listener, handle func(conn net.Conn)) Report {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if s.MaxConns > 0 {
+		s.slots = make(chan struct{}, s.MaxConns)
+	}
+
+	go s.acceptLoop(listener, handle)
+
+	sig := <-signals
+	fmt.Printf("\nReceived %v: no longer accepting, draining connections (up to %v)\n", sig, s.DrainTimeout)
+	start := time.Now()
+
+	s.mu.Lock()
+	close(s.shutdown)
+	inFlight := len(s.conns)
+	for conn, st := range s.conns {
+		if st.idle {
+			// Unblock the pending read; the handler sees ShuttingDown
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+	listener.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(s.DrainTimeout)
+	defer timer.Stop()
+
+	forced := 0
+	select {
+	case <-done:
+	case <-timer.C:
+		forced = s.forceClose()
+		<-done
+	case <-signals:
+		fmt.Println("Second signal: force-closing now")
+		forced = s.forceClose()
+		<-done
+	}
+
+	return Report{Drained: inFlight - forced, Forced: forced, Elapsed: time.Since(start)}
+}
+
+func (s *Server) acceptLoop(listener net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.ShuttingDown() {
+				return
+			}
+			fmt.Printf("Accept error: %v\n", err)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.ShuttingDown() {
+			// Accepted in the window before the listener closed
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		ip := remoteIP(conn)
+		if reason := s.admit(ip); reason != "" {
+			s.mu.Unlock()
+			go s.reject(conn, reason)
+			continue
+		}
+		s.conns[conn] = &connState{idle: true, ip: ip}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.untrack(conn)
+			handle(conn)
+		}()
+	}
+}
+
+// admit takes a connection slot and counts ip, or returns why it can't.
+// Called with s.mu held.
+func (s *Server) admit(ip string) string {
+	if s.MaxConnsPerIP > 0 && s.perIP[ip] >= s.MaxConnsPerIP {
+		s.admission.RejectedPerIP++
+		return RejectPerIP
+	}
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			// Full: refuse now rather than block Accept, so waiting
+			// clients get an answer instead of a stalled handshake
+			s.admission.RejectedMaxConns++
+			return RejectMaxConns
+		}
+	}
+
+	s.perIP[ip]++
+	s.admission.Accepted++
+	s.admission.Open++
+	s.admission.Peak = max(s.admission.Peak, s.admission.Open)
+	return ""
+}
+
+func (s *Server) reject(conn net.Conn, reason string) {
+	defer conn.Close()
+	if s.Reject != nil {
+		conn.SetDeadline(time.Now().Add(rejectTimeout))
+		s.Reject(conn, reason)
+	}
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	if st, ok := s.conns[conn]; ok {
+		if s.perIP[st.ip]--; s.perIP[st.ip] == 0 {
+			delete(s.perIP, st.ip)
+		}
+	}
+	delete(s.conns, conn)
+	s.admission.Open--
+	if s.slots != nil {
+		<-s.slots
+	}
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// Stats returns a snapshot of admission counters
+func (s *Server) Stats() AdmissionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.admission
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (s *Server) forceClose() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return len(s.conns)
+}
+
+// Idle marks conn as waiting for its next message.
+// It returns false once shutdown has started: the handler should send its
+// goodbye and return instead of reading again.
+func (s *Server) Idle(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.conns[conn]; ok {
+		st.idle = true
+	}
+	return !s.ShuttingDown()
+}
+
+// Active marks conn as processing a message, which shutdown lets finish.
+// If shutdown already woke the connection, the wake-up deadline is cleared
+// so the message that just arrived can still be read in full.
+func (s *Server) Active(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.conns[conn]
+	if !ok {
+		return
+	}
+	if st.idle && s.ShuttingDown() {
+		conn.SetReadDeadline(time.Time{})
+	}
+	st.idle = false
+}
+
+// ShuttingDown reports whether a shutdown signal has been received
+func (s *Server) ShuttingDown() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed when shutdown starts, for handlers that stream
+// indefinitely and never return to Idle
+func (s *Server) Done() <-chan struct{} {
+	return s.shutdown
+}
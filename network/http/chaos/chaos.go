@@ -0,0 +1,436 @@
+// Package chaos is an upstream that fails on purpose, for exercising a
+// proxy's timeouts, error handling and retries. It is an http.Handler
+// configured by a Config, which query parameters of the same names
+// override per request:
+//
+//	/chaos?latency=lognormal:50ms,1&error_rate=0.1
+//	/chaos?fault=rst_after_headers
+//	/chaos?drip=200ms&chunk_size=8
+//
+// Latency (before the response starts):
+//
+//	150ms                fixed
+//	uniform:10ms-200ms   uniform between the bounds
+//	normal:100ms,20ms    mean, standard deviation (clamped at 0)
+//	exp:50ms             exponential with this mean
+//	lognormal:50ms,1     median, sigma: mostly fast with a long tail
+//
+// Errors: error_rate of requests get a status drawn from error_status
+// (default "500,502,503,504") instead of the body.
+//
+// Faults, applied to fault_rate of requests (default all), break the
+// response at the socket level:
+//
+//	partial            full Content-Length, then only partial of the body and close
+//	wrong_length       Content-Length off by length_delta bytes
+//	rst_after_headers  the header, then a TCP reset (RST)
+//	half_close         the header and partial body, then FIN (CloseWrite)
+//	                   while the socket stays open for reading
+//	rst                a reset before any response
+//
+// drip sends the body chunk_size bytes at a time with this pause between,
+// a response that is alive but slow.
+//
+// Every decision for a request comes from its own RNG, seeded from the
+// handler's (Config.Seed) and reported in the X-Chaos header with what
+// was applied. Passing ?seed=N replays exactly that request.
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"claude-go/network/http/httpwire"
+)
+
+// Faults
+const (
+	FaultNone            = ""
+	FaultPartial         = "partial"
+	FaultWrongLength     = "wrong_length"
+	FaultRSTAfterHeaders = "rst_after_headers"
+	FaultHalfClose       = "half_close"
+	FaultRST             = "rst"
+)
+
+// halfCloseHold bounds how long a half-closed socket is held open
+const halfCloseHold = 30 * time.Second
+
+type Config struct {
+	Latency     string  `json:"latency"`
+	ErrorRate   float64 `json:"error_rate"`
+	ErrorStatus string  `json:"error_status"` // Comma-separated statuses to draw from
+	Fault       string  `json:"fault"`
+	FaultRate   float64 `json:"fault_rate"`   // 0 = every request when Fault is set
+	Partial     float64 `json:"partial"`      // Fraction of the body partial and half_close send
+	LengthDelta int     `json:"length_delta"` // wrong_length: declared minus actual
+	Drip        string  `json:"drip"`         // Pause between body chunks, e.g. "100ms"
+	ChunkSize   int     `json:"chunk_size"`
+	BodySize    int     `json:"body_size"`
+	Seed        int64   `json:"seed"`
+}
+
+// DefaultConfig is a well-behaved upstream; set fields to add chaos
+var DefaultConfig = Config{
+	ErrorStatus: "500,502,503,504",
+	Partial:     0.5,
+	LengthDelta: 16,
+	ChunkSize:   64,
+	BodySize:    1024,
+	Seed:        1,
+}
+
+// LoadConfig reads a JSON config over DefaultConfig
+func LoadConfig(path string) (Config, error) {
+	cfg := DefaultConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// plan is a Config parsed and checked
+type plan struct {
+	latency     latencyFunc
+	latencySpec string
+	errorRate   float64
+	statuses    []int
+	fault       string
+	faultRate   float64
+	partial     float64
+	lengthDelta int
+	drip        time.Duration
+	chunkSize   int
+	bodySize    int
+}
+
+func (c Config) plan() (*plan, error) {
+	p := &plan{
+		latencySpec: c.Latency,
+		errorRate:   c.ErrorRate,
+		fault:       c.Fault,
+		faultRate:   c.FaultRate,
+		partial:     c.Partial,
+		lengthDelta: c.LengthDelta,
+		chunkSize:   c.ChunkSize,
+		bodySize:    c.BodySize,
+	}
+
+	var err error
+	if p.latency, err = parseLatency(c.Latency); err != nil {
+		return nil, err
+	}
+	for s := range strings.SplitSeq(c.ErrorStatus, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("bad error_status %q", s)
+		}
+		p.statuses = append(p.statuses, code)
+	}
+	if c.Drip != "" {
+		if p.drip, err = time.ParseDuration(c.Drip); err != nil {
+			return nil, fmt.Errorf("bad drip: %w", err)
+		}
+	}
+
+	switch c.Fault {
+	case FaultNone, FaultPartial, FaultWrongLength, FaultRSTAfterHeaders, FaultHalfClose, FaultRST:
+	default:
+		return nil, fmt.Errorf("unknown fault %q", c.Fault)
+	}
+	if p.fault != FaultNone && p.faultRate == 0 {
+		p.faultRate = 1
+	}
+	switch {
+	case p.errorRate < 0 || p.errorRate > 1, p.faultRate < 0 || p.faultRate > 1:
+		return nil, fmt.Errorf("rates must be between 0 and 1")
+	case p.partial < 0 || p.partial > 1:
+		return nil, fmt.Errorf("partial must be between 0 and 1")
+	case p.chunkSize <= 0, p.bodySize < 0:
+		return nil, fmt.Errorf("chunk_size must be positive and body_size not negative")
+	}
+	return p, nil
+}
+
+// withQuery overrides c with the query parameters named like its JSON
+// fields
+func (c Config) withQuery(q url.Values) (Config, error) {
+	var err error
+	setFloat := func(name string, dst *float64) {
+		if v := q.Get(name); v != "" && err == nil {
+			*dst, err = strconv.ParseFloat(v, 64)
+		}
+	}
+	setInt := func(name string, dst *int) {
+		if v := q.Get(name); v != "" && err == nil {
+			*dst, err = strconv.Atoi(v)
+		}
+	}
+	setString := func(name string, dst *string) {
+		if q.Has(name) {
+			*dst = q.Get(name)
+		}
+	}
+
+	setString("latency", &c.Latency)
+	setFloat("error_rate", &c.ErrorRate)
+	setString("error_status", &c.ErrorStatus)
+	setString("fault", &c.Fault)
+	setFloat("fault_rate", &c.FaultRate)
+	setFloat("partial", &c.Partial)
+	setInt("length_delta", &c.LengthDelta)
+	setString("drip", &c.Drip)
+	setInt("chunk_size", &c.ChunkSize)
+	setInt("body_size", &c.BodySize)
+	if v := q.Get("seed"); v != "" && err == nil {
+		c.Seed, err = strconv.ParseInt(v, 10, 64)
+	}
+	return c, err
+}
+
+// Handler serves chaotic responses
+type Handler struct {
+	cfg Config
+
+	mu  sync.Mutex
+	rng *rand.Rand // Seeds the per-request RNGs
+}
+
+func New(cfg Config) (*Handler, error) {
+	if _, err := cfg.plan(); err != nil {
+		return nil, fmt.Errorf("chaos: %w", err)
+	}
+	return &Handler{cfg: cfg, rng: rand.New(rand.NewSource(cfg.Seed))}, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg, err := h.cfg.withQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "chaos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	p, err := cfg.plan()
+	if err != nil {
+		http.Error(w, "chaos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seed := cfg.Seed
+	if !r.URL.Query().Has("seed") {
+		h.mu.Lock()
+		seed = h.rng.Int63()
+		h.mu.Unlock()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	// Draw everything up front, in a fixed order, so a seed always
+	// produces the same request whatever the outcome
+	delay := p.latency(rng)
+	status := http.StatusOK
+	if rng.Float64() < p.errorRate {
+		status = p.statuses[rng.Intn(len(p.statuses))]
+	}
+	fault := FaultNone
+	if rng.Float64() < p.faultRate {
+		fault = p.fault
+	}
+
+	applied := fmt.Sprintf("seed=%d latency=%v", seed, delay.Round(time.Microsecond))
+	if status != http.StatusOK {
+		applied += fmt.Sprintf(" status=%d", status)
+	} else if fault != FaultNone {
+		applied += " fault=" + fault
+	}
+	log.Printf("[Chaos] %s %s: %s", r.Method, r.URL.RequestURI(), applied)
+
+	select {
+	case <-time.After(delay):
+	case <-r.Context().Done():
+		return
+	}
+
+	if status != http.StatusOK {
+		w.Header().Set("X-Chaos", applied)
+		http.Error(w, fmt.Sprintf("chaos: injected %d", status), status)
+		return
+	}
+
+	body := makeBody(p.bodySize)
+	if fault == FaultNone {
+		w.Header().Set("X-Chaos", applied)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		flusher, _ := w.(http.Flusher)
+		drip(w, body, p, func() {
+			if flusher != nil {
+				flusher.Flush()
+			}
+		})
+		return
+	}
+
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "chaos: socket faults need HTTP/1.x", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	rawFault(conn, fault, body, p, applied)
+}
+
+// rawFault writes a broken response straight to the socket
+func rawFault(conn net.Conn, fault string, body []byte, p *plan, applied string) {
+	tcp, _ := conn.(*net.TCPConn)
+	reset := func() {
+		if tcp != nil {
+			tcp.SetLinger(0) // Close sends RST instead of FIN
+		}
+	}
+
+	if fault == FaultRST {
+		reset()
+		return
+	}
+
+	length := len(body)
+	if fault == FaultWrongLength {
+		length = max(len(body)+p.lengthDelta, 0)
+	}
+	head := &httpwire.Response{StatusCode: http.StatusOK}
+	head.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	head.Header.Set("Content-Length", strconv.Itoa(length))
+	head.Header.Set("Connection", "close")
+	head.Header.Set("X-Chaos", applied)
+	if err := httpwire.WriteResponseHead(conn, head); err != nil {
+		return
+	}
+
+	switch fault {
+	case FaultRSTAfterHeaders:
+		reset()
+	case FaultPartial:
+		drip(conn, body[:int(float64(len(body))*p.partial)], p, nil)
+	case FaultWrongLength:
+		drip(conn, body, p, nil)
+	case FaultHalfClose:
+		drip(conn, body[:int(float64(len(body))*p.partial)], p, nil)
+		if tcp != nil {
+			tcp.CloseWrite()
+		}
+		// Keep the read side open until the peer gives up
+		conn.SetReadDeadline(time.Now().Add(halfCloseHold))
+		io.Copy(io.Discard, conn)
+	}
+}
+
+// drip writes body in chunks, pausing p.drip between them
+func drip(w io.Writer, body []byte, p *plan, flush func()) {
+	if p.drip == 0 {
+		w.Write(body)
+		return
+	}
+	for len(body) > 0 {
+		n := min(p.chunkSize, len(body))
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		if flush != nil {
+			flush()
+		}
+		body = body[n:]
+		if len(body) > 0 {
+			time.Sleep(p.drip)
+		}
+	}
+}
+
+// makeBody returns size bytes of numbered lines, so a truncated body
+// shows where it was cut
+func makeBody(size int) []byte {
+	var b strings.Builder
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "%05d the quick brown fox jumps over the lazy dog\n", i)
+	}
+	return []byte(b.String()[:size])
+}
+
+type latencyFunc func(rng *rand.Rand) time.Duration
+
+func parseLatency(spec string) (latencyFunc, error) {
+	if spec == "" {
+		return func(*rand.Rand) time.Duration { return 0 }, nil
+	}
+	dist, args, found := strings.Cut(spec, ":")
+	if !found {
+		d, err := time.ParseDuration(spec)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("bad latency %q", spec)
+		}
+		return func(*rand.Rand) time.Duration { return d }, nil
+	}
+
+	bad := fmt.Errorf("bad latency %q: want uniform:MIN-MAX, normal:MEAN,STDDEV, exp:MEAN or lognormal:MEDIAN,SIGMA", spec)
+	switch dist {
+	case "uniform":
+		lo, hi, ok := twoDurations(args, "-")
+		if !ok || hi < lo {
+			return nil, bad
+		}
+		return func(rng *rand.Rand) time.Duration {
+			return lo + time.Duration(rng.Int63n(int64(hi-lo)+1))
+		}, nil
+	case "normal":
+		mean, stddev, ok := twoDurations(args, ",")
+		if !ok {
+			return nil, bad
+		}
+		return func(rng *rand.Rand) time.Duration {
+			return max(mean+time.Duration(rng.NormFloat64()*float64(stddev)), 0)
+		}, nil
+	case "exp":
+		mean, err := time.ParseDuration(args)
+		if err != nil || mean < 0 {
+			return nil, bad
+		}
+		return func(rng *rand.Rand) time.Duration {
+			return time.Duration(rng.ExpFloat64() * float64(mean))
+		}, nil
+	case "lognormal":
+		m, s, _ := strings.Cut(args, ",")
+		median, err1 := time.ParseDuration(m)
+		sigma, err2 := strconv.ParseFloat(s, 64)
+		if err1 != nil || err2 != nil || median < 0 || sigma < 0 {
+			return nil, bad
+		}
+		return func(rng *rand.Rand) time.Duration {
+			return time.Duration(float64(median) * math.Exp(sigma*rng.NormFloat64()))
+		}, nil
+	}
+	return nil, bad
+}
+
+func twoDurations(s, sep string) (a, b time.Duration, ok bool) {
+	x, y, found := strings.Cut(s, sep)
+	if !found {
+		return 0, 0, false
+	}
+	a, err1 := time.ParseDuration(x)
+	b, err2 := time.ParseDuration(y)
+	return a, b, err1 == nil && err2 == nil && a >= 0 && b >= 0
+}
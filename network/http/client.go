@@ -3,20 +3,45 @@
 //
 // Counterpart to server.go - tests against it
 // Run: go run client.go (with server.go running on :8083)
+//
+// Connection reuse: Client keeps idle connections per host and reuses them
+// for the next request, like net/http's Transport. Benchmark it against the
+// keep-alive server:
+//   go run client.go -bench -host localhost:8084 -n 200
 
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"claude-go/network/http/httpwire"
 )
 
 func main() {
-	baseURL := "localhost:8083"
+	host := flag.String("host", "localhost:8083", "server address")
+	bench := flag.Bool("bench", false, "compare keep-alive reuse against a new connection per request")
+	n := flag.Int("n", 100, "requests per benchmark run")
+	path := flag.String("path", "/api/time", "path requested by the benchmark")
+	flag.Parse()
+
+	if *bench {
+		runBenchmark(*host, *path, *n)
+		return
+	}
+
+	baseURL := *host
+	client := NewClient()
 
 	fmt.Println("=== Minimal HTTP/1.1 Client ===")
 	fmt.Println("Testing against server at", baseURL)
@@ -24,7 +49,7 @@ func main() {
 
 	// Test 1: GET /
 	fmt.Println("--- Test 1: GET / ---")
-	resp, err := httpGet(baseURL, "/")
+	resp, err := client.Get(baseURL, "/")
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
@@ -33,7 +58,7 @@ func main() {
 
 	// Test 2: GET /api/time
 	fmt.Println("\n--- Test 2: GET /api/time ---")
-	resp, err = httpGet(baseURL, "/api/time")
+	resp, err = client.Get(baseURL, "/api/time")
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
@@ -42,7 +67,7 @@ func main() {
 
 	// Test 3: POST /api/echo
 	fmt.Println("\n--- Test 3: POST /api/echo ---")
-	resp, err = httpPost(baseURL, "/api/echo", "Hello from raw TCP client!")
+	resp, err = client.Post(baseURL, "/api/echo", "Hello from raw TCP client!")
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
@@ -51,7 +76,7 @@ func main() {
 
 	// Test 4: GET /headers
 	fmt.Println("\n--- Test 4: GET /headers ---")
-	resp, err = httpGet(baseURL, "/headers")
+	resp, err = client.Get(baseURL, "/headers")
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
@@ -60,169 +85,470 @@ func main() {
 
 	// Test 5: GET /notfound (404)
 	fmt.Println("\n--- Test 5: GET /notfound (expect 404) ---")
-	resp, err = httpGet(baseURL, "/notfound")
+	resp, err = client.Get(baseURL, "/notfound")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		printResponse(resp, false)
+	}
+
+	// Test 6: POST /api/echo with a chunked request body
+	fmt.Println("\n--- Test 6: POST /api/echo (chunked request) ---")
+	resp, err = client.PostChunked(baseURL, "/api/echo", []string{"Hello ", "in ", "chunks!"})
 	if err != nil {
 		fmt.Printf("Error: %v\n", err)
 	} else {
 		printResponse(resp, false)
 	}
+
+	// Test 7: GET /api/stream - chunked response with trailer
+	fmt.Println("\n--- Test 7: GET /api/stream (chunked response) ---")
+	resp, err = client.Get(baseURL, "/api/stream")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		printResponse(resp, false)
+	}
+
+	fmt.Printf("\nConnections: %s\n", client.Stats())
 }
 
 // HTTPResponse holds parsed response
 type HTTPResponse struct {
 	StatusCode   int
 	StatusText   string
-	Headers      map[string]string
+	Headers      httpwire.Header // Every field, in the order received
+	Trailers     httpwire.Header // Only set for chunked responses
+	Chunks       int             // Number of chunks received (chunked only)
 	Body         string
 	ResponseTime time.Duration
+	Timing       Timing
 }
 
-// httpGet performs GET request using raw TCP
-func httpGet(host, path string) (*HTTPResponse, error) {
-	return httpRequest(host, "GET", path, nil, "")
+// Timing breaks one request down into its phases
+type Timing struct {
+	Dial     time.Duration // TCP connect; zero when a pooled connection was reused
+	Write    time.Duration // Sending the request
+	TTFB     time.Duration // Request sent -> first response byte (server think time + RTT)
+	BodyRead time.Duration // First byte -> full response parsed
+	Reused   bool
+}
+
+func (t Timing) String() string {
+	conn := "new conn"
+	if t.Reused {
+		conn = "reused"
+	}
+	return fmt.Sprintf("dial=%v write=%v ttfb=%v read=%v (%s)", t.Dial, t.Write, t.TTFB, t.BodyRead, conn)
+}
+
+// Client sends requests over raw TCP, pooling idle keep-alive connections
+// per host:port.
+type Client struct {
+	MaxIdlePerHost    int           // Idle connections kept per host
+	IdleTimeout       time.Duration // Idle connections older than this are closed, not reused
+	DialTimeout       time.Duration
+	RequestTimeout    time.Duration // Deadline for write + full response read
+	DisableKeepAlives bool          // Send Connection: close and never pool
+
+	mu     sync.Mutex
+	idle   map[string][]*pooledConn // host -> idle connections, most recent last
+	dials  int
+	reuses int
+	closes int // Connections closed instead of being pooled, failed ones included
+}
+
+// pooledConn is a connection plus the reader that owns its buffered bytes
+type pooledConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	idleSince time.Time
+	expires   time.Time // From the server's Keep-Alive: timeout=N, if sent
+	requests  int       // Requests sent on this connection
+	maxReqs   int       // From the server's Keep-Alive: max=N (0 = unknown)
+}
+
+func NewClient() *Client {
+	return &Client{
+		MaxIdlePerHost: 2,
+		IdleTimeout:    90 * time.Second,
+		DialTimeout:    5 * time.Second,
+		RequestTimeout: 10 * time.Second,
+		idle:           make(map[string][]*pooledConn),
+	}
 }
 
-// httpPost performs POST request using raw TCP
-func httpPost(host, path, body string) (*HTTPResponse, error) {
+// Get performs GET request using raw TCP
+func (c *Client) Get(host, path string) (*HTTPResponse, error) {
+	return c.Do(host, "GET", path, nil, "")
+}
+
+// Post performs POST request using raw TCP
+func (c *Client) Post(host, path, body string) (*HTTPResponse, error) {
 	headers := map[string]string{
 		"Content-Type": "text/plain",
 	}
-	return httpRequest(host, "POST", path, headers, body)
+	return c.Do(host, "POST", path, headers, body)
 }
 
-// httpRequest builds and sends HTTP request over TCP
-func httpRequest(host, method, path string, headers map[string]string, body string) (*HTTPResponse, error) {
-	start := time.Now()
+// Do builds and sends HTTP request over TCP. httpwire serializes it, so a
+// method, path or header name with CR or LF in it is refused, not sent.
+func (c *Client) Do(host, method, path string, headers map[string]string, body string) (*HTTPResponse, error) {
+	// Request line: METHOD PATH HTTP/1.1
+	req := &httpwire.Request{Method: method, Target: path, Body: []byte(body)}
+	c.baseHeader(&req.Header, host)
 
-	// Connect via TCP
-	conn, err := net.DialTimeout("tcp", host, 5*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("connection failed: %w", err)
+	// Custom headers; Content-Length for the body is set by WriteRequest
+	for k, v := range headers {
+		req.Header.Set(k, v)
 	}
-	defer conn.Close()
 
-	// Set read/write deadline
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var raw bytes.Buffer
+	if err := httpwire.WriteRequest(&raw, req); err != nil {
+		return nil, err
+	}
+	return c.roundTrip(host, method, raw.Bytes())
+}
 
-	// Build request
-	// Request line: METHOD PATH HTTP/1.1
-	var req strings.Builder
-	req.WriteString(fmt.Sprintf("%s %s HTTP/1.1\r\n", method, path))
+// PostChunked sends the body as one chunk per element, with a
+// chunk extension on the first chunk and a trailer after the last one
+func (c *Client) PostChunked(host, path string, chunks []string) (*HTTPResponse, error) {
+	req := &httpwire.Request{Method: "POST", Target: path}
+	c.baseHeader(&req.Header, host)
+	req.Header.Set("Content-Type", "text/plain")
+	// No Content-Length: the length is unknown until the last chunk
+	req.Header.Set("Transfer-Encoding", "chunked")
+	req.Header.Set("Trailer", "X-Chunk-Count")
+	req.Trailer.Set("X-Chunk-Count", strconv.Itoa(len(chunks)))
+
+	var raw bytes.Buffer
+	if err := httpwire.WriteRequestHead(&raw, req); err != nil {
+		return nil, err
+	}
+	cw := httpwire.NewChunkedWriter(&raw)
+	for i, chunk := range chunks {
+		if chunk == "" {
+			continue // A zero-size chunk would end the body early
+		}
+		if i == 0 {
+			// Chunk extension: receivers must ignore ones they don't understand
+			fmt.Fprintf(&raw, "%x;note=first\r\n%s\r\n", len(chunk), chunk)
+		} else {
+			cw.Write([]byte(chunk))
+		}
+	}
+	// Last chunk, trailer section, then the final CRLF
+	cw.Close(&req.Trailer)
 
+	return c.roundTrip(host, "POST", raw.Bytes())
+}
+
+// baseHeader sets the fields every request carries
+func (c *Client) baseHeader(h *httpwire.Header, host string) {
 	// Host header (required in HTTP/1.1)
-	req.WriteString(fmt.Sprintf("Host: %s\r\n", host))
+	h.Set("Host", host)
+	h.Set("User-Agent", "RawTCPClient/1.0")
+	// Connection header: HTTP/1.1 is keep-alive unless we say otherwise
+	if c.DisableKeepAlives {
+		h.Set("Connection", "close")
+	}
+}
 
-	// User-Agent
-	req.WriteString("User-Agent: RawTCPClient/1.0\r\n")
+// roundTrip sends a serialized request and reads the response, reusing an
+// idle connection when possible.
+//
+// A pooled connection may have been closed by the server while it sat idle
+// (its keep-alive timeout fired). We only find out when the write or first
+// read fails, so idempotent requests are retried once on a fresh connection.
+//
+// The response to a HEAD has no body whatever its header says, so only the
+// header is read: reading on would take the next response's bytes, or wait
+// for a body that never comes.
+func (c *Client) roundTrip(host, method string, rawReq []byte) (*HTTPResponse, error) {
+	start := time.Now()
 
-	// Connection header
-	req.WriteString("Connection: close\r\n")
+	for attempt := 0; ; attempt++ {
+		var timing Timing
+		pc := c.getIdle(host)
+		if pc != nil {
+			timing.Reused = true
+		} else {
+			dialStart := time.Now()
+			conn, err := net.DialTimeout("tcp", host, c.DialTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("connection failed: %w", err)
+			}
+			timing.Dial = time.Since(dialStart)
+			pc = &pooledConn{conn: conn, reader: bufio.NewReader(conn)}
+			c.mu.Lock()
+			c.dials++
+			c.mu.Unlock()
+		}
+		pc.requests++
+		retryable := timing.Reused && attempt == 0 && isIdempotent(method)
 
-	// Content-Length for body
-	if body != "" {
-		req.WriteString(fmt.Sprintf("Content-Length: %d\r\n", len(body)))
-	}
+		// Set read/write deadline
+		pc.conn.SetDeadline(time.Now().Add(c.RequestTimeout))
 
-	// Custom headers
-	for k, v := range headers {
-		req.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
-	}
+		// Send request
+		writeStart := time.Now()
+		_, err := pc.conn.Write(rawReq)
+		timing.Write = time.Since(writeStart)
+		if err != nil {
+			c.discard(pc)
+			if retryable {
+				continue
+			}
+			return nil, fmt.Errorf("write failed: %w", err)
+		}
 
-	// End of headers
-	req.WriteString("\r\n")
+		// Time to first byte: wait for the response to start arriving
+		ttfbStart := time.Now()
+		if _, err := pc.reader.Peek(1); err != nil {
+			c.discard(pc)
+			if retryable && isStaleConnError(err) {
+				continue
+			}
+			return nil, fmt.Errorf("read response failed: %w", err)
+		}
+		timing.TTFB = time.Since(ttfbStart)
+
+		// Parse response
+		readStart := time.Now()
+		head := method == "HEAD"
+		resp, err := httpwire.ReadResponseHeader(pc.reader, httpwire.DefaultLimits)
+		if err == nil && !head {
+			err = httpwire.ReadResponseBody(pc.reader, resp, httpwire.DefaultLimits)
+		}
+		timing.BodyRead = time.Since(readStart)
+		if err != nil {
+			c.discard(pc)
+			return nil, fmt.Errorf("read response failed: %w", err)
+		}
 
-	// Body
-	if body != "" {
-		req.WriteString(body)
+		c.release(host, pc, resp, head)
+
+		return &HTTPResponse{
+			StatusCode:   resp.StatusCode,
+			StatusText:   resp.Reason,
+			Headers:      resp.Header,
+			Trailers:     resp.Trailer,
+			Chunks:       resp.Chunks,
+			Body:         string(resp.Body),
+			ResponseTime: time.Since(start),
+			Timing:       timing,
+		}, nil
 	}
+}
 
-	// Send request
-	_, err = conn.Write([]byte(req.String()))
-	if err != nil {
-		return nil, fmt.Errorf("write failed: %w", err)
+// getIdle pops the most recently used idle connection that is still fresh
+func (c *Client) getIdle(host string) *pooledConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conns := c.idle[host]
+	for len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+
+		now := time.Now()
+		if now.Sub(pc.idleSince) > c.IdleTimeout || (!pc.expires.IsZero() && now.After(pc.expires)) {
+			pc.conn.Close() // Server has (or will have) dropped it
+			c.closes++
+			continue
+		}
+		c.idle[host] = conns
+		c.reuses++
+		return pc
 	}
-
-	// Parse response
-	return parseResponse(conn, start)
+	c.idle[host] = conns
+	return nil
 }
 
-// parseResponse reads and parses HTTP response
-func parseResponse(conn net.Conn, start time.Time) (*HTTPResponse, error) {
-	reader := bufio.NewReader(conn)
+// release returns the connection to the pool if both sides agreed to keep it
+// open, and closes it otherwise. head says the response was to a HEAD, so
+// no body was read.
+func (c *Client) release(host string, pc *pooledConn, resp *httpwire.Response, head bool) {
+	keep := !c.DisableKeepAlives &&
+		resp.Proto == "HTTP/1.1" &&
+		!resp.Header.HasToken("Connection", "close") &&
+		// A body read until EOF means the server closed the connection
+		(head || resp.Header.Has("Content-Length") || resp.Chunked)
+
+	// Keep-Alive: timeout=30, max=100 tells us when the server will give up
+	timeout, max := parseKeepAlive(resp.Header.Get("Keep-Alive"))
+	if max > 0 {
+		pc.maxReqs = max
+	}
+	if pc.maxReqs > 0 && pc.requests >= pc.maxReqs {
+		keep = false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Read status line: HTTP/1.1 STATUS TEXT
-	statusLine, err := reader.ReadString('\n')
-	if err != nil {
-		return nil, fmt.Errorf("read status failed: %w", err)
+	if !keep || len(c.idle[host]) >= c.MaxIdlePerHost {
+		pc.conn.Close()
+		c.closes++
+		return
 	}
-	statusLine = strings.TrimSpace(statusLine)
 
-	// Parse status line
-	parts := strings.SplitN(statusLine, " ", 3)
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid status line: %s", statusLine)
+	pc.conn.SetDeadline(time.Time{})
+	pc.idleSince = time.Now()
+	pc.expires = time.Time{}
+	if timeout > 0 {
+		// Leave a margin so we don't race the server's own timer
+		pc.expires = pc.idleSince.Add(timeout - timeout/10)
 	}
+	c.idle[host] = append(c.idle[host], pc)
+}
 
-	statusCode, err := strconv.Atoi(parts[1])
-	if err != nil {
-		return nil, fmt.Errorf("invalid status code: %s", parts[1])
+// discard closes a connection a request failed on
+func (c *Client) discard(pc *pooledConn) {
+	pc.conn.Close()
+	c.mu.Lock()
+	c.closes++
+	c.mu.Unlock()
+}
+
+// CloseIdle closes every pooled connection
+func (c *Client) CloseIdle() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for host, conns := range c.idle {
+		for _, pc := range conns {
+			pc.conn.Close()
+		}
+		delete(c.idle, host)
 	}
+}
 
-	statusText := ""
-	if len(parts) == 3 {
-		statusText = parts[2]
+// Stats summarizes connection usage so far
+func (c *Client) Stats() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idle := 0
+	for _, conns := range c.idle {
+		idle += len(conns)
 	}
+	return fmt.Sprintf("%d dialed, %d reused, %d closed, %d idle", c.dials, c.reuses, c.closes, idle)
+}
 
-	// Read headers
-	headers := make(map[string]string)
-	for {
-		line, err := reader.ReadString('\n')
+// parseKeepAlive extracts "timeout=N, max=M" from a Keep-Alive header
+func parseKeepAlive(value string) (timeout time.Duration, max int) {
+	for _, param := range strings.Split(value, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
 		if err != nil {
-			return nil, fmt.Errorf("read header failed: %w", err)
+			continue
 		}
-		line = strings.TrimSpace(line)
-		if line == "" {
-			break // End of headers
+		switch strings.ToLower(k) {
+		case "timeout":
+			timeout = time.Duration(n) * time.Second
+		case "max":
+			max = n
 		}
+	}
+	return timeout, max
+}
 
-		colonIdx := strings.Index(line, ":")
-		if colonIdx > 0 {
-			key := strings.TrimSpace(line[:colonIdx])
-			value := strings.TrimSpace(line[colonIdx+1:])
-			headers[strings.ToLower(key)] = value
-		}
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
 	}
+	return false
+}
 
-	// Read body based on Content-Length
-	var body string
-	if lengthStr, ok := headers["content-length"]; ok {
-		length, _ := strconv.Atoi(lengthStr)
-		if length > 0 {
-			bodyBytes := make([]byte, length)
-			n, err := reader.Read(bodyBytes)
-			if err != nil && n == 0 {
-				return nil, fmt.Errorf("read body failed: %w", err)
-			}
-			body = string(bodyBytes[:n])
+// isStaleConnError reports errors typical of reusing a connection the
+// server already closed: EOF before any byte, or a reset. A timeout is
+// not one: the server may be slow rather than gone, and resending would
+// only double the wait and its load.
+func isStaleConnError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// runBenchmark sends n sequential requests twice - once with a new TCP
+// connection per request, once reusing pooled connections - and compares
+// the per-phase averages
+func runBenchmark(host, path string, n int) {
+	fmt.Printf("=== Keep-alive benchmark: %d x GET %s on %s ===\n\n", n, path, host)
+
+	fresh := NewClient()
+	fresh.DisableKeepAlives = true
+	freshAvg, freshTotal, err := benchRun(fresh, host, path, n)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	pooled := NewClient()
+	pooledAvg, pooledTotal, err := benchRun(pooled, host, path, n)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	pooled.CloseIdle()
+
+	fmt.Printf("%-22s %12s %12s %12s %12s %12s\n", "", "dial", "write", "ttfb", "read", "total")
+	printBenchRow("Connection: close", freshAvg, freshTotal, n)
+	printBenchRow("Keep-alive (pooled)", pooledAvg, pooledTotal, n)
+	fmt.Println()
+	fmt.Printf("Connection: close    %s\n", fresh.Stats())
+	fmt.Printf("Keep-alive (pooled)  %s\n", pooled.Stats())
+	if pooledTotal > 0 {
+		fmt.Printf("\nSpeedup: %.2fx\n", float64(freshTotal)/float64(pooledTotal))
+	}
+}
+
+func benchRun(c *Client, host, path string, n int) (Timing, time.Duration, error) {
+	var sum Timing
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		resp, err := c.Get(host, path)
+		if err != nil {
+			return Timing{}, 0, err
 		}
+		sum.Dial += resp.Timing.Dial
+		sum.Write += resp.Timing.Write
+		sum.TTFB += resp.Timing.TTFB
+		sum.BodyRead += resp.Timing.BodyRead
 	}
+	total := time.Since(start)
 
-	return &HTTPResponse{
-		StatusCode:   statusCode,
-		StatusText:   statusText,
-		Headers:      headers,
-		Body:         body,
-		ResponseTime: time.Since(start),
-	}, nil
+	d := time.Duration(n)
+	return Timing{Dial: sum.Dial / d, Write: sum.Write / d, TTFB: sum.TTFB / d, BodyRead: sum.BodyRead / d}, total, nil
+}
+
+func printBenchRow(label string, avg Timing, total time.Duration, n int) {
+	fmt.Printf("%-22s %12v %12v %12v %12v %12v\n", label, avg.Dial, avg.Write, avg.TTFB, avg.BodyRead, total/time.Duration(n))
 }
 
 // printResponse displays response info
 func printResponse(resp *HTTPResponse, truncate bool) {
 	fmt.Printf("Status: %d %s\n", resp.StatusCode, resp.StatusText)
 	fmt.Printf("Response Time: %v\n", resp.ResponseTime)
+	fmt.Printf("Timing: %s\n", resp.Timing)
 	fmt.Println("Headers:")
-	for k, v := range resp.Headers {
-		fmt.Printf("  %s: %s\n", k, v)
+	for _, f := range resp.Headers.Fields() {
+		fmt.Printf("  %s: %s\n", f.Name, f.Value)
+	}
+
+	if resp.Chunks > 0 {
+		fmt.Printf("Chunks: %d\n", resp.Chunks)
+	}
+	if resp.Trailers.Len() > 0 {
+		fmt.Println("Trailers:")
+		for _, f := range resp.Trailers.Fields() {
+			fmt.Printf("  %s: %s\n", f.Name, f.Value)
+		}
 	}
 
 	body := resp.Body
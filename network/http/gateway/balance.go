@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Balancer chooses a backend for a request
+type Balancer interface {
+	// Pick chooses one of up, the backends currently available (never empty)
+	Pick(up []*Backend, r *http.Request) *Backend
+	Name() string
+}
+
+// RoundRobin hands requests to each backend in turn
+type RoundRobin struct {
+	next atomic.Uint64
+}
+
+func (rr *RoundRobin) Pick(up []*Backend, r *http.Request) *Backend {
+	return up[(rr.next.Add(1)-1)%uint64(len(up))]
+}
+
+func (rr *RoundRobin) Name() string { return "round_robin" }
+
+// LeastConn picks the backend with the fewest requests in flight. Ties
+// rotate, so an idle pool still spreads requests instead of sending them
+// all to the first backend.
+type LeastConn struct {
+	next atomic.Uint64
+}
+
+func (lc *LeastConn) Pick(up []*Backend, r *http.Request) *Backend {
+	start := int(lc.next.Add(1) % uint64(len(up)))
+	best := up[start]
+	for i := 1; i < len(up); i++ {
+		b := up[(start+i)%len(up)]
+		if b.Inflight() < best.Inflight() {
+			best = b
+		}
+	}
+	return best
+}
+
+func (lc *LeastConn) Name() string { return "least_conn" }
+
+// virtualNodes is how many points each backend has on the hash ring.
+// More points spread keys more evenly.
+const virtualNodes = 100
+
+// ConsistentHash maps a key from each request to a point on a ring of
+// backend points and takes the first backend clockwise from it that is
+// available. A backend going down only moves the keys that were its own.
+type ConsistentHash struct {
+	key  func(r *http.Request) string
+	ring []ringPoint // Sorted by hash
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend *Backend
+}
+
+// NewConsistentHash builds the ring over every backend of the pool, up or
+// not, so availability changes don't reshuffle it
+func NewConsistentHash(backends []*Backend, key func(r *http.Request) string) *ConsistentHash {
+	ch := &ConsistentHash{key: key}
+	for _, b := range backends {
+		for i := range virtualNodes {
+			ch.ring = append(ch.ring, ringPoint{hash: hash32(b.Name + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	slices.SortFunc(ch.ring, func(a, b ringPoint) int {
+		return int(int64(a.hash) - int64(b.hash))
+	})
+	return ch
+}
+
+func (ch *ConsistentHash) Pick(up []*Backend, r *http.Request) *Backend {
+	h := hash32(ch.key(r))
+	start, _ := slices.BinarySearchFunc(ch.ring, h, func(p ringPoint, h uint32) int {
+		return int(int64(p.hash) - int64(h))
+	})
+	for i := range ch.ring {
+		p := ch.ring[(start+i)%len(ch.ring)]
+		if slices.Contains(up, p.backend) {
+			return p.backend
+		}
+	}
+	return up[0] // Unreachable: every backend in up is on the ring
+}
+
+func (ch *ConsistentHash) Name() string { return "consistent_hash" }
+
+// hash32 is FNV-1a followed by the murmur3 finalizer: FNV alone maps
+// short keys that differ in one byte ("user1", "user2") to nearby points,
+// which would put them all on the same arc of the ring
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// hashKeyFunc parses the hash_key setting: "ip" (client address, the
+// default), "path", or "header:Name" (falling back to the client address
+// when the header is missing)
+func hashKeyFunc(spec string) (func(r *http.Request) string, error) {
+	clientIP := func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+
+	switch {
+	case spec == "" || spec == "ip":
+		return clientIP, nil
+	case spec == "path":
+		return func(r *http.Request) string { return r.URL.Path }, nil
+	case strings.HasPrefix(spec, "header:") && len(spec) > len("header:"):
+		name := http.CanonicalHeaderKey(strings.TrimPrefix(spec, "header:"))
+		return func(r *http.Request) string {
+			if v := r.Header.Get(name); v != "" {
+				return v
+			}
+			return clientIP(r)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown hash_key %q: want ip, path or header:Name", spec)
+}
@@ -0,0 +1,188 @@
+package gateway
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Circuit breaker, one per backend:
+//
+//	closed     requests flow; FailureThreshold failures in a row open it
+//	open       requests skip the backend for OpenFor, without trying it
+//	half-open  up to HalfOpenRequests probes go through; SuccessThreshold
+//	           successes close it, any failure opens it again
+//
+// A failure is an attempt that got no response (refused, reset, timeout,
+// malformed) or a 502/503/504 from the backend. Other statuses, 500
+// included, are the application answering and count as success.
+
+type BreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold"`
+	OpenFor          Duration `json:"open_for"`
+	HalfOpenRequests int      `json:"half_open_requests"`
+	SuccessThreshold int      `json:"success_threshold"`
+}
+
+// Breaker defaults, for fields left 0 in the config
+const (
+	defaultFailureThreshold = 5
+	defaultOpenFor          = 10 * time.Second
+	defaultHalfOpenRequests = 1
+	defaultSuccessThreshold = 1
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type breaker struct {
+	name string // Backend name, for logs
+	cfg  BreakerConfig
+
+	mu        sync.Mutex
+	state     breakerState
+	gen       int // Bumped on every state change
+	failures  int // Consecutive, while closed
+	successes int // While half-open
+	probes    int // Half-open requests in flight
+	openUntil time.Time
+	opens     int
+}
+
+func newBreaker(name string, cfg BreakerConfig) *breaker {
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = defaultFailureThreshold
+	}
+	if cfg.OpenFor == 0 {
+		cfg.OpenFor = Duration(defaultOpenFor)
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = defaultHalfOpenRequests
+	}
+	if cfg.SuccessThreshold == 0 {
+		cfg.SuccessThreshold = defaultSuccessThreshold
+	}
+	return &breaker{name: name, cfg: cfg}
+}
+
+// ready reports whether a request could be let through now; if not, wait
+// is how long until it might be
+func (br *breaker) ready() (ok bool, wait time.Duration) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.tick()
+
+	switch br.state {
+	case breakerOpen:
+		return false, time.Until(br.openUntil)
+	case breakerHalfOpen:
+		return br.probes < br.cfg.HalfOpenRequests, 0
+	}
+	return true, 0
+}
+
+// acquire lets one request through, returning the generation to report
+// its outcome against. A half-open breaker admits only its probes.
+func (br *breaker) acquire() (gen int, ok bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.tick()
+
+	switch br.state {
+	case breakerOpen:
+		return 0, false
+	case breakerHalfOpen:
+		if br.probes >= br.cfg.HalfOpenRequests {
+			return 0, false
+		}
+		br.probes++
+	}
+	return br.gen, true
+}
+
+// record reports the outcome of a request admitted at gen. Outcomes of
+// requests admitted before the last state change are ignored: a slow
+// request from the closed period must not decide a half-open trial.
+func (br *breaker) record(gen int, success bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if gen != br.gen {
+		return
+	}
+
+	switch br.state {
+	case breakerClosed:
+		if success {
+			br.failures = 0
+			return
+		}
+		br.failures++
+		if br.failures >= br.cfg.FailureThreshold {
+			br.trip()
+		}
+	case breakerHalfOpen:
+		br.probes--
+		if !success {
+			br.trip()
+			return
+		}
+		br.successes++
+		if br.successes >= br.cfg.SuccessThreshold {
+			log.Printf("[Gateway] %s: breaker closed after %d successful probes", br.name, br.successes)
+			br.set(breakerClosed)
+		}
+	}
+}
+
+// release gives back a half-open probe slot without an outcome
+func (br *breaker) release(gen int) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if gen == br.gen && br.state == breakerHalfOpen {
+		br.probes--
+	}
+}
+
+// tick moves an open breaker whose time is up to half-open
+func (br *breaker) tick() {
+	if br.state == breakerOpen && !time.Now().Before(br.openUntil) {
+		br.set(breakerHalfOpen)
+		log.Printf("[Gateway] %s: breaker half-open, probing", br.name)
+	}
+}
+
+func (br *breaker) trip() {
+	from := br.state
+	br.set(breakerOpen)
+	br.openUntil = time.Now().Add(time.Duration(br.cfg.OpenFor))
+	br.opens++
+	log.Printf("[Gateway] %s: breaker open for %v (was %s)", br.name, time.Duration(br.cfg.OpenFor), from)
+}
+
+func (br *breaker) set(s breakerState) {
+	br.state = s
+	br.gen++
+	br.failures, br.successes, br.probes = 0, 0, 0
+}
+
+func (br *breaker) snapshot() (state string, opens int) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.tick()
+	return br.state.String(), br.opens
+}
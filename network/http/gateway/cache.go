@@ -0,0 +1,642 @@
+package gateway
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A route with a cache config answers GET requests from a shared HTTP
+// cache in front of its pool (RFC 9111, plus RFC 5861's stale-* directives).
+// The cache wraps the rest of the request handling the way a caching
+// decorator wraps any other interface: it sees only the request and the
+// response, including the gateway's own errors.
+//
+//   - Freshness comes from the response: s-maxage, max-age or Expires.
+//     Responses with no-store, private, Set-Cookie or Vary: * are not
+//     stored; no-cache ones are stored but revalidated on every use.
+//   - Vary: each combination of the named request headers is its own entry.
+//   - Expired entries with an ETag or Last-Modified are revalidated with
+//     If-None-Match / If-Modified-Since; a 304 refreshes the entry.
+//   - stale-while-revalidate=N: for N seconds after expiry the stale entry
+//     is served at once while one background request refreshes it.
+//   - stale-if-error=N: for N seconds after expiry a 500, 502, 503 or 504
+//     (the upstream's or the gateway's) is replaced by the stale entry.
+//   - Concurrent misses for the same entry wait for the first one's
+//     response instead of each going upstream. If it wasn't stored they
+//     go upstream after all.
+//   - Clients' no-store, no-cache and max-age are honored, and their
+//     If-None-Match / If-Modified-Since are answered from the entry.
+//
+// Every response says what the cache did in X-Cache, with nginx's values.
+
+type CacheConfig struct {
+	MaxEntries    int   `json:"max_entries"`     // Least recently used entries go first
+	MaxEntryBytes int64 `json:"max_entry_bytes"` // Larger responses pass through unstored
+}
+
+// Cache defaults, for fields left 0 in the config
+const (
+	defaultCacheEntries    = 1000
+	defaultCacheEntryBytes = 1 << 20
+)
+
+// revalidateTimeout bounds a background revalidation. Its flight holds
+// back every other miss for the entry until it lands, and the transport
+// may have no header timeout of its own.
+const revalidateTimeout = 30 * time.Second
+
+// CacheStatus is what the cache did with a request
+type CacheStatus string
+
+const (
+	CacheHit         CacheStatus = "HIT"         // Fresh entry served
+	CacheMiss        CacheStatus = "MISS"        // No entry, fetched from upstream
+	CacheExpired     CacheStatus = "EXPIRED"     // Entry expired and was replaced
+	CacheRevalidated CacheStatus = "REVALIDATED" // Upstream said 304, entry served
+	CacheUpdating    CacheStatus = "UPDATING"    // Stale entry served while refreshing
+	CacheStale       CacheStatus = "STALE"       // Stale entry served because upstream failed
+	CacheBypass      CacheStatus = "BYPASS"      // Not cacheable, passed through
+)
+
+type cache struct {
+	maxEntries    int
+	maxEntryBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // Of *cacheEntry, by variant key
+	lru     *list.List               // Most recently used at the front
+	vary    map[string]*urlVariants  // By primary key, while the URL has entries
+	flights map[string]*flight       // Upstream fetches in progress, by variant key
+}
+
+// cacheEntry is a stored response. Entries are never modified once in the
+// cache; a revalidation stores a new one.
+type cacheEntry struct {
+	key     string
+	primary string // URL part of key, set by put
+	status  int
+	header  http.Header
+	body    []byte
+
+	stored     time.Time     // When the response (or the 304 refreshing it) arrived
+	initialAge time.Duration // Its Age header then
+	lifetime   time.Duration // Freshness lifetime
+	cc         cacheControl
+}
+
+// urlVariants is what the cache knows of one URL: the request headers it
+// varies on, and how many entries it has, so the record goes with the last
+type urlVariants struct {
+	names   []string
+	entries int
+}
+
+// flight is one upstream fetch that other requests for the entry wait on
+type flight struct {
+	done   chan struct{}
+	stored bool // Set before done closes
+}
+
+func newCache(cfg CacheConfig) *cache {
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = defaultCacheEntries
+	}
+	if cfg.MaxEntryBytes == 0 {
+		cfg.MaxEntryBytes = defaultCacheEntryBytes
+	}
+	return &cache{
+		maxEntries:    cfg.MaxEntries,
+		maxEntryBytes: cfg.MaxEntryBytes,
+		entries:       make(map[string]*list.Element),
+		lru:           list.New(),
+		vary:          make(map[string]*urlVariants),
+		flights:       make(map[string]*flight),
+	}
+}
+
+// serve answers r from the cache, calling next for whatever must come
+// from upstream
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	reqCC := requestCacheControl(r.Header)
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" || reqCC.has("no-store") {
+		setCacheStatus(w, r, CacheBypass)
+		next(w, r)
+		return
+	}
+
+	for {
+		key := c.key(r)
+		e := c.get(key)
+		now := time.Now()
+		if e != nil && e.fresh(now, reqCC) {
+			c.write(w, r, e, CacheHit)
+			return
+		}
+		if e != nil && !reqCC.has("no-cache") && e.usableStale(now, "stale-while-revalidate") {
+			if f, leader := c.join(key); leader {
+				bg, cancel := detach(r)
+				go func() {
+					defer cancel()
+					c.fetch(discardWriter{make(http.Header)}, bg, key, e, next, f)
+				}()
+			}
+			c.write(w, r, e, CacheUpdating)
+			return
+		}
+
+		f, leader := c.join(key)
+		if leader {
+			c.fetch(w, r, key, e, next, f)
+			return
+		}
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		if !f.stored {
+			c.fetch(w, r, key, e, next, nil) // Not cacheable after all
+			return
+		}
+		// Stored: look it up again, under the key its Vary gives
+	}
+}
+
+// fetch gets the response from upstream, revalidating stale if it has
+// validators, and stores it if it may. f, if not nil, is the flight this
+// request leads.
+func (c *cache) fetch(w http.ResponseWriter, r *http.Request, key string, stale *cacheEntry, next http.HandlerFunc, f *flight) {
+	if f != nil {
+		defer c.land(key, f)
+	}
+
+	out := r.Clone(r.Context())
+	// The client's validators are answered from the entry, not forwarded:
+	// a 304 for them would leave nothing to store
+	out.Header.Del("If-None-Match")
+	out.Header.Del("If-Modified-Since")
+	validated := false
+	if stale != nil {
+		if etag := stale.header.Get("ETag"); etag != "" {
+			out.Header.Set("If-None-Match", etag)
+			validated = true
+		}
+		if lm := stale.header.Get("Last-Modified"); lm != "" {
+			out.Header.Set("If-Modified-Since", lm)
+			validated = true
+		}
+	}
+
+	status := CacheMiss
+	if stale != nil {
+		status = CacheExpired
+	}
+	cw := &cacheWriter{
+		client:  w,
+		header:  make(http.Header),
+		r:       r,
+		status:  status,
+		max:     c.maxEntryBytes,
+		keep304: validated,
+	}
+	if stale != nil && stale.usableStale(time.Now(), "stale-if-error") {
+		cw.keepErrors = true
+	}
+	next(cw, out)
+
+	switch {
+	case cw.notModified:
+		e := stale.refreshed(cw.header, time.Now())
+		c.put(r, e)
+		if f != nil {
+			f.stored = true
+		}
+		c.write(w, r, e, CacheRevalidated)
+	case cw.failed:
+		c.write(w, r, stale, CacheStale)
+	case cw.storing && !bodyFailed(r):
+		e := newCacheEntry(key, cw.code, cw.header, cw.body, time.Now())
+		e.key = c.variantKey(r, e.header)
+		c.put(r, e)
+		if f != nil {
+			f.stored = true
+		}
+	}
+}
+
+// detach copies r for a background revalidation, which outlives the
+// client's request and must not touch its Record. Nothing of the server's
+// context is kept either: under it the ReverseProxy aborts a failed body
+// copy with a panic, which no server would recover in this goroutine.
+// cancel releases the revalidateTimeout context once the fetch is done.
+func detach(r *http.Request) (*http.Request, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), infoKey{}, &requestInfo{})
+	ctx, cancel := context.WithTimeout(ctx, revalidateTimeout)
+	return r.Clone(ctx), cancel
+}
+
+// bodyFailed reports whether reading the upstream's response body for r
+// failed, leaving what was copied short
+func bodyFailed(r *http.Request) bool {
+	info, ok := r.Context().Value(infoKey{}).(*requestInfo)
+	return ok && info.ex != nil && info.ex.class != ClassNone
+}
+
+// write answers r from e, with a 304 if the client's validators match
+func (c *cache) write(w http.ResponseWriter, r *http.Request, e *cacheEntry, status CacheStatus) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = slices.Clone(v)
+	}
+	h.Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	setCacheStatus(w, r, status)
+
+	if notModified(r, e.header) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// setCacheStatus reports status in X-Cache and the request's Record
+func setCacheStatus(w http.ResponseWriter, r *http.Request, status CacheStatus) {
+	w.Header().Set("X-Cache", string(status))
+	if info, ok := r.Context().Value(infoKey{}).(*requestInfo); ok {
+		info.cache = status
+	}
+}
+
+// notModified reports whether the client's validators match header
+// (RFC 9110 13.1.1, 13.1.3; If-None-Match takes precedence)
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// key is the entry key for r under the Vary headers last seen for its URL
+func (c *cache) key(r *http.Request) string {
+	primary := primaryKey(r)
+	c.mu.Lock()
+	var names []string
+	if v := c.vary[primary]; v != nil {
+		names = v.names
+	}
+	c.mu.Unlock()
+	return variantKey(primary, names, r)
+}
+
+func (c *cache) variantKey(r *http.Request, header http.Header) string {
+	return variantKey(primaryKey(r), varyNames(header), r)
+}
+
+func primaryKey(r *http.Request) string {
+	return r.Host + r.URL.RequestURI()
+}
+
+func variantKey(primary string, names []string, r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, v := range header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+func (c *cache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return el.Value.(*cacheEntry)
+}
+
+// put stores e, which r fetched
+func (c *cache) put(r *http.Request, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.primary = primaryKey(r)
+	v := c.vary[e.primary]
+	if v == nil {
+		v = &urlVariants{}
+		c.vary[e.primary] = v
+	}
+	v.names = varyNames(e.header)
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	v.entries++
+	for c.lru.Len() > c.maxEntries {
+		old := c.lru.Remove(c.lru.Back()).(*cacheEntry)
+		delete(c.entries, old.key)
+		if ov := c.vary[old.primary]; ov != nil {
+			if ov.entries--; ov.entries == 0 {
+				delete(c.vary, old.primary)
+			}
+		}
+	}
+}
+
+// join returns the flight fetching key, starting one if there is none;
+// leader reports whether the caller started it and must land it
+func (c *cache) join(key string) (f *flight, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+func (c *cache) land(key string, f *flight) {
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	close(f.done)
+}
+
+// storable reports whether a response to r may be stored (RFC 9111 3)
+func storable(r *http.Request, code int, header http.Header) bool {
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently, http.StatusPermanentRedirect,
+		http.StatusNotFound, http.StatusGone:
+	default:
+		return false
+	}
+	cc := parseCacheControl(header)
+	switch {
+	case cc.has("no-store"), cc.has("private"):
+		return false
+	case header.Get("Set-Cookie") != "", slices.Contains(varyNames(header), "*"):
+		return false
+	case r.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"):
+		return false
+	}
+	// Worth storing only if it can be fresh or revalidated
+	return freshnessLifetime(header, cc) > 0 || header.Get("ETag") != "" || header.Get("Last-Modified") != ""
+}
+
+func newCacheEntry(key string, code int, header http.Header, body []byte, now time.Time) *cacheEntry {
+	header = header.Clone()
+	header.Del("X-Upstream-Retries")
+	header.Del("X-Cache")
+	cc := parseCacheControl(header)
+	return &cacheEntry{
+		key:        key,
+		status:     code,
+		header:     header,
+		body:       body,
+		stored:     now,
+		initialAge: ageHeader(header),
+		lifetime:   freshnessLifetime(header, cc),
+		cc:         cc,
+	}
+}
+
+// refreshed is e updated with the headers of a 304 (RFC 9111 4.3.4)
+func (e *cacheEntry) refreshed(header http.Header, now time.Time) *cacheEntry {
+	merged := e.header.Clone()
+	for k, v := range header {
+		switch k {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "X-Upstream-Retries", "X-Cache":
+			continue
+		}
+		merged[k] = v
+	}
+	return newCacheEntry(e.key, e.status, merged, e.body, now)
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+// fresh reports whether e may be served without asking upstream
+func (e *cacheEntry) fresh(now time.Time, req cacheControl) bool {
+	if e.cc.has("no-cache") || req.has("no-cache") {
+		return false
+	}
+	age := e.age(now)
+	if maxAge, ok := req.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < e.lifetime
+}
+
+// usableStale reports whether e is within the grace period of directive
+// (stale-while-revalidate or stale-if-error) past its lifetime
+func (e *cacheEntry) usableStale(now time.Time, directive string) bool {
+	if e.cc.has("must-revalidate") || e.cc.has("proxy-revalidate") || e.cc.has("no-cache") {
+		return false
+	}
+	grace, ok := e.cc.seconds(directive)
+	return ok && e.age(now) < e.lifetime+grace
+}
+
+// freshnessLifetime is how long a response is fresh (RFC 9111 4.2.1).
+// s-maxage applies because the gateway is a shared cache.
+func freshnessLifetime(header http.Header, cc cacheControl) time.Duration {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if v := header.Get("Expires"); v != "" {
+		expires, err := http.ParseTime(v)
+		if err != nil {
+			return 0 // Invalid means already expired
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return max(expires.Sub(date), 0)
+	}
+	return 0
+}
+
+func ageHeader(header http.Header) time.Duration {
+	n, err := strconv.Atoi(header.Get("Age"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// cacheControl is a parsed Cache-Control header: directive -> argument
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, v := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name != "" {
+				cc[strings.ToLower(name)] = strings.Trim(arg, `"`)
+			}
+		}
+	}
+	return cc
+}
+
+// requestCacheControl also honors HTTP/1.0's Pragma: no-cache
+func requestCacheControl(header http.Header) cacheControl {
+	cc := parseCacheControl(header)
+	if len(cc) == 0 && strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	n, err := strconv.Atoi(cc[directive])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// cacheWriter stands between the upstream response and the client. Once
+// the status is known it either holds the response back (a 304 to the
+// cache's own validators, or an error a stale entry will replace) or
+// passes it through, keeping a copy of the body if it may be stored.
+type cacheWriter struct {
+	client     http.ResponseWriter
+	header     http.Header
+	r          *http.Request
+	status     CacheStatus // For X-Cache when passing through
+	max        int64
+	keep304    bool // The cache sent validators
+	keepErrors bool // A stale entry may replace errors
+
+	wroteHeader bool
+	code        int
+	notModified bool // Held back: 304
+	failed      bool // Held back: error
+	storing     bool
+	body        []byte
+}
+
+func (cw *cacheWriter) Header() http.Header { return cw.header }
+
+func (cw *cacheWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	if code >= 100 && code < 200 {
+		return // Informational: nothing to cache or hold back
+	}
+	cw.wroteHeader = true
+	cw.code = code
+
+	switch {
+	case code == http.StatusNotModified && cw.keep304:
+		cw.notModified = true
+		return
+	case cw.keepErrors && (code == http.StatusInternalServerError || gatewayStatus(code)):
+		cw.failed = true
+		return
+	}
+
+	cw.storing = storable(cw.r, code, cw.header) && contentLength(cw.header) <= cw.max
+	h := cw.client.Header()
+	for k, v := range cw.header {
+		h[k] = v
+	}
+	setCacheStatus(cw.client, cw.r, cw.status)
+	cw.client.WriteHeader(code)
+}
+
+func (cw *cacheWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.notModified || cw.failed {
+		return len(p), nil // Discarded: the entry is served instead
+	}
+	if cw.storing {
+		if int64(len(cw.body)+len(p)) > cw.max {
+			cw.storing, cw.body = false, nil
+		} else {
+			cw.body = append(cw.body, p...)
+		}
+	}
+	return cw.client.Write(p)
+}
+
+// Flush lets the ReverseProxy stream responses that pass through
+func (cw *cacheWriter) Flush() {
+	if !cw.wroteHeader || cw.notModified || cw.failed {
+		return
+	}
+	http.NewResponseController(cw.client).Flush()
+}
+
+// contentLength is the declared body size, or 0 if not declared
+func contentLength(header http.Header) int64 {
+	n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// discardWriter receives background revalidations
+type discardWriter struct{ header http.Header }
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) WriteHeader(int)             {}
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
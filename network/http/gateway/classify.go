@@ -0,0 +1,195 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"syscall"
+)
+
+// Upstream failures are classified by error type (errors.Is / errors.As)
+// and by how far the attempt got, never by matching error text. net/http
+// has no error type for a malformed response, but an httptrace hook tells
+// us whether any response bytes arrived: an error after that which isn't a
+// timeout, reset or EOF is the response failing to parse.
+
+// ErrorClass is the kind of upstream failure
+type ErrorClass int
+
+const (
+	ClassNone           ErrorClass = iota
+	ClassUnknown                   // None of the below
+	ClassConnRefused               // Nothing listening on the upstream port
+	ClassDNS                       // Upstream host name didn't resolve
+	ClassTLS                       // Handshake or certificate failure
+	ClassConnectTimeout            // No TCP connection within the dial timeout
+	ClassHeaderTimeout             // Connected, but no response header in time
+	ClassBodyTimeout               // Response body stalled (after the header was sent on)
+	ClassPrematureEOF              // Upstream closed the connection mid-response
+	ClassConnReset                 // Connection reset (RST) by the upstream
+	ClassMalformed                 // Response bytes arrived but weren't valid HTTP
+	ClassClientCanceled            // The client went away first
+)
+
+var classInfo = [...]struct {
+	code    string
+	status  int
+	message string
+}{
+	ClassNone:           {"", http.StatusOK, ""},
+	ClassUnknown:        {"upstream_error", http.StatusBadGateway, "the upstream request failed"},
+	ClassConnRefused:    {"upstream_connection_refused", http.StatusBadGateway, "the upstream refused the connection"},
+	ClassDNS:            {"upstream_dns_failure", http.StatusBadGateway, "the upstream host name could not be resolved"},
+	ClassTLS:            {"upstream_tls_failure", http.StatusBadGateway, "the TLS handshake with the upstream failed"},
+	ClassConnectTimeout: {"upstream_connect_timeout", http.StatusGatewayTimeout, "could not connect to the upstream in time"},
+	ClassHeaderTimeout:  {"upstream_header_timeout", http.StatusGatewayTimeout, "the upstream took too long to respond"},
+	ClassBodyTimeout:    {"upstream_body_timeout", http.StatusGatewayTimeout, "the upstream stopped sending the response body"},
+	ClassPrematureEOF:   {"upstream_premature_eof", http.StatusBadGateway, "the upstream closed the connection before the response was complete"},
+	ClassConnReset:      {"upstream_connection_reset", http.StatusBadGateway, "the upstream reset the connection"},
+	ClassMalformed:      {"upstream_malformed_response", http.StatusBadGateway, "the upstream returned an invalid HTTP response"},
+	ClassClientCanceled: {"client_closed_request", 499, "the client closed the request"}, // nginx's 499
+}
+
+// String is the error code sent to clients, e.g. "upstream_header_timeout"
+func (c ErrorClass) String() string { return classInfo[c].code }
+
+// Status is the response status for the class
+func (c ErrorClass) Status() int { return classInfo[c].status }
+
+// MarshalText writes the class as its code, e.g. in access logs
+func (c ErrorClass) MarshalText() ([]byte, error) { return []byte(c.String()), nil }
+
+// Message describes the class for humans
+func (c ErrorClass) Message() string { return classInfo[c].message }
+
+// UpstreamError is a failed attempt to reach a backend, classified
+type UpstreamError struct {
+	Class   ErrorClass
+	Backend string
+	Err     error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s: %s: %v", e.Backend, e.Class, e.Err)
+}
+
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// Classify returns the class of an error from the gateway. Errors from the
+// proxy carry their class; others are classified by type alone, which
+// can't tell a malformed response from an unknown failure.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ClassNone
+	}
+	var ue *UpstreamError
+	if errors.As(err, &ue) {
+		return ue.Class
+	}
+	return classify(err, attemptTrace{})
+}
+
+// attemptTrace records how far one attempt got
+type attemptTrace struct {
+	connected bool // TCP (and TLS) connection established
+	responded bool // First response byte read
+}
+
+func (t *attemptTrace) hooks() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn:              func(httptrace.GotConnInfo) { t.connected = true },
+		GotFirstResponseByte: func() { t.responded = true },
+	}
+}
+
+func classify(err error, t attemptTrace) ErrorClass {
+	var (
+		dnsErr     *net.DNSError
+		opErr      *net.OpError
+		netErr     net.Error
+		recordErr  tls.RecordHeaderError
+		alertErr   tls.AlertError
+		verifyErr  *tls.CertificateVerificationError
+		unknownCA  x509.UnknownAuthorityError
+		hostErr    x509.HostnameError
+		invalidErr x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ClassClientCanceled
+	case errors.As(err, &dnsErr):
+		return ClassDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ClassConnRefused
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &unknownCA), errors.As(err, &hostErr), errors.As(err, &invalidErr):
+		return ClassTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		if !t.connected || (errors.As(err, &opErr) && opErr.Op == "dial") {
+			return ClassConnectTimeout
+		}
+		return ClassHeaderTimeout
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return ClassConnReset
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return ClassPrematureEOF
+	case t.responded:
+		return ClassMalformed
+	}
+	return ClassUnknown
+}
+
+// ErrorBody is the JSON body of every error the gateway answers itself
+type ErrorBody struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code       string `json:"code"`
+	Status     int    `json:"status"`
+	Message    string `json:"message"`
+	Upstream   string `json:"upstream,omitempty"`
+	Retries    int    `json:"retries,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // Seconds, as in the Retry-After header
+	Detail     string `json:"detail,omitempty"`      // The underlying error
+}
+
+// WriteError answers a failed proxy attempt with the status of its class
+// and an ErrorBody. It is the default Gateway.ErrorHandler.
+func WriteError(w http.ResponseWriter, r *http.Request, b *Backend, err error) {
+	class := Classify(err)
+	detail := ErrorDetail{
+		Code:     class.String(),
+		Status:   class.Status(),
+		Message:  class.Message(),
+		Upstream: b.Name,
+		Detail:   err.Error(),
+	}
+	var ue *UpstreamError
+	if errors.As(err, &ue) {
+		detail.Detail = ue.Err.Error()
+	}
+	if ex, ok := r.Context().Value(exchangeKey{}).(*exchange); ok {
+		detail.Retries = ex.retries
+	}
+	writeJSONError(w, detail)
+}
+
+func writeJSONError(w http.ResponseWriter, detail ErrorDetail) {
+	if detail.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(detail.RetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(detail.Status)
+	json.NewEncoder(w).Encode(ErrorBody{Error: detail})
+}
@@ -0,0 +1,508 @@
+// Package gateway is a configurable reverse proxy in front of pools of
+// upstream servers, built on net/http/httputil.ReverseProxy.
+//
+// Each route maps a path prefix to a pool of backends. The longest
+// matching prefix wins. A pool picks a backend per request with one of:
+//
+//	round_robin      each backend in turn
+//	least_conn       the backend with the fewest requests in flight
+//	consistent_hash  the same key always lands on the same backend, and
+//	                 losing one backend only moves that backend's keys
+//
+// Backends leave the rotation in two ways:
+//   - Active health checks: GET health_check.path every interval; after
+//     unhealthy_threshold failures in a row the backend is down until
+//     healthy_threshold checks in a row succeed
+//   - Passive ejection: after passive.max_502s consecutive 502 responses
+//     the backend is skipped for passive.eject_for, then tried again
+//   - Circuit breaker: failing attempts open the backend's breaker, which
+//     keeps requests away until a probe succeeds (see breaker.go)
+//
+// When no backend of a route is available the gateway fails fast with
+// 503 and a Retry-After of the time until one might be. Attempts that got
+// no response are retried, within a budget, when that is safe (see
+// retry.go). A route with a cache serves GETs from an HTTP cache in front
+// of its pool, and stale responses instead of errors where the upstream
+// allows it (see cache.go).
+//
+// Configuration is JSON:
+//
+//	{"routes": [{
+//	    "prefix": "/api/",
+//	    "upstreams": ["http://localhost:9090", "http://localhost:9091"],
+//	    "balance": "consistent_hash",
+//	    "hash_key": "header:X-User",
+//	    "strip_prefix": true,
+//	    "health_check": {"path": "/healthz", "interval": "2s", "timeout": "1s",
+//	                     "unhealthy_threshold": 2, "healthy_threshold": 2},
+//	    "passive": {"max_502s": 3, "eject_for": "10s"},
+//	    "breaker": {"failure_threshold": 5, "open_for": "10s",
+//	                "half_open_requests": 1, "success_threshold": 1},
+//	    "retry": {"attempts": 2, "budget_ratio": 0.2, "min_per_second": 3},
+//	    "cache": {"max_entries": 1000, "max_entry_bytes": 1048576}
+//	}]}
+//
+// Every proxy error is attributed to the backend that caused it and
+// classified (see classify.go): the ErrorHandler receives the backend and
+// an *UpstreamError, and Status reports per-backend counts. Errors the
+// gateway answers itself have a JSON ErrorBody with a code.
+//
+// OnRequest receives a Record of every request (route, upstream, status,
+// bytes, latency, error class) for JSON access logs and Prometheus metrics
+// (see observe.go).
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as a string ("2s") in JSON
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"2s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type Config struct {
+	Routes []RouteConfig `json:"routes"`
+}
+
+type RouteConfig struct {
+	Prefix      string             `json:"prefix"`
+	Upstreams   []string           `json:"upstreams"`
+	Balance     string             `json:"balance"`  // round_robin (default), least_conn, consistent_hash
+	HashKey     string             `json:"hash_key"` // consistent_hash: ip (default), path or header:Name
+	StripPrefix bool               `json:"strip_prefix"`
+	HealthCheck *HealthCheckConfig `json:"health_check"` // nil = no active checks
+	Passive     PassiveConfig      `json:"passive"`
+	Breaker     *BreakerConfig     `json:"breaker"` // nil = no circuit breaker
+	Retry       RetryConfig        `json:"retry"`
+	Cache       *CacheConfig       `json:"cache"` // nil = no caching
+}
+
+type HealthCheckConfig struct {
+	Path               string   `json:"path"`
+	Interval           Duration `json:"interval"`
+	Timeout            Duration `json:"timeout"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold"`
+	HealthyThreshold   int      `json:"healthy_threshold"`
+}
+
+// PassiveConfig ejects a backend that keeps answering 502. Max502s 0
+// disables passive ejection.
+type PassiveConfig struct {
+	Max502s  int      `json:"max_502s"`
+	EjectFor Duration `json:"eject_for"`
+}
+
+// LoadConfig reads a JSON config file
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Gateway routes requests to pools. Set the exported fields before
+// serving.
+type Gateway struct {
+	// ErrorHandler writes the response when proxying to b failed (the
+	// upstream could not be reached or sent no valid response). err is an
+	// *UpstreamError. The default is WriteError.
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, b *Backend, err error)
+
+	// Transport makes the upstream requests (default http.DefaultTransport)
+	Transport http.RoundTripper
+
+	// BodyTimeout, if set, aborts a response whose body sends nothing for
+	// this long while the gateway waits on it; time spent writing to a slow
+	// client doesn't count. The status is already on its way to the client
+	// by then, so the client sees the connection close.
+	BodyTimeout time.Duration
+
+	// OnRequest, if set, is called with a Record of every request once its
+	// response is finished, for access logs and metrics (see AccessLog and
+	// Metrics)
+	OnRequest func(Record)
+
+	pools []*Pool // Longest prefix first
+	proxy *httputil.ReverseProxy
+}
+
+// exchange is what ServeHTTP decided for one request, passed to the
+// ReverseProxy callbacks through the request context. A retry moves it
+// to another backend.
+type exchange struct {
+	pool    *Pool
+	backend *Backend
+	gen     int // Breaker generation backend admitted the attempt at
+	retries int
+	class   ErrorClass // Of the last failure, cleared when an attempt gets a response
+	cancel  context.CancelCauseFunc
+}
+
+// errBodyTimeout is the cancel cause when the body watchdog fires
+var errBodyTimeout = errors.New("gateway: response body timeout")
+
+type exchangeKey struct{}
+
+func New(cfg Config) (*Gateway, error) {
+	if len(cfg.Routes) == 0 {
+		return nil, fmt.Errorf("gateway: no routes")
+	}
+
+	g := &Gateway{}
+	for i, rc := range cfg.Routes {
+		pool, err := newPool(rc)
+		if err != nil {
+			return nil, fmt.Errorf("gateway: route %d (%q): %w", i, rc.Prefix, err)
+		}
+		g.pools = append(g.pools, pool)
+	}
+	slices.SortStableFunc(g.pools, func(a, b *Pool) int {
+		return len(b.Prefix) - len(a.Prefix)
+	})
+
+	g.proxy = &httputil.ReverseProxy{
+		Rewrite:        g.rewrite,
+		Transport:      roundTripperFunc(g.roundTrip),
+		ModifyResponse: g.modifyResponse,
+		ErrorHandler:   g.proxyError,
+	}
+	return g, nil
+}
+
+// Start runs the active health checks until ctx is cancelled
+func (g *Gateway) Start(ctx context.Context) {
+	for _, p := range g.pools {
+		p.startHealthChecks(ctx)
+	}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	info := &requestInfo{}
+	r = r.WithContext(context.WithValue(r.Context(), infoKey{}, info))
+	if g.OnRequest != nil {
+		// Deferred: a body that fails mid-copy aborts the handler with a panic
+		defer func() { g.OnRequest(newRecord(r, start, rec, info)) }()
+	}
+
+	info.pool = g.match(r.URL.Path)
+	if info.pool == nil {
+		writeJSONError(rec, ErrorDetail{
+			Code:    "no_route",
+			Status:  http.StatusNotFound,
+			Message: "no route for " + r.URL.Path,
+		})
+		return
+	}
+
+	pool := info.pool
+	pool.inflight.Add(1)
+	defer pool.inflight.Add(-1)
+
+	if pool.cache != nil {
+		pool.cache.serve(rec, r, func(w http.ResponseWriter, r *http.Request) { g.forward(w, r, pool) })
+		return
+	}
+	g.forward(rec, r, pool)
+}
+
+// requestInfo collects what ServeHTTP and the layers under it did with a
+// request, for its Record
+type requestInfo struct {
+	pool  *Pool
+	ex    *exchange // The upstream exchange, if any
+	cache CacheStatus
+}
+
+type infoKey struct{}
+
+// forward sends r to a backend of pool, or answers 503 if none is
+// available
+func (g *Gateway) forward(w http.ResponseWriter, r *http.Request, pool *Pool) {
+	b, gen, wait := pool.pick(r, nil)
+	if b == nil {
+		// Fail fast rather than queue behind backends that are down
+		retryAfter := max(int(math.Ceil(wait.Seconds())), 1)
+		log.Printf("[Gateway] %s %s: no available upstream in %s, retry after %ds", r.Method, r.URL.Path, pool.Prefix, retryAfter)
+		writeJSONError(w, ErrorDetail{
+			Code:       "no_available_upstream",
+			Status:     http.StatusServiceUnavailable,
+			Message:    "no upstream for " + pool.Prefix + " is available",
+			RetryAfter: retryAfter,
+		})
+		return
+	}
+	if pool.budget != nil {
+		pool.budget.deposit()
+	}
+
+	ctx, cancel := context.WithCancelCause(r.Context())
+	defer cancel(nil)
+	ex := &exchange{pool: pool, backend: b, gen: gen, cancel: cancel}
+	if info, ok := r.Context().Value(infoKey{}).(*requestInfo); ok {
+		info.ex = ex
+	}
+	b.inflight.Add(1)
+
+	// The status the backend's response got, before any cache stepped in
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		ex.backend.inflight.Add(-1)
+		pool.observe(ex.backend, rec.status)
+	}()
+
+	g.proxy.ServeHTTP(rec, r.WithContext(context.WithValue(ctx, exchangeKey{}, ex)))
+}
+
+// match returns the pool with the longest prefix of path
+func (g *Gateway) match(path string) *Pool {
+	for _, p := range g.pools {
+		if strings.HasPrefix(path, p.Prefix) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) rewrite(pr *httputil.ProxyRequest) {
+	ex := pr.In.Context().Value(exchangeKey{}).(*exchange)
+	if ex.pool.stripPrefix {
+		pr.Out.URL.Path = "/" + strings.TrimPrefix(pr.Out.URL.Path, ex.pool.Prefix)
+		pr.Out.URL.RawPath = ""
+	}
+	pr.SetURL(ex.backend.URL)
+	pr.SetXForwarded()
+}
+
+// roundTrip sends the request to the exchange's backend, reports the
+// outcome to its breaker, and retries elsewhere when that is safe
+func (g *Gateway) roundTrip(r *http.Request) (*http.Response, error) {
+	transport := g.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	ex := r.Context().Value(exchangeKey{}).(*exchange)
+
+	var tried []*Backend
+	for {
+		b := ex.backend
+		var trace attemptTrace
+		resp, err := transport.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace.hooks())))
+		if err == nil {
+			b.done(ex.gen, !gatewayStatus(resp.StatusCode))
+			ex.class = ClassNone
+			return resp, nil
+		}
+
+		ex.class = classify(err, trace)
+		err = &UpstreamError{Class: ex.class, Backend: b.Name, Err: err}
+		if ex.class == ClassClientCanceled {
+			b.abandon(ex.gen) // The client gave up, not the backend
+			return nil, err
+		}
+		b.done(ex.gen, false)
+		b.failures.Add(1)
+
+		if ex.retries >= ex.pool.retry.Attempts || !retryable(r, ex.class) {
+			return nil, err
+		}
+		if !ex.pool.budget.withdraw() {
+			log.Printf("[Gateway] %s %s: %v, retry budget exhausted", r.Method, r.URL.Path, err)
+			return nil, err
+		}
+
+		// Prefer a backend not tried yet; a pool of one retries the same
+		tried = append(tried, b)
+		next, gen, _ := ex.pool.pick(r, tried)
+		if next == nil {
+			if next, gen, _ = ex.pool.pick(r, nil); next == nil {
+				return nil, err
+			}
+		}
+		log.Printf("[Gateway] %s %s: %v, retrying on %s", r.Method, r.URL.Path, err, next.Name)
+
+		b.inflight.Add(-1)
+		next.inflight.Add(1)
+		ex.backend, ex.gen = next, gen
+		ex.retries++
+
+		r = r.Clone(r.Context())
+		r.URL.Scheme, r.URL.Host = next.URL.Scheme, next.URL.Host
+		if r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// gatewayStatus reports statuses that mean the backend, or something in
+// front of it, could not handle the request
+func gatewayStatus(code int) bool {
+	return code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+}
+
+func (g *Gateway) modifyResponse(resp *http.Response) error {
+	ex := resp.Request.Context().Value(exchangeKey{}).(*exchange)
+	resp.Header.Set("X-Upstream", ex.backend.Name)
+	if ex.retries > 0 {
+		resp.Header.Set("X-Upstream-Retries", strconv.Itoa(ex.retries))
+	}
+	resp.Body = newBodyReader(resp.Body, resp.Request.Context(), ex, g.BodyTimeout)
+	return nil
+}
+
+// bodyReader classifies errors reading the response body, which the
+// ReverseProxy can only log, and enforces BodyTimeout. The watchdog runs
+// only inside Read: between reads the proxy is writing to the client, and
+// a client slow to take the body is no fault of the upstream's.
+type bodyReader struct {
+	io.ReadCloser
+	ctx      context.Context
+	ex       *exchange
+	timeout  time.Duration
+	watchdog *time.Timer // Created stopped, by newBodyReader
+}
+
+func newBodyReader(body io.ReadCloser, ctx context.Context, ex *exchange, timeout time.Duration) *bodyReader {
+	br := &bodyReader{ReadCloser: body, ctx: ctx, ex: ex, timeout: timeout}
+	if timeout > 0 {
+		br.watchdog = time.AfterFunc(timeout, func() { ex.cancel(errBodyTimeout) })
+		br.watchdog.Stop()
+	}
+	return br
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	if br.watchdog != nil {
+		br.watchdog.Reset(br.timeout)
+	}
+	n, err := br.ReadCloser.Read(p)
+	if br.watchdog != nil {
+		br.watchdog.Stop()
+	}
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	class := classify(err, attemptTrace{connected: true, responded: true})
+	if context.Cause(br.ctx) == errBodyTimeout {
+		class = ClassBodyTimeout
+	}
+	if class == ClassClientCanceled && br.ctx.Err() == nil {
+		class = ClassUnknown // Not our context: something else cancelled
+	}
+	b := br.ex.backend
+	br.ex.class = class
+	if class != ClassClientCanceled {
+		b.failures.Add(1)
+	}
+	log.Printf("[Gateway] %s: response body failed: %s (%v)", b.Name, class, err)
+	return n, &UpstreamError{Class: class, Backend: b.Name, Err: err}
+}
+
+func (br *bodyReader) Close() error {
+	if br.watchdog != nil {
+		br.watchdog.Stop()
+	}
+	return br.ReadCloser.Close()
+}
+
+func (g *Gateway) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	ex := r.Context().Value(exchangeKey{}).(*exchange)
+	b := ex.backend
+
+	w.Header().Set("X-Upstream", b.Name)
+	if ex.retries > 0 {
+		w.Header().Set("X-Upstream-Retries", strconv.Itoa(ex.retries))
+	}
+
+	if g.ErrorHandler != nil {
+		g.ErrorHandler(w, r, b, err)
+		return
+	}
+	log.Printf("[Gateway] %v", err)
+	WriteError(w, r, b, err)
+}
+
+// Status reports every pool and backend, for a status endpoint
+func (g *Gateway) Status() []PoolStatus {
+	out := make([]PoolStatus, len(g.pools))
+	for i, p := range g.pools {
+		out[i] = p.status()
+	}
+	return out
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// statusRecorder remembers the status written, whether relayed from the
+// upstream or produced by the ErrorHandler, and counts the body bytes
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush on the real writer,
+// which the ReverseProxy needs to stream responses
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
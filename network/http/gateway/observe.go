@@ -0,0 +1,178 @@
+package gateway
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"claude-go/network/http/metrics"
+)
+
+// Record is what the gateway did with one request, passed to
+// Gateway.OnRequest once the response is finished
+type Record struct {
+	Time     time.Time     `json:"time"` // When the request arrived
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Route    string        `json:"route,omitempty"`    // Pool prefix, empty without a route
+	Upstream string        `json:"upstream,omitempty"` // Backend of the last attempt
+	Status   int           `json:"status"`             // 0 if the response was aborted before a status
+	Bytes    int64         `json:"bytes"`              // Body bytes sent to the client
+	Latency  time.Duration `json:"-"`                  // Until the response was finished
+	Retries  int           `json:"retries,omitempty"`
+	Error    ErrorClass    `json:"error,omitempty"` // Why the response failed, if it did
+	Cache    CacheStatus   `json:"cache,omitempty"` // Routes with a cache only
+	Remote   string        `json:"remote"`
+}
+
+// MarshalJSON writes Latency as latency_ms, which log tools can sum
+func (rec Record) MarshalJSON() ([]byte, error) {
+	type plain Record
+	return json.Marshal(struct {
+		plain
+		LatencyMS float64 `json:"latency_ms"`
+	}{plain(rec), float64(rec.Latency.Microseconds()) / 1000})
+}
+
+func newRecord(r *http.Request, start time.Time, rec *statusRecorder, info *requestInfo) Record {
+	out := Record{
+		Time:    start,
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Status:  rec.status,
+		Bytes:   rec.bytes,
+		Latency: time.Since(start),
+		Cache:   info.cache,
+		Remote:  r.RemoteAddr,
+	}
+	if info.pool != nil {
+		out.Route = info.pool.Prefix
+	}
+	if ex := info.ex; ex != nil {
+		out.Upstream = ex.backend.Name
+		out.Retries = ex.retries
+		out.Error = ex.class
+	}
+	return out
+}
+
+// AccessLog returns an OnRequest hook that writes each Record to w as a
+// line of JSON
+func AccessLog(w io.Writer) func(Record) {
+	var mu sync.Mutex
+	return func(rec Record) {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(append(line, '\n'))
+	}
+}
+
+// Metrics exports the gateway's traffic in the Prometheus text format.
+// Counters and the latency histogram are fed by Observe; the gauges are
+// read from the pools on each scrape.
+//
+//	gateway_requests_total{route,status}                  counter
+//	gateway_request_duration_seconds{route}               histogram
+//	gateway_response_bytes_total{route}                   counter
+//	gateway_retries_total{route}                          counter
+//	gateway_upstream_errors_total{route,upstream,class}   counter
+//	gateway_cache_requests_total{route,status}            counter, by X-Cache value
+//	gateway_requests_in_flight{route}                     gauge
+//	gateway_upstream_in_flight{route,upstream}            gauge
+//	gateway_upstream_available{route,upstream}            gauge, 1 or 0
+//	gateway_upstream_breaker_state{route,upstream,state}  gauge, 1 for the current state
+//
+// Requests without a route have route="none".
+type Metrics struct {
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+	bytes    *metrics.CounterVec
+	retries  *metrics.CounterVec
+	errors   *metrics.CounterVec
+	cache    *metrics.CounterVec
+}
+
+// NewMetrics registers the gateway's metrics with reg. Set Observe as (or
+// call it from) the gateway's OnRequest.
+func NewMetrics(g *Gateway, reg *metrics.Registry) *Metrics {
+	m := &Metrics{
+		requests: reg.NewCounter("gateway_requests_total", "Requests handled, by route and response status.", "route", "status"),
+		duration: reg.NewHistogram("gateway_request_duration_seconds", "Time from request to the end of the response.", nil, "route"),
+		bytes:    reg.NewCounter("gateway_response_bytes_total", "Response body bytes sent to clients.", "route"),
+		retries:  reg.NewCounter("gateway_retries_total", "Upstream attempts retried on another (or the same) backend.", "route"),
+		errors:   reg.NewCounter("gateway_upstream_errors_total", "Requests that failed upstream, by backend and error class.", "route", "upstream", "class"),
+		cache:    reg.NewCounter("gateway_cache_requests_total", "Requests to cached routes, by what the cache did.", "route", "status"),
+	}
+
+	reg.NewGaugeFunc("gateway_requests_in_flight", "Requests being handled.", []string{"route"},
+		func(emit func(float64, ...string)) {
+			for _, p := range g.pools {
+				emit(float64(p.inflight.Load()), p.Prefix)
+			}
+		})
+	reg.NewGaugeFunc("gateway_upstream_in_flight", "Requests in flight to each backend.", []string{"route", "upstream"},
+		func(emit func(float64, ...string)) {
+			for _, p := range g.pools {
+				for _, b := range p.Backends {
+					emit(float64(b.Inflight()), p.Prefix, b.Name)
+				}
+			}
+		})
+	reg.NewGaugeFunc("gateway_upstream_available", "Whether each backend is in the rotation.", []string{"route", "upstream"},
+		func(emit func(float64, ...string)) {
+			for _, p := range g.pools {
+				for _, b := range p.Backends {
+					emit(boolValue(b.Available()), p.Prefix, b.Name)
+				}
+			}
+		})
+	reg.NewGaugeFunc("gateway_upstream_breaker_state", "Circuit breaker state of each backend.", []string{"route", "upstream", "state"},
+		func(emit func(float64, ...string)) {
+			for _, p := range g.pools {
+				for _, b := range p.Backends {
+					if b.breaker == nil {
+						continue
+					}
+					current, _ := b.breaker.snapshot()
+					for _, s := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+						emit(boolValue(s.String() == current), p.Prefix, b.Name, s.String())
+					}
+				}
+			}
+		})
+	return m
+}
+
+// Observe counts one finished request
+func (m *Metrics) Observe(rec Record) {
+	route := rec.Route
+	if route == "" {
+		route = "none"
+	}
+	m.requests.With(route, strconv.Itoa(rec.Status)).Inc()
+	m.duration.With(route).Observe(rec.Latency.Seconds())
+	m.bytes.With(route).Add(float64(rec.Bytes))
+	if rec.Retries > 0 {
+		m.retries.With(route).Add(float64(rec.Retries))
+	}
+	if rec.Error != ClassNone {
+		m.errors.With(route, rec.Upstream, rec.Error.String()).Inc()
+	}
+	if rec.Cache != "" {
+		m.cache.With(route, string(rec.Cache)).Inc()
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,371 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Health check and ejection defaults, for fields left 0 in the config
+const (
+	defaultCheckInterval      = 5 * time.Second
+	defaultCheckTimeout       = 2 * time.Second
+	defaultUnhealthyThreshold = 2
+	defaultHealthyThreshold   = 2
+	defaultEjectFor           = 30 * time.Second
+)
+
+// Backend is one upstream server of a pool
+type Backend struct {
+	Name string // host:port
+	URL  *url.URL
+
+	inflight atomic.Int64
+	requests atomic.Int64
+	failures atomic.Int64 // Attempts that got no valid response, retried or not
+	status5x atomic.Int64 // 5xx responses sent on its behalf, failures included
+
+	mu           sync.Mutex
+	healthy      bool      // Verdict of the active checks
+	ejectedUntil time.Time // Passive ejection
+	ejections    int
+	checkFails   int // Consecutive failed / passed active checks
+	checkPasses  int
+	lastCheckErr string
+	recent502s   int // Consecutive 502s
+
+	breaker *breaker // nil without a breaker config
+}
+
+// Available reports whether b is in the rotation
+func (b *Backend) Available() bool {
+	ok, _ := b.ready()
+	return ok
+}
+
+// ready reports whether b can take a request now; if not, wait is how
+// long until it might (0 if unknown, i.e. waiting on health checks)
+func (b *Backend) ready() (ok bool, wait time.Duration) {
+	b.mu.Lock()
+	healthy, ejectedFor := b.healthy, time.Until(b.ejectedUntil)
+	b.mu.Unlock()
+
+	switch {
+	case !healthy:
+		return false, 0
+	case ejectedFor > 0:
+		return false, ejectedFor
+	case b.breaker != nil:
+		return b.breaker.ready()
+	}
+	return true, 0
+}
+
+// admit takes a breaker slot for one attempt
+func (b *Backend) admit() (gen int, ok bool) {
+	if b.breaker == nil {
+		return 0, true
+	}
+	return b.breaker.acquire()
+}
+
+// done reports the outcome of an attempt admitted at gen to the breaker
+func (b *Backend) done(gen int, success bool) {
+	if b.breaker != nil {
+		b.breaker.record(gen, success)
+	}
+}
+
+// abandon gives back the breaker slot of an attempt whose outcome says
+// nothing about the backend (the client went away)
+func (b *Backend) abandon(gen int) {
+	if b.breaker != nil {
+		b.breaker.release(gen)
+	}
+}
+
+// Inflight is the number of requests b is serving now
+func (b *Backend) Inflight() int64 {
+	return b.inflight.Load()
+}
+
+// Pool is the backends of one route and how to choose among them
+type Pool struct {
+	Prefix   string
+	Backends []*Backend
+
+	balancer    Balancer
+	stripPrefix bool
+	check       *HealthCheckConfig
+	passive     PassiveConfig
+	retry       RetryConfig
+	budget      *retryBudget
+	cache       *cache // nil without a cache config
+
+	inflight atomic.Int64 // Requests being handled, answered by the gateway or not
+}
+
+func newPool(rc RouteConfig) (*Pool, error) {
+	if rc.Prefix == "" || rc.Prefix[0] != '/' {
+		return nil, fmt.Errorf("prefix must start with /")
+	}
+	if len(rc.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+
+	p := &Pool{Prefix: rc.Prefix, stripPrefix: rc.StripPrefix, passive: rc.Passive, retry: rc.Retry}
+	for _, raw := range rc.Upstreams {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("bad upstream %q: want http(s)://host:port", raw)
+		}
+		// A retry moves the request to another backend by swapping the
+		// host, so the paths must agree
+		if len(p.Backends) > 0 && u.Path != p.Backends[0].URL.Path {
+			return nil, fmt.Errorf("upstream %q: all upstreams of a route must have the same path", raw)
+		}
+		b := &Backend{Name: u.Host, URL: u, healthy: true}
+		if rc.Breaker != nil {
+			b.breaker = newBreaker(b.Name, *rc.Breaker)
+		}
+		p.Backends = append(p.Backends, b)
+	}
+	if p.retry.Attempts > 0 {
+		p.budget = newRetryBudget(p.retry)
+	}
+	if rc.Cache != nil {
+		p.cache = newCache(*rc.Cache)
+	}
+
+	switch rc.Balance {
+	case "", "round_robin":
+		p.balancer = &RoundRobin{}
+	case "least_conn":
+		p.balancer = &LeastConn{}
+	case "consistent_hash":
+		key, err := hashKeyFunc(rc.HashKey)
+		if err != nil {
+			return nil, err
+		}
+		p.balancer = NewConsistentHash(p.Backends, key)
+	default:
+		return nil, fmt.Errorf("unknown balance %q", rc.Balance)
+	}
+
+	if p.passive.Max502s > 0 && p.passive.EjectFor == 0 {
+		p.passive.EjectFor = Duration(defaultEjectFor)
+	}
+	if rc.HealthCheck != nil {
+		hc := *rc.HealthCheck
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		if hc.Interval == 0 {
+			hc.Interval = Duration(defaultCheckInterval)
+		}
+		if hc.Timeout == 0 {
+			hc.Timeout = Duration(defaultCheckTimeout)
+		}
+		if hc.UnhealthyThreshold == 0 {
+			hc.UnhealthyThreshold = defaultUnhealthyThreshold
+		}
+		if hc.HealthyThreshold == 0 {
+			hc.HealthyThreshold = defaultHealthyThreshold
+		}
+		p.check = &hc
+	}
+	return p, nil
+}
+
+// pick returns the backend for r, skipping those in tried, and the
+// breaker generation it was admitted at. If none is available it returns
+// nil and how long until one might be.
+func (p *Pool) pick(r *http.Request, tried []*Backend) (*Backend, int, time.Duration) {
+	skip := slices.Clone(tried)
+	for {
+		up := make([]*Backend, 0, len(p.Backends))
+		var wait time.Duration
+		for _, b := range p.Backends {
+			if slices.Contains(skip, b) {
+				continue
+			}
+			ok, w := b.ready()
+			if ok {
+				up = append(up, b)
+				continue
+			}
+			if w == 0 && p.check != nil {
+				// Down: back after HealthyThreshold passed checks at best
+				w = time.Duration(p.check.Interval) * time.Duration(p.check.HealthyThreshold)
+			}
+			if w > 0 && (wait == 0 || w < wait) {
+				wait = w
+			}
+		}
+		if len(up) == 0 {
+			return nil, 0, wait
+		}
+
+		b := p.balancer.Pick(up, r)
+		if gen, ok := b.admit(); ok {
+			b.requests.Add(1)
+			return b, gen, 0
+		}
+		// Another request took the last half-open probe slot
+		skip = append(skip, b)
+	}
+}
+
+// observe records the status sent for a request to b (0 if nothing was
+// written) and ejects b after too many 502s in a row
+func (p *Pool) observe(b *Backend, status int) {
+	if status >= 500 {
+		b.status5x.Add(1)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if status != http.StatusBadGateway {
+		b.recent502s = 0
+		return
+	}
+	b.recent502s++
+	if p.passive.Max502s == 0 || b.recent502s < p.passive.Max502s {
+		return
+	}
+	b.recent502s = 0
+	b.ejections++
+	b.ejectedUntil = time.Now().Add(time.Duration(p.passive.EjectFor))
+	log.Printf("[Gateway] %s: %d consecutive 502s, ejected from %s for %v",
+		b.Name, p.passive.Max502s, p.Prefix, time.Duration(p.passive.EjectFor))
+}
+
+func (p *Pool) startHealthChecks(ctx context.Context) {
+	if p.check == nil {
+		return
+	}
+	client := &http.Client{
+		Timeout: time.Duration(p.check.Timeout),
+		// A redirect answer is an answer: don't follow it
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	for _, b := range p.Backends {
+		go p.healthLoop(ctx, client, b)
+	}
+}
+
+func (p *Pool) healthLoop(ctx context.Context, client *http.Client, b *Backend) {
+	ticker := time.NewTicker(time.Duration(p.check.Interval))
+	defer ticker.Stop()
+	for {
+		p.recordCheck(b, probe(ctx, client, b.URL.JoinPath(p.check.Path)))
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe passes on any status below 500
+func probe(ctx context.Context, client *http.Client, u *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *Pool) recordCheck(b *Backend, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err != nil {
+		b.checkPasses = 0
+		b.checkFails++
+		b.lastCheckErr = err.Error()
+		if b.healthy && b.checkFails >= p.check.UnhealthyThreshold {
+			b.healthy = false
+			log.Printf("[Gateway] %s is DOWN after %d failed checks: %v", b.Name, b.checkFails, err)
+		}
+		return
+	}
+
+	b.checkFails = 0
+	b.checkPasses++
+	b.lastCheckErr = ""
+	if !b.healthy && b.checkPasses >= p.check.HealthyThreshold {
+		b.healthy = true
+		log.Printf("[Gateway] %s is UP after %d passed checks", b.Name, b.checkPasses)
+	}
+}
+
+type PoolStatus struct {
+	Prefix        string          `json:"prefix"`
+	Balance       string          `json:"balance"`
+	Retries       int64           `json:"retries"`
+	RetriesDenied int64           `json:"retries_denied"` // Over the retry budget
+	Backends      []BackendStatus `json:"backends"`
+}
+
+type BackendStatus struct {
+	Name         string     `json:"name"`
+	Available    bool       `json:"available"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+	Ejections    int        `json:"ejections"`
+	LastCheckErr string     `json:"last_check_error,omitempty"`
+	Breaker      string     `json:"breaker,omitempty"` // closed, open or half-open
+	BreakerOpens int        `json:"breaker_opens,omitempty"`
+	Inflight     int64      `json:"inflight"`
+	Requests     int64      `json:"requests"`
+	Failures     int64      `json:"failures"`
+	Status5xx    int64      `json:"status_5xx"`
+}
+
+func (p *Pool) status() PoolStatus {
+	ps := PoolStatus{Prefix: p.Prefix, Balance: p.balancer.Name()}
+	if p.budget != nil {
+		ps.Retries, ps.RetriesDenied = p.budget.counts()
+	}
+	for _, b := range p.Backends {
+		available := b.Available()
+		b.mu.Lock()
+		bs := BackendStatus{
+			Name:         b.Name,
+			Available:    available,
+			Healthy:      b.healthy,
+			Ejections:    b.ejections,
+			LastCheckErr: b.lastCheckErr,
+		}
+		if time.Now().Before(b.ejectedUntil) {
+			until := b.ejectedUntil
+			bs.EjectedUntil = &until
+		}
+		b.mu.Unlock()
+
+		if b.breaker != nil {
+			bs.Breaker, bs.BreakerOpens = b.breaker.snapshot()
+		}
+		bs.Inflight = b.inflight.Load()
+		bs.Requests = b.requests.Load()
+		bs.Failures = b.failures.Load()
+		bs.Status5xx = b.status5x.Load()
+		ps.Backends = append(ps.Backends, bs)
+	}
+	return ps
+}
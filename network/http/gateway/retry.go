@@ -0,0 +1,121 @@
+package gateway
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Retries resend a request whose attempt got no response, to another
+// backend when the pool has one. Only two cases are safe:
+//   - the connection was refused: nothing was sent, any method may retry
+//   - the connection was reset or closed before a response, and the
+//     method is idempotent (GET, HEAD, OPTIONS, TRACE, PUT, DELETE)
+//
+// Either way the request must have no body, or one that GetBody can
+// produce again: the Transport closes the body after a failed attempt,
+// even one that never connected.
+//
+// Timeouts are never retried: the backend may still be working on it.
+//
+// A retry budget caps retries at a fraction of requests, so when a
+// backend fails outright retries don't multiply the load on the rest
+// of the pool (a retry storm). MinPerSecond keeps retries possible
+// at low traffic.
+
+type RetryConfig struct {
+	Attempts     int     `json:"attempts"`       // Retries after the first attempt, 0 = off
+	BudgetRatio  float64 `json:"budget_ratio"`   // Retries earned per request
+	MinPerSecond int     `json:"min_per_second"` // Retries always allowed per second
+}
+
+// Retry budget defaults, for fields left 0 in the config
+const (
+	defaultBudgetRatio  = 0.2
+	defaultMinPerSecond = 3
+
+	// maxBudgetTokens bounds the retries a quiet period can save up
+	maxBudgetTokens = 100
+)
+
+type retryBudget struct {
+	ratio        float64
+	minPerSecond int
+
+	mu      sync.Mutex
+	tokens  float64
+	window  time.Time // Start of the current second, for minPerSecond
+	minUsed int
+
+	allowed int64
+	denied  int64
+}
+
+func newRetryBudget(cfg RetryConfig) *retryBudget {
+	if cfg.BudgetRatio == 0 {
+		cfg.BudgetRatio = defaultBudgetRatio
+	}
+	if cfg.MinPerSecond == 0 {
+		cfg.MinPerSecond = defaultMinPerSecond
+	}
+	return &retryBudget{ratio: cfg.BudgetRatio, minPerSecond: cfg.MinPerSecond}
+}
+
+// deposit is called once per request
+func (rb *retryBudget) deposit() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.tokens = min(rb.tokens+rb.ratio, maxBudgetTokens)
+}
+
+// withdraw reports whether one more retry is within budget
+func (rb *retryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	if now := time.Now(); now.Sub(rb.window) >= time.Second {
+		rb.window = now
+		rb.minUsed = 0
+	}
+	switch {
+	case rb.minUsed < rb.minPerSecond:
+		rb.minUsed++
+	case rb.tokens >= 1:
+		rb.tokens--
+	default:
+		rb.denied++
+		return false
+	}
+	rb.allowed++
+	return true
+}
+
+func (rb *retryBudget) counts() (allowed, denied int64) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	return rb.allowed, rb.denied
+}
+
+// retryable reports whether r may be sent again after a failure of class
+func retryable(r *http.Request, class ErrorClass) bool {
+	switch class {
+	case ClassConnRefused:
+		return replayable(r)
+	case ClassConnReset, ClassPrematureEOF:
+		return idempotent(r.Method) && replayable(r)
+	}
+	return false
+}
+
+// replayable reports whether r's body, if any, can be sent again
+func replayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
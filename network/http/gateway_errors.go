@@ -1,47 +1,213 @@
 // gateway_errors.go demonstrates 502 Bad Gateway and 504 Gateway Timeout errors
 //
 // Architecture:
-//   Client -> Reverse Proxy (:8080) -> Upstream Server (:9090)
+//   Client -> Reverse Proxy (:8080) -> Upstream Servers (:9090, :9091, :9092)
 //
 // 502 Bad Gateway: Upstream returns invalid/malformed response
 // 504 Gateway Timeout: Upstream takes too long to respond
 //
-// Run: go run gateway_errors.go
+// Each failure is classified by error type (gateway/classify.go) and
+// answered with its status and a JSON body naming the class:
+//
+//	{"error":{"code":"upstream_header_timeout","status":504,
+//	  "message":"the upstream took too long to respond","upstream":"localhost:9092",...}}
+//
+// The proxy is the gateway package: routes map path prefixes to pools of
+// upstreams with load balancing, health checks and passive ejection (see
+// gateway/gateway.go). Errors name the upstream that caused them, and
+// every response carries it in X-Upstream.
+//
+// Each upstream has a circuit breaker: 3 failures (connection errors,
+// timeouts, malformed responses) open it for 5s, during which the route
+// answers 503 with Retry-After instead of trying. Idempotent requests
+// whose connection was reset are retried on another upstream (up to 2
+// times, within a retry budget; X-Upstream-Retries counts them).
+//
+// Run: go run gateway_errors.go [-config gateway.json]
 // Test:
-//   curl http://localhost:8080/normal    # 200 OK
-//   curl http://localhost:8080/slow      # 504 Gateway Timeout
-//   curl http://localhost:8080/crash     # 502 Bad Gateway
+//   curl http://localhost:8080/normal    # 200 OK, round robin over 3 upstreams
+//   curl http://localhost:8080/slow      # 504 upstream_header_timeout
+//   curl http://localhost:8080/crash     # 502 upstream_premature_eof, after retrying on the other upstreams
+//   curl http://localhost:8080/invalid   # 502 upstream_malformed_response
+//   curl http://localhost:8080/truncated # 200, then the connection drops (upstream_premature_eof in the log)
+//   curl http://localhost:8080/stall     # 200, then cut off after 5s (upstream_body_timeout in the log)
+//   curl http://localhost:8080/refused/  # 502 upstream_connection_refused
+//   curl http://localhost:8080/nxdomain/ # 502 upstream_dns_failure
+//   curl http://localhost:8080/tls/      # 502 upstream_tls_failure (HTTPS to a plain HTTP port)
+//   curl -X POST http://localhost:8080/crash      # 502, POST is not retried
+//   for i in 1 2 3 4; do curl -si http://localhost:8080/solo/invalid | head -1; done  # 502 x3, then 503
+//   curl http://localhost:8080/lc/normal # least connections
+//   curl -H 'X-User: alice' http://localhost:8080/hash/normal  # same upstream every time
+//   curl http://localhost:9091/sick      # fail :9091's health checks (again to recover)
+//   curl http://localhost:8080/gateway/status
+//   curl http://localhost:8080/metrics   # Prometheus text format
+//
+// /cached/ has an HTTP cache (see gateway/cache.go) in front of :9090,
+// whose /cacheable is fresh for 5s and takes 0.5s to render:
+//   curl -si http://localhost:8080/cached/cacheable   # X-Cache: MISS, then HIT
+//   for i in 1 2 3 4 5; do curl -s http://localhost:8080/cached/cacheable & done  # one upstream request
+//   curl -si -H 'Accept-Language: ja' http://localhost:8080/cached/cacheable  # its own entry (Vary)
+//   sleep 6; curl -si http://localhost:8080/cached/cacheable   # UPDATING: stale, refreshed by ETag behind it
+//   curl http://localhost:9090/sick; sleep 16; curl -si http://localhost:8080/cached/cacheable  # STALE, not 503
+//
+// Every proxied request is logged to stdout as a line of JSON (logs go to
+// stderr), e.g. go run gateway_errors.go 2>/dev/null | jq:
+//
+//	{"time":"...","method":"GET","path":"/crash","route":"/","upstream":"localhost:9092",
+//	 "status":502,"bytes":181,"retries":2,"error":"upstream_premature_eof",
+//	 "remote":"[::1]:52514","latency_ms":3.2}
+//
+// Chaos: every upstream also serves /chaos (see chaos/chaos.go), failing
+// as configured by -chaos (a JSON file) or query parameters, reproducibly
+// from -seed:
+//   curl 'http://localhost:8080/chaos?latency=lognormal:1s,1'       # some 504s (3s header timeout)
+//   curl 'http://localhost:8080/chaos?error_rate=0.3'                # random 5xx
+//   curl 'http://localhost:8080/chaos?fault=rst'                     # 502 upstream_connection_reset, after retries
+//   curl 'http://localhost:8080/chaos?fault=rst_after_headers'       # dropped (upstream_connection_reset in the log)
+//   curl 'http://localhost:8080/chaos?fault=wrong_length'            # dropped (upstream_premature_eof in the log)
+//   curl 'http://localhost:8080/chaos?fault=half_close&fault_rate=0.5'
+//   curl 'http://localhost:8080/chaos?drip=1s&chunk_size=16'         # alive but slow
+//   curl 'http://localhost:8080/chaos?drip=6s&chunk_size=512'        # too slow: body timeout
+//   curl 'http://localhost:8080/chaos?seed=42&error_rate=0.5'        # replay one request
 
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
+	"sync/atomic"
 	"time"
+
+	"claude-go/network/http/chaos"
+	"claude-go/network/http/gateway"
+	"claude-go/network/http/metrics"
 )
 
+var upstreamAddrs = []string{":9090", ":9091", ":9092"}
+
 func main() {
-	// Start upstream server
-	go startUpstreamServer()
+	configPath := flag.String("config", "", "gateway config file (default: built-in demo routes)")
+	chaosPath := flag.String("chaos", "", "chaos config file for the upstreams' /chaos endpoint")
+	seed := flag.Int64("seed", 1, "chaos RNG seed (upstream i uses seed+i)")
+	flag.Parse()
+
+	chaosConfig := chaos.DefaultConfig
+	if *chaosPath != "" {
+		var err error
+		if chaosConfig, err = chaos.LoadConfig(*chaosPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *chaosPath == "" || isFlagSet("seed") {
+		chaosConfig.Seed = *seed
+	}
+
+	// Start upstream servers
+	for i, addr := range upstreamAddrs {
+		cfg := chaosConfig
+		cfg.Seed += int64(i)
+		monkey, err := chaos.New(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go startUpstreamServer(addr, monkey)
+	}
 	time.Sleep(100 * time.Millisecond)
 
 	// Start reverse proxy
-	startReverseProxy()
+	startReverseProxy(*configPath)
+}
+
+// defaultConfig proxies every route to all three upstreams
+func defaultConfig() gateway.Config {
+	var upstreams []string
+	for _, addr := range upstreamAddrs {
+		upstreams = append(upstreams, "http://localhost"+addr)
+	}
+	check := &gateway.HealthCheckConfig{
+		Path:     "/healthz",
+		Interval: gateway.Duration(time.Second),
+		Timeout:  gateway.Duration(500 * time.Millisecond),
+	}
+	passive := gateway.PassiveConfig{Max502s: 3, EjectFor: gateway.Duration(10 * time.Second)}
+	breaker := &gateway.BreakerConfig{FailureThreshold: 3, OpenFor: gateway.Duration(5 * time.Second)}
+	retry := gateway.RetryConfig{Attempts: 2, BudgetRatio: 0.2, MinPerSecond: 3}
+
+	route := func(prefix, balance string) gateway.RouteConfig {
+		return gateway.RouteConfig{
+			Prefix: prefix, Upstreams: upstreams, Balance: balance, StripPrefix: prefix != "/",
+			HealthCheck: check, Passive: passive, Breaker: breaker, Retry: retry,
+		}
+	}
+	hash := route("/hash/", "consistent_hash")
+	hash.HashKey = "header:X-User"
+	solo := route("/solo/", "round_robin")
+	solo.Upstreams = upstreams[:1]
+	solo.Passive = gateway.PassiveConfig{} // Leave it to the breaker
+	cached := route("/cached/", "round_robin")
+	cached.Upstreams = upstreams[:1] // So /sick takes the route down
+	cached.Cache = &gateway.CacheConfig{}
+
+	// Upstreams that can never answer, one per failure class
+	broken := func(prefix, upstream string) gateway.RouteConfig {
+		return gateway.RouteConfig{Prefix: prefix, Upstreams: []string{upstream}, StripPrefix: true}
+	}
+
+	return gateway.Config{Routes: []gateway.RouteConfig{
+		route("/", "round_robin"),
+		route("/lc/", "least_conn"),
+		hash,
+		solo,
+		cached,
+		broken("/refused/", "http://localhost:9099"),
+		broken("/nxdomain/", "http://upstream.invalid"),
+		broken("/tls/", "https://localhost"+upstreamAddrs[0]),
+	}}
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 // Upstream server simulates various failure scenarios
-func startUpstreamServer() {
+func startUpstreamServer(addr string, monkey *chaos.Handler) {
 	mux := http.NewServeMux()
 
+	// Configurable failures, see chaos/chaos.go
+	mux.Handle("/chaos", monkey)
+
+	// Health check target; /sick toggles it between 200 and 503
+	var sick atomic.Bool
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if sick.Load() {
+			http.Error(w, "sick", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/sick", func(w http.ResponseWriter, r *http.Request) {
+		now := !sick.Load()
+		sick.Store(now)
+		fmt.Fprintf(w, "upstream %s sick=%v\n", addr, now)
+	})
+
 	// Normal response
 	mux.HandleFunc("/normal", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("Hello from upstream!"))
+		fmt.Fprintf(w, "Hello from upstream %s!\n", addr)
 	})
 
 	// Slow response - causes 504 Gateway Timeout
@@ -68,6 +234,25 @@ func startUpstreamServer() {
 		conn.Close()
 	})
 
+	// Truncated body - the status is already sent, so the client just
+	// sees the connection drop
+	mux.HandleFunc("/truncated", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("only ten.\n"))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler) // Close without the other 90 bytes
+	})
+
+	// Stalled body - headers and a first line, then nothing
+	mux.HandleFunc("/stall", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first line, then silence\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-time.After(30 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+
 	// Invalid response - also causes 502
 	mux.HandleFunc("/invalid", func(w http.ResponseWriter, r *http.Request) {
 		log.Println("[Upstream] Sending malformed response...")
@@ -84,15 +269,43 @@ func startUpstreamServer() {
 		conn.Close()
 	})
 
-	log.Println("[Upstream] Starting on :9090")
-	http.ListenAndServe(":9090", mux)
+	// Cacheable: fresh for 5s, then revalidated by ETag (a new version
+	// every 30s); slow, so coalesced misses show
+	var served atomic.Int64
+	mux.HandleFunc("/cacheable", func(w http.ResponseWriter, r *http.Request) {
+		n := served.Add(1)
+		version := fmt.Sprintf(`"v%d"`, time.Now().Unix()/30)
+		w.Header().Set("Cache-Control", "max-age=5, stale-while-revalidate=10, stale-if-error=60")
+		w.Header().Set("ETag", version)
+		w.Header().Set("Vary", "Accept-Language")
+		if r.Header.Get("If-None-Match") == version {
+			log.Printf("[Upstream] %s /cacheable #%d: not modified", addr, n)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		log.Printf("[Upstream] %s /cacheable #%d: rendering %s", addr, n, version)
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprintf(w, "cacheable #%d from %s, version %s, language %q\n", n, addr, version, r.Header.Get("Accept-Language"))
+	})
+
+	log.Printf("[Upstream] Starting on %s", addr)
+	http.ListenAndServe(addr, mux)
 }
 
 // Reverse proxy with timeout settings
-func startReverseProxy() {
-	upstream, _ := url.Parse("http://localhost:9090")
+func startReverseProxy(configPath string) {
+	cfg := defaultConfig()
+	if configPath != "" {
+		var err error
+		if cfg, err = gateway.LoadConfig(configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy, err := gateway.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Custom transport with short timeout for demonstration
 	proxy.Transport = &http.Transport{
@@ -102,28 +315,35 @@ func startReverseProxy() {
 		}).DialContext,
 		ResponseHeaderTimeout: 3 * time.Second, // Timeout waiting for response headers
 	}
+	proxy.BodyTimeout = 5 * time.Second // Timeout between body reads
 
-	// Custom error handler
-	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("[Proxy] Error: %v", err)
-
-		// Determine error type
-		if isTimeout(err) {
-			// 504 Gateway Timeout
-			w.WriteHeader(http.StatusGatewayTimeout)
-			fmt.Fprintf(w, "504 Gateway Timeout: upstream server took too long\nError: %v\n", err)
-		} else {
-			// 502 Bad Gateway
-			w.WriteHeader(http.StatusBadGateway)
-			fmt.Fprintf(w, "502 Bad Gateway: upstream server returned invalid response\nError: %v\n", err)
-		}
+	// Custom error handler; b is the upstream that failed
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, b *gateway.Backend, err error) {
+		class := gateway.Classify(err)
+		log.Printf("[Proxy] %d %v", class.Status(), err)
+		gateway.WriteError(w, r, b, err)
 	}
 
-	// Wrap proxy to log requests
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[Proxy] Request: %s %s", r.Method, r.URL.Path)
-		proxy.ServeHTTP(w, r)
+	// Structured access log on stdout, and the same records as metrics
+	registry := metrics.NewRegistry()
+	accessLog := gateway.AccessLog(os.Stdout)
+	gatewayMetrics := gateway.NewMetrics(proxy, registry)
+	proxy.OnRequest = func(rec gateway.Record) {
+		accessLog(rec)
+		gatewayMetrics.Observe(rec)
+	}
+
+	proxy.Start(context.Background())
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	mux.HandleFunc("/gateway/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(proxy.Status())
 	})
+	mux.Handle("/", proxy)
 
 	log.Println("[Proxy] Starting reverse proxy on :8080")
 	log.Println("")
@@ -132,56 +352,21 @@ func startReverseProxy() {
 	log.Println("  curl http://localhost:8080/slow     # 504 Gateway Timeout (wait 3s)")
 	log.Println("  curl http://localhost:8080/crash    # 502 Bad Gateway")
 	log.Println("  curl http://localhost:8080/invalid  # 502 Bad Gateway")
+	log.Println("  curl -si http://localhost:8080/solo/invalid  # 502 x3, then 503 + Retry-After")
+	log.Println("  curl http://localhost:8080/lc/normal   # least connections")
+	log.Println("  curl -H 'X-User: alice' http://localhost:8080/hash/normal")
+	log.Println("  curl http://localhost:9091/sick     # toggle :9091's health check")
+	log.Println("  curl http://localhost:8080/gateway/status")
+	log.Println("  curl http://localhost:8080/metrics")
+	log.Println("  curl -si http://localhost:8080/cached/cacheable  # X-Cache: MISS, then HIT")
+	log.Println("  curl 'http://localhost:8080/chaos?fault=rst_after_headers'  # see the header comment for more")
 	log.Println("")
 
-	if err := http.ListenAndServe(":8080", handler); err != nil {
+	if err := http.ListenAndServe(":8080", mux); err != nil {
 		log.Fatal(err)
 	}
 }
 
-// isTimeout checks if error is a timeout error
-func isTimeout(err error) bool {
-	if err == nil {
-		return false
-	}
-
-	// Check for context deadline exceeded
-	if err.Error() == "context deadline exceeded" {
-		return true
-	}
-
-	// Check for net.Error timeout
-	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-		return true
-	}
-
-	// Check wrapped errors
-	if unwrapped := err.(interface{ Unwrap() error }); unwrapped != nil {
-		return isTimeout(unwrapped.Unwrap())
-	}
-
-	// Check error message for timeout indicators
-	errStr := err.Error()
-	if contains(errStr, "timeout") || contains(errStr, "deadline") {
-		return true
-	}
-
-	return false
-}
-
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(s) > 0 && containsAt(s, substr, 0))
-}
-
-func containsAt(s, substr string, start int) bool {
-	for i := start; i <= len(s)-len(substr); i++ {
-		if s[i:i+len(substr)] == substr {
-			return true
-		}
-	}
-	return false
-}
-
 // Alternative: Simple demonstration without reverse proxy
 func simpleDemo() {
 	// Direct server that returns 502/504
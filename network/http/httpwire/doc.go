@@ -0,0 +1,13 @@
+// Package httpwire parses and serializes HTTP/1.x messages on raw
+// connections, for the socket-level examples in network/http.
+//
+// It is deliberately small: ReadRequest and ReadResponse read one complete
+// message (Content-Length, chunked, or read-until-close bodies), and
+// WriteRequest / WriteResponse serialize one. Headers keep their original
+// order and every repeated field. All reads are bounded by Limits, and
+// malformed input is reported as a *ParseError wrapping one of the Err*
+// sentinels, which StatusCode maps to the status a server should reply with.
+//
+// Conformance table and mutation fuzzer: go run network/http/wire_conformance.go
+// Fuzz targets, seeded from that table: go test -fuzz=FuzzReadRequest ./network/http/httpwire
+package httpwire
@@ -0,0 +1,123 @@
+package httpwire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors for malformed input. Parse functions wrap them in a
+// *ParseError, so use errors.Is to test for a particular class.
+var (
+	ErrLineTooLong          = errors.New("line too long")
+	ErrURITooLong           = errors.New("request line too long")
+	ErrHeaderTooLarge       = errors.New("header section too large")
+	ErrTooManyHeaders       = errors.New("too many header fields")
+	ErrBodyTooLarge         = errors.New("body too large")
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrMalformedStatusLine  = errors.New("malformed status line")
+	ErrMalformedHeader      = errors.New("malformed header field")
+	ErrInvalidContentLength = errors.New("invalid Content-Length")
+	ErrInvalidChunk         = errors.New("invalid chunked encoding")
+	ErrUnsupportedEncoding  = errors.New("unsupported transfer coding")
+	ErrUnsupportedVersion   = errors.New("unsupported HTTP version")
+
+	// Framing ambiguities: inputs two parsers could disagree about, the
+	// root of request smuggling. Rejected outright instead of guessed at.
+	ErrBareLF                 = errors.New("line not terminated by CRLF")
+	ErrObsFold                = errors.New("obsolete line folding")
+	ErrAmbiguousFraming       = errors.New("ambiguous message framing")
+	ErrDuplicateContentLength = errors.New("multiple Content-Length values")
+)
+
+// ParseError describes where and why input was rejected
+type ParseError struct {
+	Err    error  // One of the sentinel errors above, or an I/O error
+	Detail string // Offending input, truncated for logging
+}
+
+func (e *ParseError) Error() string {
+	if e.Detail == "" {
+		return "httpwire: " + e.Err.Error()
+	}
+	return fmt.Sprintf("httpwire: %s: %q", e.Err, e.Detail)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func parseErr(err error, detail string) error {
+	const maxDetail = 64
+	if len(detail) > maxDetail {
+		detail = detail[:maxDetail] + "..."
+	}
+	return &ParseError{Err: err, Detail: detail}
+}
+
+// StatusCode maps a parse error to the response a server should send.
+// Returns 0 for errors that are not the peer's fault (I/O, EOF), in which
+// case the connection should just be closed.
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrURITooLong):
+		return 414 // URI Too Long
+	case errors.Is(err, ErrLineTooLong),
+		errors.Is(err, ErrHeaderTooLarge),
+		errors.Is(err, ErrTooManyHeaders):
+		return 431 // Request Header Fields Too Large
+	case errors.Is(err, ErrBodyTooLarge):
+		return 413 // Content Too Large
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return 501 // Not Implemented
+	case errors.Is(err, ErrUnsupportedVersion):
+		return 505 // HTTP Version Not Supported
+	case errors.Is(err, ErrMalformedRequestLine),
+		errors.Is(err, ErrMalformedStatusLine),
+		errors.Is(err, ErrMalformedHeader),
+		errors.Is(err, ErrInvalidContentLength),
+		errors.Is(err, ErrInvalidChunk),
+		errors.Is(err, ErrBareLF),
+		errors.Is(err, ErrObsFold),
+		errors.Is(err, ErrAmbiguousFraming),
+		errors.Is(err, ErrDuplicateContentLength):
+		return 400
+	}
+	return 0
+}
+
+var statusText = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
+	200: "OK",
+	201: "Created",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	304: "Not Modified",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	408: "Request Timeout",
+	411: "Length Required",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+}
+
+// StatusText returns the reason phrase for code, or "" if unknown
+func StatusText(code int) string {
+	return statusText[code]
+}
@@ -0,0 +1,85 @@
+package httpwire
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// Fuzz targets for the parsers, with the same properties the mutation loop
+// in wire_conformance.go checks. testdata/fuzz holds the seed corpus, the
+// conformance table's inputs, written from network/http by
+//
+//	go run wire_conformance.go -iterations 0 -corpus httpwire/testdata/fuzz
+//
+// go test runs every seed as a regression case; go test -fuzz=FuzzReadRequest
+// explores from them and adds any input that fails to the corpus.
+
+// fuzzLimits are small, so mutations reach the limit checks too
+var fuzzLimits = Limits{
+	MaxLineBytes:   64,
+	MaxHeaderBytes: 256,
+	MaxHeaderCount: 4,
+	MaxBodyBytes:   32,
+}
+
+// FuzzReadRequest: the parser never panics, and any request it accepts
+// survives WriteRequest -> ReadRequest unchanged
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte("POST /a?b=c HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\nX-T: 1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		req, err := ReadRequest(bufio.NewReader(bytes.NewReader(input)), fuzzLimits)
+		if err != nil {
+			return
+		}
+		if int64(len(req.Body)) > fuzzLimits.MaxBodyBytes {
+			t.Fatalf("accepted a %d-byte body over MaxBodyBytes %d", len(req.Body), fuzzLimits.MaxBodyBytes)
+		}
+
+		// Limits are lifted on re-read because WriteRequest adds Content-Length
+		var buf bytes.Buffer
+		if err := WriteRequest(&buf, req); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		again, err := ReadRequest(bufio.NewReader(&buf), DefaultLimits)
+		if err != nil {
+			t.Fatalf("re-read %q: %v", buf.String(), err)
+		}
+		if again.Method != req.Method || again.Target != req.Target || !bytes.Equal(again.Body, req.Body) {
+			t.Fatalf("round trip changed request: %q", buf.String())
+		}
+	})
+}
+
+// FuzzReadChunked: the chunked decoder never panics or passes
+// MaxBodyBytes, and a body it accepts reads back the same once re-chunked
+func FuzzReadChunked(f *testing.F) {
+	f.Add([]byte("1\r\na\r\n2;ext=v\r\nbc\r\n0\r\nX-T: 1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var trailer Header
+		body, _, err := readChunked(bufio.NewReader(bytes.NewReader(input)), &trailer, fuzzLimits)
+		if err != nil {
+			return
+		}
+		if int64(len(body)) > fuzzLimits.MaxBodyBytes {
+			t.Fatalf("accepted a %d-byte body over MaxBodyBytes %d", len(body), fuzzLimits.MaxBodyBytes)
+		}
+
+		var buf bytes.Buffer
+		cw := NewChunkedWriter(&buf)
+		if _, err := cw.Write(body); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := cw.Close(&trailer); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		var again Header
+		got, _, err := readChunked(bufio.NewReader(&buf), &again, DefaultLimits)
+		if err != nil {
+			t.Fatalf("re-read %q: %v", buf.String(), err)
+		}
+		if !bytes.Equal(got, body) || again.Len() != trailer.Len() {
+			t.Fatalf("round trip changed body or trailer: %q", buf.String())
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package httpwire
+
+import "strings"
+
+// Field is a single header line as it appeared on the wire
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Header is an ordered list of fields.
+//
+// Unlike map[string]string it keeps every occurrence of a repeated name
+// (Set-Cookie, Via, ...) and the order fields were received in.
+// Lookups are case-insensitive; names keep their original spelling.
+type Header struct {
+	fields []Field
+}
+
+// Add appends a field, keeping any existing ones with the same name
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, Field{Name: name, Value: value})
+}
+
+// Set replaces all fields named name with a single one
+func (h *Header) Set(name, value string) {
+	h.Del(name)
+	h.Add(name, value)
+}
+
+// Del removes all fields named name
+func (h *Header) Del(name string) {
+	kept := h.fields[:0]
+	for _, f := range h.fields {
+		if !strings.EqualFold(f.Name, name) {
+			kept = append(kept, f)
+		}
+	}
+	h.fields = kept
+}
+
+// Get returns the first value for name, or "" if absent
+func (h *Header) Get(name string) string {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Has reports whether at least one field is named name
+func (h *Header) Has(name string) bool {
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Values returns every value for name in wire order
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+// HasToken reports whether the comma-separated list in any name field
+// contains token, e.g. HasToken("Connection", "close")
+func (h *Header) HasToken(name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Fields returns the fields in wire order. The slice must not be modified.
+func (h *Header) Fields() []Field {
+	return h.fields
+}
+
+// Len returns the number of fields
+func (h *Header) Len() int {
+	return len(h.fields)
+}
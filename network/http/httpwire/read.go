@@ -0,0 +1,484 @@
+package httpwire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits bounds how much memory a single message can make us allocate.
+// A zero field means "use the DefaultLimits value".
+type Limits struct {
+	MaxLineBytes   int   // Request line, status line, or one header line
+	MaxHeaderBytes int   // All header lines together
+	MaxHeaderCount int   // Number of header fields
+	MaxBodyBytes   int64 // Decoded body, Content-Length or chunked
+}
+
+// DefaultLimits are in the same range as common servers (nginx, Go's net/http)
+var DefaultLimits = Limits{
+	MaxLineBytes:   8 << 10,  // 8KB
+	MaxHeaderBytes: 64 << 10, // 64KB
+	MaxHeaderCount: 100,
+	MaxBodyBytes:   10 << 20, // 10MB
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxLineBytes <= 0 {
+		l.MaxLineBytes = DefaultLimits.MaxLineBytes
+	}
+	if l.MaxHeaderBytes <= 0 {
+		l.MaxHeaderBytes = DefaultLimits.MaxHeaderBytes
+	}
+	if l.MaxHeaderCount <= 0 {
+		l.MaxHeaderCount = DefaultLimits.MaxHeaderCount
+	}
+	if l.MaxBodyBytes <= 0 {
+		l.MaxBodyBytes = DefaultLimits.MaxBodyBytes
+	}
+	return l
+}
+
+// Request is a parsed HTTP/1.x request with its body fully read
+type Request struct {
+	Method  string
+	Target  string // Request-target as sent, e.g. "/users/42?x=1"
+	Proto   string // "HTTP/1.1"
+	Header  Header
+	Body    []byte
+	Trailer Header // Fields after the last chunk (chunked bodies only)
+	Chunked bool
+}
+
+// Path returns Target without the query string
+func (r *Request) Path() string {
+	if i := strings.IndexByte(r.Target, '?'); i >= 0 {
+		return r.Target[:i]
+	}
+	return r.Target
+}
+
+// RawQuery returns the part of Target after '?', undecoded
+func (r *Request) RawQuery() string {
+	if i := strings.IndexByte(r.Target, '?'); i >= 0 {
+		return r.Target[i+1:]
+	}
+	return ""
+}
+
+// WantsClose reports whether the connection should close after this request:
+// HTTP/1.1 defaults to keep-alive, HTTP/1.0 defaults to close.
+func (r *Request) WantsClose() bool {
+	if r.Header.HasToken("Connection", "close") {
+		return true
+	}
+	if r.Proto == "HTTP/1.0" {
+		return !r.Header.HasToken("Connection", "keep-alive")
+	}
+	return false
+}
+
+// Response is a parsed HTTP/1.x response, or one to be written
+type Response struct {
+	Proto      string // "HTTP/1.1"; WriteResponse defaults to it when empty
+	StatusCode int
+	Reason     string // Reason phrase; WriteResponse fills in StatusText when empty
+	Header     Header
+	Body       []byte
+	Trailer    Header
+	Chunked    bool // ReadResponse: body arrived chunked
+	Chunks     int  // ReadResponse: number of data chunks received
+
+	// Stream, when set, is sent chunked by WriteResponse instead of Body.
+	// If StreamLength > 0 it is sent with that Content-Length instead,
+	// and exactly that many bytes are copied from Stream.
+	Stream       io.Reader
+	StreamLength int64
+}
+
+// ReadRequest reads one request from r. It consumes exactly the bytes of
+// that request, so it can be called repeatedly on a keep-alive connection.
+//
+// A clean EOF before the first byte returns io.EOF unwrapped, so callers
+// can tell "client went away" from "client sent garbage".
+func ReadRequest(r *bufio.Reader, lim Limits) (*Request, error) {
+	req, err := ReadRequestHeader(r, lim)
+	if err != nil {
+		return nil, err
+	}
+	if err := ReadRequestBody(r, req, lim); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// ReadRequestHeader reads the request line and header section only, for
+// servers that apply a different deadline to the body (see
+// ReadRequestBody). Errors are as for ReadRequest.
+func ReadRequestHeader(r *bufio.Reader, lim Limits) (*Request, error) {
+	lim = lim.withDefaults()
+
+	line, err := readLine(r, lim.MaxLineBytes)
+	if err != nil {
+		if errors.Is(err, ErrLineTooLong) {
+			return nil, parseErr(ErrURITooLong, "")
+		}
+		return nil, err
+	}
+
+	// request-line = method SP request-target SP HTTP-version
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return nil, parseErr(ErrMalformedRequestLine, line)
+	}
+	if !isToken(parts[0]) || !isTarget(parts[1]) {
+		return nil, parseErr(ErrMalformedRequestLine, line)
+	}
+	if err := checkVersion(parts[2], ErrMalformedRequestLine); err != nil {
+		return nil, err
+	}
+
+	req := &Request{Method: parts[0], Target: parts[1], Proto: parts[2]}
+
+	if err := readHeader(r, &req.Header, lim); err != nil {
+		return nil, err
+	}
+	// Two Host fields let a proxy and an origin route the same request
+	// differently (RFC 9112 section 3.2)
+	if len(req.Header.Values("Host")) > 1 {
+		return nil, parseErr(ErrMalformedHeader, "duplicate Host")
+	}
+	return req, nil
+}
+
+// ReadRequestBody reads the body framed by req's header, plus any trailer
+func ReadRequestBody(r *bufio.Reader, req *Request, lim Limits) error {
+	var err error
+	req.Body, req.Chunked, err = readBody(r, &req.Header, &req.Trailer, lim.withDefaults(), false, nil)
+	return err
+}
+
+// ReadResponse reads one response from r.
+// Responses without Content-Length or chunked framing are read until EOF.
+// The response to a HEAD request has no body, whatever its header says:
+// read that with ReadResponseHeader alone.
+func ReadResponse(r *bufio.Reader, lim Limits) (*Response, error) {
+	resp, err := ReadResponseHeader(r, lim)
+	if err != nil {
+		return nil, err
+	}
+	if err := ReadResponseBody(r, resp, lim); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReadResponseHeader reads the status line and header section only, for
+// clients that know from their request whether a body follows (see
+// ReadResponseBody). Errors are as for ReadResponse.
+func ReadResponseHeader(r *bufio.Reader, lim Limits) (*Response, error) {
+	lim = lim.withDefaults()
+
+	line, err := readLine(r, lim.MaxLineBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// status-line = HTTP-version SP status-code SP [ reason-phrase ]
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return nil, parseErr(ErrMalformedStatusLine, line)
+	}
+	if err := checkVersion(parts[0], ErrMalformedStatusLine); err != nil {
+		return nil, err
+	}
+	if len(parts[1]) != 3 {
+		return nil, parseErr(ErrMalformedStatusLine, line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil || code < 100 {
+		return nil, parseErr(ErrMalformedStatusLine, line)
+	}
+
+	resp := &Response{Proto: parts[0], StatusCode: code}
+	if len(parts) == 3 {
+		resp.Reason = parts[2]
+	}
+
+	if err := readHeader(r, &resp.Header, lim); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReadResponseBody reads the body framed by resp's header, plus any trailer
+func ReadResponseBody(r *bufio.Reader, resp *Response, lim Limits) error {
+	// 1xx, 204 and 304 never carry a body, whatever the headers say
+	if code := resp.StatusCode; code < 200 || code == 204 || code == 304 {
+		return nil
+	}
+
+	var err error
+	resp.Body, resp.Chunked, err = readBody(r, &resp.Header, &resp.Trailer, lim.withDefaults(), true, &resp.Chunks)
+	return err
+}
+
+// readLine returns one line without its CRLF.
+// Unlike ReadString it stops buffering once max bytes are exceeded.
+// A bare LF is an error: a peer that splits lines on LF alone would see
+// different message boundaries than one that requires CRLF.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var buf []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if len(buf)+len(frag) > max+2 { // +2 for CRLF
+			return "", parseErr(ErrLineTooLong, string(buf))
+		}
+		buf = append(buf, frag...)
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(buf) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	if !bytes.HasSuffix(buf, []byte("\r\n")) {
+		return "", parseErr(ErrBareLF, string(buf))
+	}
+	return string(buf[:len(buf)-2]), nil
+}
+
+// readHeader reads fields up to and including the empty line
+func readHeader(r *bufio.Reader, h *Header, lim Limits) error {
+	total := 0
+	for {
+		line, err := readLine(r, lim.MaxLineBytes)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+
+		total += len(line) + 2
+		if total > lim.MaxHeaderBytes {
+			return parseErr(ErrHeaderTooLarge, "")
+		}
+		if h.Len() >= lim.MaxHeaderCount {
+			return parseErr(ErrTooManyHeaders, "")
+		}
+
+		// A line starting with whitespace continues the previous field
+		// (obs-fold, RFC 9112 section 5.2); before the first field it
+		// would hide a header from parsers that skip it
+		if line[0] == ' ' || line[0] == '\t' {
+			return parseErr(ErrObsFold, line)
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !isToken(name) || !isFieldValue(value) {
+			return parseErr(ErrMalformedHeader, line)
+		}
+		h.Add(name, strings.Trim(value, " \t"))
+	}
+}
+
+// readBody applies the message body length rules of RFC 9112 section 6.3.
+// untilEOF selects the response rule for messages with no framing headers.
+//
+// Requests are held to the strict reading: Content-Length together with
+// Transfer-Encoding is rejected rather than resolved in favor of chunked,
+// since a front end that resolved it the other way would see a different
+// request boundary (CL.TE / TE.CL smuggling).
+func readBody(r *bufio.Reader, h, trailer *Header, lim Limits, untilEOF bool, chunks *int) ([]byte, bool, error) {
+	if te := h.Values("Transfer-Encoding"); len(te) > 0 {
+		if !untilEOF && h.Has("Content-Length") {
+			return nil, false, parseErr(ErrAmbiguousFraming, "Content-Length with Transfer-Encoding")
+		}
+
+		// chunked is the only coding implemented, so it must be the only
+		// one present, exactly once
+		joined := strings.Join(te, ",")
+		chunked := 0
+		for _, coding := range strings.Split(joined, ",") {
+			coding = strings.Trim(coding, " \t")
+			switch {
+			case coding == "":
+			case strings.EqualFold(coding, "chunked"):
+				chunked++
+			default:
+				return nil, false, parseErr(ErrUnsupportedEncoding, joined)
+			}
+		}
+		if chunked != 1 {
+			return nil, false, parseErr(ErrAmbiguousFraming, joined)
+		}
+		body, n, err := readChunked(r, trailer, lim)
+		if chunks != nil {
+			*chunks = n
+		}
+		return body, true, err
+	}
+
+	if cl := h.Values("Content-Length"); len(cl) > 0 {
+		// "5, 5" or two fields: RFC 9110 lets identical copies be merged,
+		// but there is no safe answer once they differ, so refuse both
+		if len(cl) > 1 || strings.Contains(cl[0], ",") {
+			return nil, false, parseErr(ErrDuplicateContentLength, strings.Join(cl, ", "))
+		}
+		raw := cl[0]
+		// Digits only: ParseInt alone would take "+5" and "-0"
+		if raw == "" || strings.TrimLeft(raw, "0123456789") != "" {
+			return nil, false, parseErr(ErrInvalidContentLength, raw)
+		}
+		length, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, false, parseErr(ErrInvalidContentLength, raw)
+		}
+		if length > lim.MaxBodyBytes {
+			return nil, false, parseErr(ErrBodyTooLarge, raw)
+		}
+		body := make([]byte, length)
+		// ReadFull, not Read: a single Read may return fewer bytes
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, false, err
+		}
+		return body, false, nil
+	}
+
+	if !untilEOF {
+		return nil, false, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r, lim.MaxBodyBytes+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > lim.MaxBodyBytes {
+		return nil, false, parseErr(ErrBodyTooLarge, "")
+	}
+	return body, false, nil
+}
+
+// readChunked decodes a chunked body (RFC 9112 section 7.1):
+//
+//	chunk-size [; ext-name [= ext-val]] CRLF
+//	chunk-data CRLF
+//	...
+//	0 CRLF
+//	[trailer-field CRLF]...
+//	CRLF
+func readChunked(r *bufio.Reader, trailer *Header, lim Limits) ([]byte, int, error) {
+	var body []byte
+	chunks := 0
+	for {
+		line, err := readLine(r, lim.MaxLineBytes)
+		if err != nil {
+			return nil, chunks, err
+		}
+
+		// Chunk extensions follow ';' - parsed past but ignored
+		sizeStr, _, _ := strings.Cut(line, ";")
+		sizeStr = strings.TrimRight(sizeStr, " \t")
+		if sizeStr == "" || len(sizeStr) > 16 {
+			return nil, chunks, parseErr(ErrInvalidChunk, line)
+		}
+		size, err := strconv.ParseUint(sizeStr, 16, 64)
+		if err != nil {
+			return nil, chunks, parseErr(ErrInvalidChunk, line)
+		}
+		if size == 0 {
+			break
+		}
+		if uint64(len(body))+size > uint64(lim.MaxBodyBytes) {
+			return nil, chunks, parseErr(ErrBodyTooLarge, line)
+		}
+
+		start := len(body)
+		body = append(body, make([]byte, size)...)
+		if _, err := io.ReadFull(r, body[start:]); err != nil {
+			return nil, chunks, err
+		}
+		chunks++
+
+		// chunk-data is followed by CRLF, nothing else
+		crlf, err := readLine(r, lim.MaxLineBytes)
+		if err != nil {
+			return nil, chunks, err
+		}
+		if crlf != "" {
+			return nil, chunks, parseErr(ErrInvalidChunk, crlf)
+		}
+	}
+
+	if err := readHeader(r, trailer, lim); err != nil {
+		return nil, chunks, err
+	}
+	return body, chunks, nil
+}
+
+// checkVersion validates HTTP-version = "HTTP/" DIGIT "." DIGIT,
+// returning malformed (wrapped) if the syntax is wrong
+func checkVersion(v string, malformed error) error {
+	if len(v) != 8 || !strings.HasPrefix(v, "HTTP/") || v[6] != '.' ||
+		!isDigit(v[5]) || !isDigit(v[7]) {
+		return parseErr(malformed, v)
+	}
+	if v[5] != '1' {
+		return parseErr(ErrUnsupportedVersion, v)
+	}
+	return nil
+}
+
+// isTarget rejects request-targets containing control characters or
+// non-ASCII bytes, which must be percent-encoded
+func isTarget(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isFieldValue allows visible characters, SP, HTAB and obs-text;
+// a stray CR, NUL or other control character is rejected
+func isFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isToken reports whether s is a non-empty RFC 9110 token
+// (the character set allowed in methods and header names)
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', isDigit(c):
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package httpwire
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// WriteRequest serializes req. Content-Length is set from Body unless the
+// request is Chunked, in which case Body goes out as one chunk followed by
+// req.Trailer. A method, target or field name that is not valid on the
+// wire is an error, and nothing is written.
+func WriteRequest(w io.Writer, req *Request) error {
+	h := cloneHeader(&req.Header)
+	if req.Chunked {
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		announceTrailer(h, &req.Trailer)
+	} else if len(req.Body) > 0 {
+		h.Set("Content-Length", strconv.Itoa(len(req.Body)))
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := writeRequestHead(bw, req, h); err != nil {
+		return err
+	}
+
+	if req.Chunked {
+		cw := NewChunkedWriter(bw)
+		cw.Write(req.Body)
+		cw.Close(&req.Trailer)
+	} else {
+		bw.Write(req.Body)
+	}
+	return bw.Flush()
+}
+
+// WriteResponse serializes resp. With resp.Stream set the body is copied
+// from it using chunked encoding and resp.Trailer is sent after the last
+// chunk, unless resp.StreamLength gives the length up front; otherwise
+// resp.Body is sent with Content-Length.
+func WriteResponse(w io.Writer, resp *Response) error {
+	bw := bufio.NewWriter(w)
+
+	h := cloneHeader(&resp.Header)
+	noBody := resp.StatusCode < 200 || resp.StatusCode == 204 || resp.StatusCode == 304
+	switch {
+	case noBody:
+		h.Del("Content-Length")
+		h.Del("Transfer-Encoding")
+	case resp.Stream != nil && resp.StreamLength > 0:
+		h.Del("Transfer-Encoding")
+		h.Set("Content-Length", strconv.FormatInt(resp.StreamLength, 10))
+	case resp.Stream != nil:
+		h.Del("Content-Length")
+		h.Set("Transfer-Encoding", "chunked")
+		announceTrailer(h, &resp.Trailer)
+	default:
+		h.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	}
+
+	writeStatusLine(bw, resp)
+	writeFields(bw, h)
+	bw.WriteString("\r\n")
+
+	if noBody {
+		return bw.Flush()
+	}
+	if resp.Stream == nil {
+		bw.Write(resp.Body)
+		return bw.Flush()
+	}
+
+	// Flush the head first so the client sees headers before the body starts
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if resp.StreamLength > 0 {
+		_, err := io.CopyN(w, resp.Stream, resp.StreamLength)
+		return err
+	}
+	cw := NewChunkedWriter(w)
+	if _, err := io.Copy(cw, resp.Stream); err != nil {
+		return err
+	}
+	return cw.Close(&resp.Trailer)
+}
+
+// WriteResponseHead writes only the status line and header fields, for
+// handlers that produce the body themselves (e.g. with a ChunkedWriter)
+func WriteResponseHead(w io.Writer, resp *Response) error {
+	bw := bufio.NewWriter(w)
+	writeStatusLine(bw, resp)
+	writeFields(bw, &resp.Header)
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
+
+// WriteRequestHead writes only the request line and header fields, for
+// clients that send the body themselves (e.g. with a ChunkedWriter). The
+// header goes out as it is, framing fields included. Errors are as for
+// WriteRequest.
+func WriteRequestHead(w io.Writer, req *Request) error {
+	bw := bufio.NewWriter(w)
+	if err := writeRequestHead(bw, req, &req.Header); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeRequestHead checks everything a caller could use to add lines of
+// its own before writing any of it: values only lose their CR and LF, but
+// a method, target or name can't be repaired that way
+func writeRequestHead(bw *bufio.Writer, req *Request, h *Header) error {
+	if !isToken(req.Method) || req.Target == "" || !isTarget(req.Target) {
+		return fmt.Errorf("httpwire: invalid request line %q %q", req.Method, req.Target)
+	}
+	for _, f := range slices.Concat(h.Fields(), req.Trailer.Fields()) {
+		if !isToken(f.Name) {
+			return fmt.Errorf("httpwire: invalid field name %q", f.Name)
+		}
+	}
+
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	fmt.Fprintf(bw, "%s %s %s\r\n", req.Method, req.Target, proto)
+	writeFields(bw, h)
+	bw.WriteString("\r\n")
+	return nil
+}
+
+func writeStatusLine(bw *bufio.Writer, resp *Response) {
+	proto := resp.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	reason := resp.Reason
+	if reason == "" {
+		reason = StatusText(resp.StatusCode)
+	}
+	fmt.Fprintf(bw, "%s %d %s\r\n", proto, resp.StatusCode, reason)
+}
+
+func writeFields(bw *bufio.Writer, h *Header) {
+	for _, f := range h.Fields() {
+		// Drop CR/LF from values so a caller can't inject extra header lines
+		value := strings.NewReplacer("\r", "", "\n", "").Replace(f.Value)
+		fmt.Fprintf(bw, "%s: %s\r\n", f.Name, value)
+	}
+}
+
+func cloneHeader(h *Header) *Header {
+	c := &Header{fields: make([]Field, len(h.fields))}
+	copy(c.fields, h.fields)
+	return c
+}
+
+func announceTrailer(h, trailer *Header) {
+	if trailer.Len() == 0 {
+		return
+	}
+	var names []string
+	for _, f := range trailer.Fields() {
+		names = append(names, f.Name)
+	}
+	h.Set("Trailer", strings.Join(names, ", "))
+}
+
+// ChunkedWriter frames every Write as one chunk: size in hex, CRLF, data, CRLF
+type ChunkedWriter struct {
+	w io.Writer
+}
+
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{w: w}
+}
+
+func (cw *ChunkedWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil // A zero-length chunk would terminate the body
+	}
+	frame := make([]byte, 0, len(p)+20)
+	frame = strconv.AppendInt(frame, int64(len(p)), 16)
+	frame = append(frame, '\r', '\n')
+	frame = append(frame, p...)
+	frame = append(frame, '\r', '\n')
+	if _, err := cw.w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk, the trailer fields (may be nil) and the
+// terminating CRLF. It does not close the underlying writer.
+func (cw *ChunkedWriter) Close(trailer *Header) error {
+	bw := bufio.NewWriter(cw.w)
+	bw.WriteString("0\r\n")
+	if trailer != nil {
+		writeFields(bw, trailer)
+	}
+	bw.WriteString("\r\n")
+	return bw.Flush()
+}
@@ -0,0 +1,384 @@
+// Package metrics keeps counters, gauges and histograms and writes them
+// in the Prometheus text exposition format (version 0.0.4), so a server
+// can offer /metrics without a client library:
+//
+//	# HELP http_requests_total Requests handled.
+//	# TYPE http_requests_total counter
+//	http_requests_total{route="/api/",status="200"} 1027
+//	# TYPE http_request_duration_seconds histogram
+//	http_request_duration_seconds_bucket{route="/api/",le="0.1"} 1000
+//	http_request_duration_seconds_bucket{route="/api/",le="+Inf"} 1027
+//	http_request_duration_seconds_sum{route="/api/"} 53.2
+//	http_request_duration_seconds_count{route="/api/"} 1027
+//
+// Each metric is a vector: one series per combination of label values,
+// created on first use. Series are written sorted, so scrapes are stable.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are histogram bounds in seconds suited to request latency
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds metrics in registration order
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+type metric interface {
+	header() (name, help, kind string)
+	writeSamples(bw *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+func (r *Registry) register(m metric) {
+	name, _, _ := m.header()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		name, help, kind := m.header()
+		fmt.Fprintf(bw, "# HELP %s %s\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		m.writeSamples(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the registry as a /metrics endpoint
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// vec is the label bookkeeping shared by every metric type
+type vec[T any] struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*T // By encoded label values
+	values map[string][]string
+	newT   func() *T
+}
+
+func newVec[T any](name, help string, labels []string, newT func() *T) vec[T] {
+	return vec[T]{
+		name: name, help: help, labels: labels,
+		series: make(map[string]*T),
+		values: make(map[string][]string),
+		newT:   newT,
+	}
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s wants %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.series[key]
+	if !ok {
+		s = v.newT()
+		v.series[key] = s
+		v.values[key] = slices.Clone(values)
+	}
+	return s
+}
+
+// each calls fn for every series in label order
+func (v *vec[T]) each(fn func(labels string, s *T)) {
+	type entry struct {
+		labels string
+		s      *T
+	}
+	v.mu.Lock()
+	entries := make([]entry, 0, len(v.series))
+	for k, s := range v.series {
+		entries = append(entries, entry{formatLabels(v.labels, v.values[k]), s})
+	}
+	v.mu.Unlock()
+	slices.SortFunc(entries, func(a, b entry) int { return strings.Compare(a.labels, b.labels) })
+
+	for _, e := range entries {
+		fn(e.labels, e.s)
+	}
+}
+
+// Counter only goes up
+type Counter struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (c *Counter) Inc() { c.Add(1) }
+
+// Add adds delta, which must not be negative
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.mu.Lock()
+	c.v += delta
+	c.mu.Unlock()
+}
+
+func (c *Counter) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v
+}
+
+type CounterVec struct{ vec[Counter] }
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, labels, func() *Counter { return &Counter{} })}
+	r.register(c)
+	return c
+}
+
+// With returns the series for the label values, in label order
+func (c *CounterVec) With(values ...string) *Counter { return c.with(values) }
+
+func (c *CounterVec) header() (string, string, string) { return c.name, c.help, "counter" }
+
+func (c *CounterVec) writeSamples(bw *bufio.Writer) {
+	c.each(func(labels string, s *Counter) {
+		writeSample(bw, c.name, labels, s.value())
+	})
+}
+
+// Gauge goes up and down
+type Gauge struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (g *Gauge) Set(v float64) {
+	g.mu.Lock()
+	g.v = v
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.mu.Lock()
+	g.v += delta
+	g.mu.Unlock()
+}
+
+func (g *Gauge) Inc() { g.Add(1) }
+func (g *Gauge) Dec() { g.Add(-1) }
+
+func (g *Gauge) value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.v
+}
+
+type GaugeVec struct{ vec[Gauge] }
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, labels, func() *Gauge { return &Gauge{} })}
+	r.register(g)
+	return g
+}
+
+func (g *GaugeVec) With(values ...string) *Gauge { return g.with(values) }
+
+func (g *GaugeVec) header() (string, string, string) { return g.name, g.help, "gauge" }
+
+func (g *GaugeVec) writeSamples(bw *bufio.Writer) {
+	g.each(func(labels string, s *Gauge) {
+		writeSample(bw, g.name, labels, s.value())
+	})
+}
+
+// GaugeFunc is a gauge computed at scrape time, for values another
+// component already tracks
+type GaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(emit func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge whose series are whatever collect emits
+// on each scrape
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) {
+	r.register(&GaugeFunc{name: name, help: help, labels: labels, collect: collect})
+}
+
+func (g *GaugeFunc) header() (string, string, string) { return g.name, g.help, "gauge" }
+
+func (g *GaugeFunc) writeSamples(bw *bufio.Writer) {
+	type sample struct {
+		labels string
+		value  float64
+	}
+	var samples []sample
+	g.collect(func(value float64, values ...string) {
+		samples = append(samples, sample{formatLabels(g.labels, values), value})
+	})
+	slices.SortStableFunc(samples, func(a, b sample) int { return strings.Compare(a.labels, b.labels) })
+	for _, s := range samples {
+		writeSample(bw, g.name, s.labels, s.value)
+	}
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	mu     sync.Mutex
+	bounds []float64 // Upper bounds, ascending, without +Inf
+	counts []uint64  // Per bucket (not cumulative), plus one for +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v) // First bound >= v: le is inclusive
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+type HistogramVec struct {
+	vec[Histogram]
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds
+// (nil for DefBuckets)
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	if !slices.IsSorted(buckets) {
+		panic("metrics: buckets of " + name + " not sorted")
+	}
+	bounds := slices.Clone(buckets)
+	h := &HistogramVec{newVec(name, help, labels, func() *Histogram {
+		return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	})}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) With(values ...string) *Histogram { return h.with(values) }
+
+func (h *HistogramVec) header() (string, string, string) { return h.name, h.help, "histogram" }
+
+func (h *HistogramVec) writeSamples(bw *bufio.Writer) {
+	h.each(func(labels string, s *Histogram) {
+		s.mu.Lock()
+		counts := slices.Clone(s.counts)
+		sum, count := s.sum, s.count
+		s.mu.Unlock()
+
+		var cumulative uint64
+		for i, bound := range s.bounds {
+			cumulative += counts[i]
+			writeSample(bw, h.name+"_bucket", withLabel(labels, "le", formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(bw, h.name+"_bucket", withLabel(labels, "le", "+Inf"), float64(count))
+		writeSample(bw, h.name+"_sum", labels, sum)
+		writeSample(bw, h.name+"_count", labels, float64(count))
+	})
+}
+
+func writeSample(bw *bufio.Writer, name, labels string, v float64) {
+	bw.WriteString(name)
+	bw.WriteString(labels)
+	bw.WriteByte(' ')
+	bw.WriteString(formatFloat(v))
+	bw.WriteByte('\n')
+}
+
+// formatLabels renders {a="1",b="2"}, or "" without labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel adds one more label to a rendered label set
+func withLabel(labels, name, value string) string {
+	extra := name + `="` + labelEscaper.Replace(value) + `"`
+	if labels == "" {
+		return "{" + extra + "}"
+	}
+	return labels[:len(labels)-1] + "," + extra + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
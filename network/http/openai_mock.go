@@ -0,0 +1,520 @@
+// Local stand-in for the OpenAI chat completions API, built on the same
+// raw-socket stack as server.go (httpwire + router + graceful).
+// Lets openai_stream.go and the sse package run end to end offline.
+//
+// The reply echoes the last user message back one word per token, paced
+// by -delay, so streaming is visible.
+//
+//	go run openai_mock.go -api-key test
+//	OPENAI_API_KEY=test OPENAI_API_BASE=http://localhost:8085/v1 go run openai_stream.go
+//
+// Failures can be injected for every request (-fail), the first N
+// (-fail-first), a random fraction (-fail-rate), or one request through
+// the X-Mock-Fail header:
+//
+//	429         rate limit error with Retry-After
+//	500         server error
+//	disconnect  connection dropped halfway through the stream
+//	malformed   one chunk of invalid JSON in the stream
+//
+// X-Mock-Delay (e.g. "10ms") overrides the pacing for one request.
+//
+// Tool calling: when the request offers tools and the last user message
+// names one of them, the reply is a call to each tool named, streamed as
+// tool_calls deltas with the arguments split across chunks. The arguments
+// are the first JSON object in the message, or {}. Once the last messages
+// are "tool" results, the reply repeats them back.
+//
+//	> what time is it in Tokyo? use get_current_time {"timezone":"Asia/Tokyo"}
+//
+// Endpoints: /v1/chat/completions, /chat/completions and the Azure form
+// /openai/deployments/{deployment}/chat/completions. When -api-key is set,
+// either "Authorization: Bearer <key>" or Azure's "api-key: <key>" is accepted.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"claude-go/network/graceful"
+	"claude-go/network/http/httpwire"
+	"claude-go/network/http/router"
+)
+
+const drainTimeout = 5 * time.Second
+
+var srv = graceful.New(drainTimeout)
+
+// Failure modes for -fail and X-Mock-Fail
+const (
+	failNone       = ""
+	failRateLimit  = "429"
+	failServer     = "500"
+	failDisconnect = "disconnect"
+	failMalformed  = "malformed"
+)
+
+type mockConfig struct {
+	apiKey     string
+	delay      time.Duration
+	fail       string
+	failFirst  int64   // Only the first N requests fail (0 = no limit)
+	failRate   float64 // Fraction of requests that fail
+	retryAfter int     // Seconds, sent with 429
+}
+
+var (
+	config   mockConfig
+	requests atomic.Int64
+
+	rngMu sync.Mutex
+	rng   *rand.Rand
+)
+
+// Wire format of the API, as much of it as clients read
+
+type chatRequest struct {
+	Model         string        `json:"model"`
+	Messages      []chatMessage `json:"messages"`
+	Stream        bool          `json:"stream"`
+	MaxTokens     int           `json:"max_tokens"`
+	StreamOptions *struct {
+		IncludeUsage bool `json:"include_usage"`
+	} `json:"stream_options"`
+	Tools []struct {
+		Type     string `json:"type"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	} `json:"tools"`
+}
+
+type chatMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type toolCall struct {
+	Index    *int   `json:"index,omitempty"` // Only in stream deltas
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type completion struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []completionChoice `json:"choices"`
+	Usage   usage              `json:"usage"`
+}
+
+type completionChoice struct {
+	Index        int         `json:"index"`
+	Message      chatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"`
+}
+
+type chunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []chunkChoice `json:"choices"`
+	Usage   *usage        `json:"usage,omitempty"`
+}
+
+type chunkChoice struct {
+	Index        int        `json:"index"`
+	Delta        chunkDelta `json:"delta"`
+	FinishReason *string    `json:"finish_reason"`
+}
+
+type chunkDelta struct {
+	Role      string     `json:"role,omitempty"`
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []toolCall `json:"tool_calls,omitempty"`
+}
+
+type apiError struct {
+	Error struct {
+		Message string  `json:"message"`
+		Type    string  `json:"type"`
+		Code    *string `json:"code"`
+	} `json:"error"`
+}
+
+func main() {
+	addr := flag.String("addr", ":8085", "listen address")
+	flag.StringVar(&config.apiKey, "api-key", "", "required API key (empty = no auth)")
+	flag.DurationVar(&config.delay, "delay", 50*time.Millisecond, "pause between streamed tokens")
+	flag.StringVar(&config.fail, "fail", failNone, "inject a failure: 429, 500, disconnect or malformed")
+	flag.Int64Var(&config.failFirst, "fail-first", 0, "fail only the first N requests (0 = all)")
+	flag.Float64Var(&config.failRate, "fail-rate", 1, "fraction of requests to fail when -fail is set")
+	flag.IntVar(&config.retryAfter, "retry-after", 2, "Retry-After seconds sent with 429")
+	seed := flag.Int64("seed", 1, "RNG seed for -fail-rate")
+	flag.Parse()
+	rng = rand.New(rand.NewSource(*seed))
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Printf("Failed to start server: %v\n", err)
+		return
+	}
+	defer listener.Close()
+
+	fmt.Printf("Mock OpenAI API listening on %s (delay %v", *addr, config.delay)
+	if config.fail != failNone {
+		fmt.Printf(", failing with %s", config.fail)
+	}
+	fmt.Println(")")
+	fmt.Printf("export OPENAI_API_BASE=http://localhost%s/v1\n", *addr)
+
+	report := srv.Serve(listener, handleConn)
+	fmt.Printf("Shutdown complete: %s\n", report)
+}
+
+var routes = newRoutes()
+
+func newRoutes() *router.Router {
+	r := router.New()
+	r.Use(router.RequestID, router.Logging, router.Recovery, requireKey)
+
+	r.Post("/v1/chat/completions", chatCompletions)
+	r.Post("/chat/completions", chatCompletions)
+	r.Post("/openai/deployments/{deployment}/chat/completions", chatCompletions)
+	return r
+}
+
+// handleConn serves one request per connection, like server.go
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if !srv.Idle(conn) {
+		return
+	}
+	if _, err := reader.Peek(1); err != nil {
+		return
+	}
+	srv.Active(conn)
+
+	req, err := httpwire.ReadRequest(reader, httpwire.DefaultLimits)
+	if err != nil {
+		if status := httpwire.StatusCode(err); status != 0 {
+			writeResponse(conn, errorResponse(status, "invalid_request_error", err.Error()))
+		}
+		return
+	}
+
+	resp := routes.Serve(context.Background(), req, conn.RemoteAddr().String())
+	writeResponse(conn, resp)
+}
+
+func writeResponse(conn net.Conn, resp *httpwire.Response) {
+	if c, ok := resp.Stream.(io.Closer); ok {
+		defer c.Close()
+	}
+	resp.Header.Set("Connection", "close")
+	if err := httpwire.WriteResponse(conn, resp); err != nil {
+		fmt.Printf("[%s] Write ended: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// requireKey checks the OpenAI or Azure auth header when -api-key is set
+func requireKey(next router.Handler) router.Handler {
+	return func(req *router.Request) *httpwire.Response {
+		if config.apiKey == "" {
+			return next(req)
+		}
+		bearer, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if bearer == config.apiKey || req.Header.Get("api-key") == config.apiKey {
+			return next(req)
+		}
+		return errorResponse(401, "invalid_request_error", "Incorrect API key provided")
+	}
+}
+
+func chatCompletions(req *router.Request) *httpwire.Response {
+	n := requests.Add(1)
+
+	var body chatRequest
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		return errorResponse(400, "invalid_request_error", "We could not parse the JSON body of your request: "+err.Error())
+	}
+	if len(body.Messages) == 0 {
+		return errorResponse(400, "invalid_request_error", "'messages' must contain at least one message")
+	}
+	if body.Model == "" {
+		body.Model = "mock-gpt"
+	}
+
+	delay := config.delay
+	if d, err := time.ParseDuration(req.Header.Get("X-Mock-Delay")); err == nil {
+		delay = d
+	}
+
+	fail := req.Header.Get("X-Mock-Fail")
+	if fail == "" {
+		fail = injectedFailure(n)
+	}
+	switch fail {
+	case failRateLimit:
+		resp := errorResponse(429, "rate_limit_error", "Rate limit reached, please retry")
+		resp.Header.Set("Retry-After", strconv.Itoa(config.retryAfter))
+		return resp
+	case failServer:
+		return errorResponse(500, "server_error", "The server had an error while processing your request")
+	}
+
+	r := reply(body, n)
+	promptTokens := 0
+	for _, m := range body.Messages {
+		promptTokens += len(strings.Fields(m.Content))
+	}
+	completionTokens := len(r.tokens)
+	for _, c := range r.calls {
+		completionTokens += len(argumentPieces(c.Function.Arguments))
+	}
+	u := usage{PromptTokens: promptTokens, CompletionTokens: completionTokens, TotalTokens: promptTokens + completionTokens}
+	id := fmt.Sprintf("chatcmpl-mock%d", n)
+
+	if !body.Stream {
+		out, _ := json.Marshal(completion{
+			ID: id, Object: "chat.completion", Created: time.Now().Unix(), Model: body.Model,
+			Choices: []completionChoice{{
+				Message:      chatMessage{Role: "assistant", Content: strings.Join(r.tokens, ""), ToolCalls: r.calls},
+				FinishReason: r.finish,
+			}},
+			Usage: u,
+		})
+		return router.JSON(200, string(out))
+	}
+
+	includeUsage := body.StreamOptions != nil && body.StreamOptions.IncludeUsage
+	pr, pw := io.Pipe()
+	go streamChunks(pw, id, body.Model, r, delay, fail, includeUsage, u)
+
+	resp := router.Stream(200, "text/event-stream", pr, httpwire.Header{})
+	resp.Header.Set("Cache-Control", "no-cache")
+	return resp
+}
+
+// injectedFailure applies -fail, -fail-first and -fail-rate to request n
+func injectedFailure(n int64) string {
+	if config.fail == failNone || (config.failFirst > 0 && n > config.failFirst) {
+		return failNone
+	}
+	rngMu.Lock()
+	defer rngMu.Unlock()
+	if rng.Float64() >= config.failRate {
+		return failNone
+	}
+	return config.fail
+}
+
+// mockReply is what the mock answers: content tokens, or tool calls
+type mockReply struct {
+	tokens []string
+	calls  []toolCall
+	finish string
+}
+
+// reply echoes the last user message, split into word tokens that keep
+// their trailing space. max_tokens cuts it short with finish "length".
+// Offered tools named in the message are called instead, and tool results
+// at the end of the conversation are repeated back.
+func reply(body chatRequest, n int64) mockReply {
+	last := ""
+	for _, m := range body.Messages {
+		if m.Role == "user" {
+			last = m.Content
+		}
+	}
+
+	text := "You said: " + last
+	if results := trailingToolResults(body.Messages); len(results) > 0 {
+		text = "Tool results: " + strings.Join(results, "; ")
+	} else if calls := requestedCalls(body, last, n); len(calls) > 0 {
+		return mockReply{calls: calls, finish: "tool_calls"}
+	}
+
+	var tokens []string
+	words := strings.Fields(text)
+	for i, w := range words {
+		if i < len(words)-1 {
+			w += " "
+		}
+		tokens = append(tokens, w)
+	}
+
+	if body.MaxTokens > 0 && len(tokens) > body.MaxTokens {
+		return mockReply{tokens: tokens[:body.MaxTokens], finish: "length"}
+	}
+	return mockReply{tokens: tokens, finish: "stop"}
+}
+
+// trailingToolResults returns the contents of the tool messages that end
+// the conversation, if it ends with any
+func trailingToolResults(messages []chatMessage) []string {
+	i := len(messages)
+	for i > 0 && messages[i-1].Role == "tool" {
+		i--
+	}
+	var results []string
+	for _, m := range messages[i:] {
+		results = append(results, m.Content)
+	}
+	return results
+}
+
+// requestedCalls calls each offered tool whose name appears in text, with
+// the first JSON object in text as arguments
+func requestedCalls(body chatRequest, text string, n int64) []toolCall {
+	args := "{}"
+	if i, j := strings.Index(text, "{"), strings.LastIndex(text, "}"); i >= 0 && j > i && json.Valid([]byte(text[i:j+1])) {
+		args = text[i : j+1]
+	}
+
+	var calls []toolCall
+	for _, t := range body.Tools {
+		if t.Function.Name == "" || !strings.Contains(text, t.Function.Name) {
+			continue
+		}
+		var c toolCall
+		c.ID = fmt.Sprintf("call_mock%d_%d", n, len(calls))
+		c.Type = "function"
+		c.Function.Name = t.Function.Name
+		c.Function.Arguments = args
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+// argumentPieces splits tool call arguments the way the API streams them,
+// a few bytes per chunk
+func argumentPieces(args string) []string {
+	const size = 8
+	var pieces []string
+	for len(args) > size {
+		pieces = append(pieces, args[:size])
+		args = args[size:]
+	}
+	return append(pieces, args)
+}
+
+// streamChunks writes the SSE body: a role chunk, one chunk per token,
+// a finish chunk, optionally usage, then [DONE]. Each Write becomes one
+// HTTP chunk on the wire. A tool call is one chunk with its ID and name,
+// then one per piece of the arguments. An injected failure comes halfway
+// through the tokens, or through the first call's arguments if there are
+// no tokens.
+func streamChunks(pw *io.PipeWriter, id, model string, r mockReply, delay time.Duration, fail string, includeUsage bool, u usage) {
+	created := time.Now().Unix()
+	send := func(c chunk) error {
+		c.ID, c.Object, c.Created, c.Model = id, "chat.completion.chunk", created, model
+		data, _ := json.Marshal(c)
+		_, err := fmt.Fprintf(pw, "data: %s\n\n", data)
+		return err
+	}
+	delta := func(d chunkDelta, finish *string) chunk {
+		return chunk{Choices: []chunkChoice{{Delta: d, FinishReason: finish}}}
+	}
+	// inject writes the failure, if any; false means the response is over
+	inject := func() bool {
+		switch fail {
+		case failDisconnect:
+			// Abort the response: the server drops the connection
+			// without the terminating chunk
+			pw.CloseWithError(errors.New("injected disconnect"))
+			return false
+		case failMalformed:
+			fmt.Fprint(pw, "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\n\n")
+		}
+		return true
+	}
+
+	if err := send(delta(chunkDelta{Role: "assistant"}, nil)); err != nil {
+		return // Client went away
+	}
+	for i, c := range r.calls {
+		index := i
+		head := c
+		head.Index = &index
+		head.Function.Arguments = ""
+		if err := send(delta(chunkDelta{ToolCalls: []toolCall{head}}, nil)); err != nil {
+			return
+		}
+		pieces := argumentPieces(c.Function.Arguments)
+		for j, piece := range pieces {
+			time.Sleep(delay)
+
+			if i == 0 && j == len(pieces)/2 && len(r.tokens) == 0 && !inject() {
+				return
+			}
+
+			var d toolCall
+			d.Index = &index
+			d.Function.Arguments = piece
+			if err := send(delta(chunkDelta{ToolCalls: []toolCall{d}}, nil)); err != nil {
+				return
+			}
+		}
+	}
+	tokens := r.tokens
+	for i, tok := range tokens {
+		time.Sleep(delay)
+
+		if i == len(tokens)/2 && !inject() {
+			return
+		}
+
+		if err := send(delta(chunkDelta{Content: tok}, nil)); err != nil {
+			return
+		}
+	}
+	if err := send(delta(chunkDelta{}, &r.finish)); err != nil {
+		return
+	}
+	if includeUsage {
+		if err := send(chunk{Choices: []chunkChoice{}, Usage: &u}); err != nil {
+			return
+		}
+	}
+	fmt.Fprint(pw, "data: [DONE]\n\n")
+	pw.Close()
+}
+
+// errorResponse builds an error in the API's JSON shape
+func errorResponse(status int, errType, message string) *httpwire.Response {
+	var e apiError
+	e.Error.Message = message
+	e.Error.Type = errType
+	out, _ := json.Marshal(e)
+	return router.JSON(status, string(out))
+}
@@ -2,40 +2,132 @@
 //
 // Uses chunked transfer encoding with SSE format.
 // Each chunk contains: data: {"choices":[{"delta":{"content":"token"}}]}
+// The sse package parses the event stream and accumulates the deltas.
+//
+// With -prompt it sends one message and exits. Without, it runs a chat
+// REPL that keeps the conversation history and offers the model the Go
+// functions in the tools table. A reply that asks for tool calls (streamed
+// as tool_calls deltas) has them run locally, the results sent back as
+// "tool" messages, and the model asked again, until it answers in text.
+//
+// REPL commands: /save FILE, /load FILE (JSON transcripts), /history,
+// /reset, /quit. Ctrl-C during a reply cancels that reply only.
+//
+// Failures are retried with exponential backoff and jitter: connection
+// errors, 408/429/5xx (waiting for Retry-After when the server sends it),
+// servers that send no headers for -idle-timeout, and streams that drop
+// before [DONE] or stall for -idle-timeout. A stream can't be resumed
+// mid-reply, so a retry starts the reply over.
+// Ctrl-C cancels the request and closes the body cleanly.
 //
 // Usage:
-//   export OPENAI_API_KEY=sk-...
-//   export OPENAI_API_BASE=https://api.openai.com/v1  # optional, default
-//   go run ./network/http/openai_stream.go
+//
+//	export OPENAI_API_KEY=sk-...
+//	export OPENAI_API_BASE=https://api.openai.com/v1  # optional, default
+//	go run ./network/http/openai_stream.go                 # chat REPL
+//	go run ./network/http/openai_stream.go -prompt "Hello"  # one message
+//	  [-retries 4] [-idle-timeout 15s] [-model gpt-4o-mini]
+//
+// Offline, against the local mock (see openai_mock.go):
+//
+//	go run ./network/http/openai_mock.go -api-key test
+//	OPENAI_API_KEY=test OPENAI_API_BASE=http://localhost:8085/v1 go run ./network/http/openai_stream.go
 //
 // Azure OpenAI:
-//   export OPENAI_API_KEY=your-azure-key
-//   export OPENAI_API_BASE=https://{resource}.openai.azure.com/openai/deployments/{deployment}?api-version=2024-02-15-preview
-//   go run ./network/http/openai_stream.go
+//
+//	export OPENAI_API_KEY=your-azure-key
+//	export OPENAI_API_BASE=https://{resource}.openai.azure.com/openai/deployments/{deployment}?api-version=2024-02-15-preview
+//	go run ./network/http/openai_stream.go
 package main
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"claude-go/network/http/sse"
 )
 
 type ChatRequest struct {
 	Model    string    `json:"model"`
 	Messages []Message `json:"messages"`
 	Stream   bool      `json:"stream"`
+	Tools    []Tool    `json:"tools,omitempty"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string         `json:"role"` // system, user, assistant or tool
+	Content    string         `json:"content"`
+	ToolCalls  []sse.ToolCall `json:"tool_calls,omitempty"`   // assistant: calls requested
+	ToolCallID string         `json:"tool_call_id,omitempty"` // tool: which call this answers
+}
+
+// Tool declares a function the model may call; Parameters is a JSON Schema
+type Tool struct {
+	Type     string       `json:"type"` // Always "function"
+	Function ToolFunction `json:"function"`
 }
 
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// maxToolRounds bounds model -> tools -> model round trips per user turn
+const maxToolRounds = 5
+
+// Backoff between attempts: base * 2^attempt, capped, with jitter. A
+// server's Retry-After is honored up to maxRetryAfter.
+const (
+	backoffBase   = 500 * time.Millisecond
+	backoffMax    = 30 * time.Second
+	maxRetryAfter = 2 * time.Minute
+)
+
+// attemptError is why one attempt failed, and whether another may succeed
+type attemptError struct {
+	err        error
+	retryable  bool
+	retryAfter time.Duration // From the Retry-After header, 0 if none
+}
+
+func (e *attemptError) Error() string { return e.err.Error() }
+func (e *attemptError) Unwrap() error { return e.err }
+
+// streamStats summarizes the attempt that produced the reply
+type streamStats struct {
+	attempts int
+	tokens   int           // Content deltas received (about one token each)
+	ttft     time.Duration // Request sent to first content delta
+	stream   time.Duration // First content delta to end of stream
+	usage    *sse.Usage    // Exact counts, if the server sent them
+	message  sse.Message
+	done     bool // [DONE] received
+}
 
 func main() {
+	prompt := flag.String("prompt", "", "send one message and exit (default: interactive chat)")
+	model := flag.String("model", "gpt-4o-mini", "model name")
+	retries := flag.Int("retries", 4, "retries after the first attempt")
+	idleTimeout := flag.Duration("idle-timeout", 15*time.Second, "give up on a stream with no data for this long")
+	flag.Parse()
+
 	apiKey := os.Getenv("OPENAI_API_KEY")
 	if apiKey == "" {
 		fmt.Println("Error: OPENAI_API_KEY not set")
@@ -46,57 +138,580 @@ func main() {
 	if apiBase == "" {
 		apiBase = "https://api.openai.com/v1"
 	}
-	endpoint := apiBase + "/chat/completions"
 
-	// Build request
-	reqBody := ChatRequest{
-		Model: "gpt-4o-mini",
-		Messages: []Message{
-			{Role: "user", Content: "Count from 1 to 5 slowly, one number per line."},
-		},
-		Stream: true,
+	// The idle watchdog only starts once headers arrive; before that a
+	// server that never answers is cut off by the header timeout
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = *idleTimeout
+
+	c := &chatClient{
+		http:        &http.Client{Transport: transport},
+		endpoint:    apiBase + "/chat/completions",
+		apiKey:      apiKey,
+		model:       *model,
+		retries:     *retries,
+		idleTimeout: *idleTimeout,
+	}
+
+	if *prompt == "" {
+		repl(c)
+		return
 	}
 
-	jsonBody, _ := json.Marshal(reqBody)
+	// Ctrl-C cancels ctx, which aborts the request or body read in progress
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(jsonBody))
+	c.verbose = true
+	stats, err := c.complete(ctx, []Message{{Role: "user", Content: *prompt}}, nil)
 	if err != nil {
-		fmt.Println("Error creating request:", err)
+		if ctx.Err() != nil {
+			fmt.Println("\n\nCancelled")
+			printSummary(stats)
+			os.Exit(130)
+		}
+		fmt.Printf("\nError: %v (attempt %d, giving up)\n", err, stats.attempts)
 		os.Exit(1)
 	}
+	printSummary(stats)
+}
+
+// chatClient holds the endpoint settings shared by every request
+type chatClient struct {
+	http        *http.Client
+	endpoint    string
+	apiKey      string
+	model       string
+	retries     int
+	idleTimeout time.Duration
+	verbose     bool // Print status and stream banners
+}
+
+// complete streams one reply to messages, retrying as described at the
+// top of the file. On error the stats describe the last attempt.
+func (c *chatClient) complete(ctx context.Context, messages []Message, tools []Tool) (*streamStats, error) {
+	body, err := json.Marshal(ChatRequest{Model: c.model, Messages: messages, Stream: true, Tools: tools})
+	if err != nil {
+		return &streamStats{}, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		stats, err := c.streamOnce(ctx, body)
+		stats.attempts = attempt + 1
+		if err == nil || ctx.Err() != nil {
+			return stats, err
+		}
+
+		var ae *attemptError
+		if !errors.As(err, &ae) || !ae.retryable || attempt >= c.retries {
+			return stats, err
+		}
+
+		wait := backoff(attempt)
+		if ae.retryAfter > 0 {
+			wait = ae.retryAfter
+		}
+		fmt.Printf("\nAttempt %d failed: %v - retrying in %v\n", attempt+1, err, wait.Round(time.Millisecond))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		}
+	}
+}
+
+// streamOnce makes one request and streams the reply to stdout. The
+// returned stats are valid even on error (partial reply).
+func (c *chatClient) streamOnce(ctx context.Context, body []byte) (*streamStats, error) {
+	stats := &streamStats{}
+
+	// Cancelled by the idle watchdog, by Ctrl-C via ctx, or on return
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, "POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return stats, err
+	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("api-key", apiKey) // Azure OpenAI uses this header
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	req.Header.Set("api-key", c.apiKey) // Azure OpenAI uses this header
 
 	// Send request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	start := time.Now()
+	resp, err := c.http.Do(req)
 	if err != nil {
-		fmt.Println("Error sending request:", err)
-		os.Exit(1)
+		return stats, &attemptError{err: err, retryable: true}
 	}
+	// Closing the body returns the connection (or drops it mid-stream)
 	defer resp.Body.Close()
 
-	fmt.Printf("Status: %s\n", resp.Status)
-	fmt.Printf("Content-Type: %s\n", resp.Header.Get("Content-Type"))
-	fmt.Printf("Transfer-Encoding: %s\n\n", resp.Header.Get("Transfer-Encoding"))
+	if c.verbose {
+		fmt.Printf("Status: %s (%s)\n", resp.Status, resp.Header.Get("Content-Type"))
+	}
 
 	if resp.StatusCode != http.StatusOK {
-		fmt.Println("API error:", resp.Status)
-		os.Exit(1)
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return stats, &attemptError{
+			err:        fmt.Errorf("API error: %s: %s", resp.Status, bytes.TrimSpace(detail)),
+			retryable:  resp.StatusCode == 408 || resp.StatusCode == 429 || resp.StatusCode >= 500,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	// Idle watchdog: every event pushes it back; if it fires the stream
+	// has stalled and cancelling the context unblocks the body read
+	var stalled atomic.Bool
+	watchdog := time.AfterFunc(c.idleTimeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	// Parse the event stream and fold the deltas into the reply,
+	// printing each piece as it arrives
+	if c.verbose {
+		fmt.Println("=== Streaming ===")
+	}
+	var acc sse.Accumulator
+	var firstToken time.Time
+	var streamErr error
+	for ev, err := range sse.NewReader(resp.Body).All() {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		watchdog.Reset(c.idleTimeout)
+		if ev.Done() {
+			acc.Add(ev)
+			break
+		}
+		delta, err := acc.Add(ev)
+		if err != nil {
+			streamErr = err
+			break
+		}
+		if delta != "" {
+			if firstToken.IsZero() {
+				firstToken = time.Now()
+				stats.ttft = firstToken.Sub(start)
+			}
+			stats.tokens++
+			fmt.Print(delta)
+		}
+	}
+	if c.verbose {
+		fmt.Println("\n=== End ===")
+	} else if stats.tokens > 0 {
+		fmt.Println()
+	}
+
+	if !firstToken.IsZero() {
+		stats.stream = time.Since(firstToken)
+	}
+	stats.usage = acc.Usage
+	stats.message = acc.Message()
+	stats.done = acc.Done()
+
+	switch {
+	case stalled.Load():
+		return stats, &attemptError{err: fmt.Errorf("stream stalled: no data for %v", c.idleTimeout), retryable: true}
+	case ctx.Err() != nil:
+		return stats, ctx.Err()
+	case streamErr != nil:
+		return stats, &attemptError{err: streamErr, retryable: true}
+	case !acc.Done():
+		return stats, &attemptError{err: errors.New("stream ended without [DONE]"), retryable: true}
+	}
+	return stats, nil
+}
+
+// repl reads user messages from stdin until EOF or /quit. Each one is a
+// turn: the reply, plus any tool rounds it needs, is added to history.
+func repl(c *chatClient) {
+	var history []Message
+	in := bufio.NewScanner(os.Stdin)
+	in.Buffer(make([]byte, 0, 4096), 1<<20)
+
+	fmt.Printf("Chatting with %s. Tools: %s. /help for commands.\n", c.model, strings.Join(toolNames(), ", "))
+	for {
+		fmt.Print("\n> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(in.Text())
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "/"):
+			if !command(c, line, &history) {
+				return
+			}
+			continue
+		}
+
+		history = c.turn(append(history, Message{Role: "user", Content: line}))
+	}
+}
+
+// turn asks for a reply to history, running the tools it calls, and
+// returns the history with the reply appended. If the turn fails or is
+// cancelled, history is rolled back to before the user's message, so a
+// transcript never ends in a question or a tool call with no answer.
+func (c *chatClient) turn(history []Message) []Message {
+	// Ctrl-C cancels this reply only; at the prompt it still exits
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	before := len(history) - 1
+	defs := toolDefs()
+	for round := 0; round <= maxToolRounds; round++ {
+		stats, err := c.complete(ctx, history, defs)
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Println("\n(cancelled)")
+			} else {
+				fmt.Printf("\nError: %v (attempt %d, giving up)\n", err, stats.attempts)
+			}
+			return history[:before]
+		}
+
+		reply := stats.message
+		history = append(history, Message{Role: "assistant", Content: reply.Content, ToolCalls: reply.ToolCalls})
+		if len(reply.ToolCalls) == 0 {
+			if reply.FinishReason == "length" {
+				fmt.Println("(reply cut off at the token limit)")
+			}
+			return history
+		}
+		if round == maxToolRounds {
+			break
+		}
+
+		// Every call gets an answer, in order, even if it failed
+		for _, call := range reply.ToolCalls {
+			result := runTool(call)
+			fmt.Printf("[tool] %s(%s) -> %s\n", call.Function.Name, call.Function.Arguments, shorten(result, 200))
+			history = append(history, Message{Role: "tool", ToolCallID: call.ID, Content: result})
+		}
 	}
 
-	// Dump raw SSE body
-	fmt.Println("=== Raw SSE Body ===")
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == "" {
-			fmt.Println("[empty line]")
-		} else {
-			fmt.Println(line)
+	fmt.Printf("(gave up after %d tool rounds)\n", maxToolRounds)
+	return history[:before]
+}
+
+// command runs a /command and reports whether the REPL should continue
+func command(c *chatClient, line string, history *[]Message) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case "/quit", "/exit":
+		return false
+	case "/help":
+		fmt.Println("/save FILE     write the conversation as JSON")
+		fmt.Println("/load FILE     replace the conversation with a saved one")
+		fmt.Println("/history       show the conversation")
+		fmt.Println("/system TEXT   start over with a system prompt")
+		fmt.Println("/reset         start over")
+		fmt.Println("/quit          exit (so does Ctrl-D)")
+	case "/save":
+		if arg == "" {
+			fmt.Println("Usage: /save FILE")
+			break
+		}
+		if err := saveTranscript(arg, c.model, *history); err != nil {
+			fmt.Printf("Save failed: %v\n", err)
+			break
+		}
+		fmt.Printf("Saved %d messages to %s\n", len(*history), arg)
+	case "/load":
+		if arg == "" {
+			fmt.Println("Usage: /load FILE")
+			break
+		}
+		t, err := loadTranscript(arg)
+		if err != nil {
+			fmt.Printf("Load failed: %v\n", err)
+			break
+		}
+		*history = t.Messages
+		fmt.Printf("Loaded %d messages (saved %s with %s)\n", len(t.Messages), t.Saved.Format(time.RFC3339), t.Model)
+	case "/history":
+		printHistory(*history)
+	case "/system":
+		*history = nil
+		if arg != "" {
+			*history = []Message{{Role: "system", Content: arg}}
+		}
+		fmt.Println("New conversation")
+	case "/reset":
+		*history = nil
+		fmt.Println("New conversation")
+	default:
+		fmt.Printf("Unknown command %s (try /help)\n", name)
+	}
+	return true
+}
+
+func printHistory(history []Message) {
+	if len(history) == 0 {
+		fmt.Println("(empty)")
+	}
+	for i, m := range history {
+		switch {
+		case m.Role == "tool":
+			fmt.Printf("%3d tool      [%s] %s\n", i, m.ToolCallID, shorten(m.Content, 200))
+		case len(m.ToolCalls) > 0:
+			for _, tc := range m.ToolCalls {
+				fmt.Printf("%3d assistant [%s] calls %s(%s)\n", i, tc.ID, tc.Function.Name, tc.Function.Arguments)
+			}
+			if m.Content != "" {
+				fmt.Printf("%3d assistant %s\n", i, m.Content)
+			}
+		default:
+			fmt.Printf("%3d %-9s %s\n", i, m.Role, m.Content)
+		}
+	}
+}
+
+func shorten(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// transcript is the JSON file written by /save. Messages are in the API's
+// own shape, so a saved file can be replayed with curl.
+type transcript struct {
+	Model    string    `json:"model"`
+	Saved    time.Time `json:"saved"`
+	Messages []Message `json:"messages"`
+}
+
+func saveTranscript(path, model string, history []Message) error {
+	data, err := json.MarshalIndent(transcript{Model: model, Saved: time.Now(), Messages: history}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// loadTranscript reads a /save file, rejecting messages the API would
+// refuse later (unknown roles, tool results that answer no call)
+func loadTranscript(path string) (*transcript, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t transcript
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	calls := make(map[string]bool)
+	for i, m := range t.Messages {
+		switch m.Role {
+		case "system", "user":
+		case "assistant":
+			for _, tc := range m.ToolCalls {
+				calls[tc.ID] = true
+			}
+		case "tool":
+			if !calls[m.ToolCallID] {
+				return nil, fmt.Errorf("%s: message %d answers unknown tool call %q", path, i, m.ToolCallID)
+			}
+		default:
+			return nil, fmt.Errorf("%s: message %d has unknown role %q", path, i, m.Role)
+		}
+	}
+	return &t, nil
+}
+
+// localTool is a Go function offered to the model. run gets the call's
+// arguments as JSON and returns the result text sent back to the model.
+type localTool struct {
+	name        string
+	description string
+	parameters  string // JSON Schema of the arguments object
+	run         func(args json.RawMessage) (string, error)
+}
+
+var tools = []localTool{
+	{
+		name:        "get_current_time",
+		description: "Get the current date and time, optionally in a given time zone",
+		parameters: `{"type":"object","properties":{
+			"timezone":{"type":"string","description":"IANA time zone, e.g. Asia/Tokyo (default: local)"}}}`,
+		run: toolTime,
+	},
+	{
+		name:        "calculate",
+		description: "Apply an arithmetic operator to two numbers",
+		parameters: `{"type":"object","properties":{
+			"a":{"type":"number"},
+			"op":{"type":"string","enum":["+","-","*","/","^"]},
+			"b":{"type":"number"}},
+			"required":["a","op","b"]}`,
+		run: toolCalculate,
+	},
+}
+
+func toolDefs() []Tool {
+	defs := make([]Tool, len(tools))
+	for i, t := range tools {
+		defs[i] = Tool{Type: "function", Function: ToolFunction{
+			Name:        t.name,
+			Description: t.description,
+			Parameters:  json.RawMessage(t.parameters),
+		}}
+	}
+	return defs
+}
+
+func toolNames() []string {
+	names := make([]string, len(tools))
+	for i, t := range tools {
+		names[i] = t.name
+	}
+	return names
+}
+
+// runTool executes one call. Failures are reported to the model as
+// {"error": ...} rather than ending the turn, so it can correct itself.
+func runTool(call sse.ToolCall) string {
+	for _, t := range tools {
+		if t.name != call.Function.Name {
+			continue
+		}
+		args := json.RawMessage(call.Function.Arguments)
+		if len(bytes.TrimSpace(args)) == 0 {
+			args = json.RawMessage("{}")
+		}
+		result, err := t.run(args)
+		if err != nil {
+			return toolError(err)
+		}
+		return result
+	}
+	return toolError(fmt.Errorf("unknown tool %q", call.Function.Name))
+}
+
+func toolError(err error) string {
+	data, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return string(data)
+}
+
+func toolTime(args json.RawMessage) (string, error) {
+	var in struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil {
+		return "", fmt.Errorf("bad arguments: %w", err)
+	}
+	loc := time.Local
+	if in.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(in.Timezone); err != nil {
+			return "", err
 		}
 	}
-	fmt.Println("=== End ===")
+	now := time.Now().In(loc)
+	data, err := json.Marshal(map[string]string{
+		"time":     now.Format(time.RFC3339),
+		"weekday":  now.Weekday().String(),
+		"timezone": loc.String(),
+	})
+	return string(data), err
+}
+
+func toolCalculate(args json.RawMessage) (string, error) {
+	var in struct {
+		A  *float64 `json:"a"`
+		Op string   `json:"op"`
+		B  *float64 `json:"b"`
+	}
+	if err := json.Unmarshal(args, &in); err != nil {
+		return "", fmt.Errorf("bad arguments: %w", err)
+	}
+	if in.A == nil || in.B == nil {
+		return "", errors.New("a and b are required")
+	}
+
+	a, b := *in.A, *in.B
+	var r float64
+	switch in.Op {
+	case "+":
+		r = a + b
+	case "-":
+		r = a - b
+	case "*":
+		r = a * b
+	case "/":
+		if b == 0 {
+			return "", errors.New("division by zero")
+		}
+		r = a / b
+	case "^":
+		r = math.Pow(a, b)
+	default:
+		return "", fmt.Errorf("unknown operator %q", in.Op)
+	}
+	data, err := json.Marshal(map[string]float64{"result": r})
+	return string(data), err
+}
+
+// backoff returns the wait before retry number attempt+1: exponential,
+// capped, with "equal jitter" (half fixed, half random) so clients that
+// failed together don't retry together
+func backoff(attempt int) time.Duration {
+	// Past this many doublings the cap applies anyway, and shifting further
+	// would overflow
+	attempt = min(attempt, 6)
+	d := min(backoffBase<<attempt, backoffMax)
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter accepts delay-seconds or an HTTP-date, capped at
+// maxRetryAfter
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(min(secs, int(maxRetryAfter/time.Second))) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return min(max(time.Until(t), 0), maxRetryAfter)
+	}
+	return 0
+}
+
+func printSummary(stats *streamStats) {
+	fmt.Println("\n=== Summary ===")
+	fmt.Printf("Attempts:        %d\n", stats.attempts)
+	if stats.message.FinishReason != "" {
+		fmt.Printf("Finish reason:   %s\n", stats.message.FinishReason)
+	}
+	for _, tc := range stats.message.ToolCalls {
+		fmt.Printf("Tool call %s: %s(%s)\n", tc.ID, tc.Function.Name, tc.Function.Arguments)
+	}
+	fmt.Printf("Tokens received: %d\n", stats.tokens)
+	if stats.usage != nil {
+		fmt.Printf("Usage:           %d prompt + %d completion = %d tokens\n",
+			stats.usage.PromptTokens, stats.usage.CompletionTokens, stats.usage.TotalTokens)
+	}
+	if stats.tokens > 0 {
+		fmt.Printf("Time to first:   %v\n", stats.ttft.Round(time.Millisecond))
+		if stats.stream > 0 {
+			fmt.Printf("Tokens/sec:      %.1f\n", float64(stats.tokens)/stats.stream.Seconds())
+		}
+	}
+	if !stats.done {
+		fmt.Println("Warning: stream ended without [DONE] - reply may be truncated")
+	}
 }
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"claude-go/network/http/httpwire"
+)
+
+// Logging prints one line per request after it has been handled:
+//
+//	[127.0.0.1:51234] GET /users/42 -> 200 (85µs) id=3f9a1c2e
+func Logging(next Handler) Handler {
+	return func(req *Request) *httpwire.Response {
+		start := time.Now()
+		resp := next(req)
+		line := fmt.Sprintf("[%s] %s %s -> %d (%v)", req.RemoteAddr, req.Method, req.Target, resp.StatusCode, time.Since(start))
+		if req.RequestID != "" {
+			line += " id=" + req.RequestID
+		}
+		fmt.Println(line)
+		return resp
+	}
+}
+
+// Recovery turns a handler panic into a 500 instead of killing the
+// connection goroutine (or, without the server's own recover, the process)
+func Recovery(next Handler) Handler {
+	return func(req *Request) (resp *httpwire.Response) {
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("[%s] panic in %s %s: %v\n%s", req.RemoteAddr, req.Method, req.Target, r, debug.Stack())
+				resp = Error(500)
+			}
+		}()
+		return next(req)
+	}
+}
+
+// RequestID propagates the client's X-Request-ID, or assigns a new one,
+// and echoes it on the response so both sides can correlate logs
+func RequestID(next Handler) Handler {
+	return func(req *Request) *httpwire.Response {
+		id := req.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			b := make([]byte, 4)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		req.RequestID = id
+
+		resp := next(req)
+		resp.Header.Set("X-Request-ID", id)
+		return resp
+	}
+}
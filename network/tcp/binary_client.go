@@ -5,6 +5,9 @@
 //
 // Run server first: go run binary_server.go
 // Then run client:  go run binary_client.go
+//
+// A shutdown notice is seen on the next send: this client only reads the
+// socket after writing, like a simple request/response protocol.
 
 package main
 
@@ -60,6 +63,12 @@ func main() {
 			return
 		}
 
+		// Zero-length message = server shutdown notice
+		if len(response) == 0 {
+			fmt.Println("Server is shutting down, disconnecting")
+			return
+		}
+
 		fmt.Printf("Response (%d bytes): %s\n", len(response), string(response))
 
 		if message == "quit" {
@@ -7,17 +7,28 @@
 // [4 bytes: message length (BigEndian uint32)][N bytes: message data]
 //
 // This approach works for any data type (text, images, protobuf, etc.)
+//
+// A zero-length message is reserved as the server's shutdown notice:
+// on SIGINT/SIGTERM every idle client receives [0x00 0x00 0x00 0x00]
 
 package main
 
 import (
+	"bufio"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"time"
+
+	"claude-go/network/graceful"
 )
 
+// drainTimeout bounds how long shutdown waits for in-flight messages
+const drainTimeout = 10 * time.Second
+
+var srv = graceful.New(drainTimeout)
+
 func main() {
 	listener, err := net.Listen("tcp", ":8081")
 	if err != nil {
@@ -28,17 +39,10 @@ func main() {
 
 	fmt.Println("Binary TCP Server listening on :8081")
 	fmt.Println("Protocol: [4-byte length][data]")
-	fmt.Println("Waiting for connections...")
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Accept error: %v\n", err)
-			continue
-		}
+	fmt.Println("Waiting for connections... (Ctrl-C to shut down gracefully)")
 
-		go handleBinaryConnection(conn)
-	}
+	report := srv.Serve(listener, handleBinaryConnection)
+	fmt.Printf("Shutdown complete: %s\n", report)
 }
 
 func handleBinaryConnection(conn net.Conn) {
@@ -47,11 +51,25 @@ func handleBinaryConnection(conn net.Conn) {
 	clientAddr := conn.RemoteAddr().String()
 	fmt.Printf("[%s] Client connected\n", clientAddr)
 
+	// Buffered so we can wait for a message without consuming it
+	reader := bufio.NewReader(conn)
+
 	for {
+		// Set before Idle: a shutdown that wakes the connection once Idle
+		// has returned sets its own deadline, which this must not overwrite
 		conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+		if !srv.Idle(conn) {
+			break
+		}
+
+		// Wait for the next message to start; shutdown interrupts only this wait
+		if _, err := reader.Peek(1); err != nil && srv.ShuttingDown() {
+			break
+		}
+		srv.Active(conn)
 
 		// Step 1: Read message length (4 bytes)
-		data, err := receiveMessage(conn)
+		data, err := receiveMessage(reader)
 		if err != nil {
 			if err == io.EOF {
 				fmt.Printf("[%s] Client disconnected\n", clientAddr)
@@ -78,13 +96,17 @@ func handleBinaryConnection(conn net.Conn) {
 			return
 		}
 	}
+
+	// Shutting down: send the zero-length shutdown notice
+	fmt.Printf("[%s] Sending shutdown notice\n", clientAddr)
+	sendMessage(conn, nil)
 }
 
 // receiveMessage reads a length-prefixed message
-func receiveMessage(conn net.Conn) ([]byte, error) {
+func receiveMessage(r io.Reader) ([]byte, error) {
 	// Read 4-byte length header
 	var length uint32
-	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
 		return nil, err
 	}
 
@@ -95,7 +117,7 @@ func receiveMessage(conn net.Conn) ([]byte, error) {
 
 	// Read exactly 'length' bytes
 	data := make([]byte, length)
-	if _, err := io.ReadFull(conn, data); err != nil {
+	if _, err := io.ReadFull(r, data); err != nil {
 		return nil, err
 	}
 
@@ -16,8 +16,15 @@ import (
 	"net"
 	"strings"
 	"time"
+
+	"claude-go/network/graceful"
 )
 
+// drainTimeout bounds how long shutdown waits for in-flight messages
+const drainTimeout = 10 * time.Second
+
+var srv = graceful.New(drainTimeout)
+
 func main() {
 	// Listen on TCP port 8080
 	// "tcp" specifies the protocol
@@ -29,23 +36,16 @@ func main() {
 	defer listener.Close()
 
 	fmt.Println("TCP Server listening on :8080")
-	fmt.Println("Waiting for connections...")
-
-	for {
-		// Accept blocks until a client connects
-		// This is where the 3-way handshake completes:
-		// 1. Client sends SYN
-		// 2. Server responds with SYN-ACK
-		// 3. Client sends ACK
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Printf("Accept error: %v\n", err)
-			continue
-		}
-
-		// Handle each connection in a goroutine
-		go handleConnection(conn)
-	}
+	fmt.Println("Waiting for connections... (Ctrl-C to shut down gracefully)")
+
+	// Accept blocks until a client connects
+	// This is where the 3-way handshake completes:
+	// 1. Client sends SYN
+	// 2. Server responds with SYN-ACK
+	// 3. Client sends ACK
+	// Each connection is handled in its own goroutine until SIGINT/SIGTERM
+	report := srv.Serve(listener, handleConnection)
+	fmt.Printf("Shutdown complete: %s\n", report)
 }
 
 func handleConnection(conn net.Conn) {
@@ -59,7 +59,18 @@ func handleConnection(conn net.Conn) {
 
 	reader := bufio.NewReader(conn)
 
-	for {
+	for srv.Idle(conn) {
+		// Wait for the first byte of the next message; shutdown interrupts
+		// this wait, but not a message that has already started arriving
+		if _, err := reader.Peek(1); err != nil {
+			if srv.ShuttingDown() {
+				break
+			}
+			fmt.Printf("[%s] Connection closed: %v\n", clientAddr, err)
+			return
+		}
+		srv.Active(conn)
+
 		// Read until newline - TCP is stream-based
 		// Data may arrive in chunks, but bufio handles this
 		message, err := reader.ReadString('\n')
@@ -90,4 +101,8 @@ func handleConnection(conn net.Conn) {
 			return
 		}
 	}
+
+	// Server is shutting down: tell the client before closing
+	fmt.Printf("[%s] Sending shutdown notice\n", clientAddr)
+	conn.Write([]byte("Server shutting down\n"))
 }
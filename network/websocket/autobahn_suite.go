@@ -0,0 +1,591 @@
+// WebSocket protocol conformance suite
+// Starts an in-process wsserver.Server on a loopback listener, the same
+// connection handling server.go runs (handshake, read loop, send queue
+// writer, closing handshake), sends each case's raw frames over a real
+// TCP connection, and checks what comes back: the echoed messages and
+// pongs in order, then the close frame's status code, then the server
+// hanging up.
+//
+// The cases follow the sections of the Autobahn fuzzing client (framing,
+// pings, reserved bits, opcodes, fragmentation, UTF-8, close handling,
+// limits, and permessage-deflate in 12/13) and keep its case numbers
+// where one matches. Where server.go's session is a chat client, the
+// session here echoes every data message verbatim, as Autobahn expects.
+// Messages are limited to 64KB so the limit cases stay small, and the
+// write timeout is short so a case can idle past it.
+//
+// Run: go run autobahn_suite.go
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"claude-go/network/websocket/wsserver"
+	"claude-go/network/websocket/wswire"
+)
+
+// suiteMaxMessageSize stands in for server.go's 1MB limit and
+// suiteWriteTimeout for its 10s; fragmentSize is the same, so large echoes
+// come back fragmented
+const (
+	suiteMaxMessageSize = 1 << 16 // 64KB
+	suiteWriteTimeout   = 250 * time.Millisecond
+	fragmentSize        = 4096
+)
+
+type reply struct {
+	opcode byte
+	data   string
+}
+
+type conformanceCase struct {
+	id      string // Autobahn case number, or the nearest section
+	name    string
+	deflate *wswire.DeflateParams // permessage-deflate offer, nil for none
+	send    []byte                // Client frames, back to back
+	idle    time.Duration         // Then a pause before sending later
+	later   []byte
+	want    []reply // Echoes and pongs before the close, in order
+	close   int     // Status in the server's close frame; CloseNoStatus = empty payload
+}
+
+// Frame builders. Client frames are masked unless built with unmasked.
+
+func frame(fin bool, rsv, opcode byte, payload string) []byte {
+	var b bytes.Buffer
+	wswire.WriteFrame(&b, wswire.Frame{Fin: fin, Rsv: rsv, Opcode: opcode, Payload: []byte(payload)}, true)
+	return b.Bytes()
+}
+
+func msg(opcode byte, payload string) []byte {
+	return frame(true, 0, opcode, payload)
+}
+
+func unmasked(opcode byte, payload string) []byte {
+	var b bytes.Buffer
+	wswire.WriteFrame(&b, wswire.Frame{Fin: true, Opcode: opcode, Payload: []byte(payload)}, false)
+	return b.Bytes()
+}
+
+func closeFrame(code int, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return msg(wswire.OpClose, string(payload)+reason)
+}
+
+// fragments splits a text message into frames of size bytes
+func fragments(opcode byte, payload string, size int) []byte {
+	var b []byte
+	for off := 0; off < len(payload) || off == 0; off += size {
+		end := min(off+size, len(payload))
+		op := opcode
+		if off > 0 {
+			op = wswire.OpContinuation
+		}
+		b = append(b, frame(end == len(payload), 0, op, payload[off:end])...)
+	}
+	return b
+}
+
+func frames(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// deflated encodes messages the way a client with these agreed
+// parameters would, each compressed with the context of those before
+func deflated(p wswire.DeflateParams, fragment int, opcode byte, messages ...string) []byte {
+	var b bytes.Buffer
+	ws := wswire.NewConn(nil, &b, true)
+	ws.EnableDeflate(p)
+	ws.FragmentSize = fragment
+	for _, m := range messages {
+		ws.WriteMessage(opcode, []byte(m))
+	}
+	return b.Bytes()
+}
+
+// bye ends the cases that expect the connection to stay up
+var bye = closeFrame(wswire.CloseNormal, "")
+
+func textReply(s string) reply { return reply{wswire.OpText, s} }
+func binReply(s string) reply  { return reply{wswire.OpBinary, s} }
+func pong(s string) reply      { return reply{wswire.OpPong, s} }
+
+func conformanceCases() []conformanceCase {
+	cases := []conformanceCase{
+		// 1 Framing: payload lengths around the 7-bit, 16-bit and 64-bit encodings
+		{id: "1.1.1", name: "text, 0 bytes", send: frames(msg(wswire.OpText, ""), bye), want: []reply{textReply("")}, close: 1000},
+		{id: "1.2.1", name: "binary, 0 bytes", send: frames(msg(wswire.OpBinary, ""), bye), want: []reply{binReply("")}, close: 1000},
+	}
+	for _, n := range []int{125, 126, 127, 128, 65535, 65536} {
+		payload := strings.Repeat("*", n)
+		cases = append(cases,
+			conformanceCase{id: "1.1", name: fmt.Sprintf("text, %d bytes", n), send: frames(msg(wswire.OpText, payload), bye), want: []reply{textReply(payload)}, close: 1000},
+			conformanceCase{id: "1.2", name: fmt.Sprintf("binary, %d bytes", n), send: frames(msg(wswire.OpBinary, payload), bye), want: []reply{binReply(payload)}, close: 1000},
+		)
+	}
+
+	var tenPings []byte
+	var tenPongs []reply
+	for i := range 10 {
+		tenPings = append(tenPings, msg(wswire.OpPing, fmt.Sprint("ping ", i))...)
+		tenPongs = append(tenPongs, pong(fmt.Sprint("ping ", i)))
+	}
+
+	// "€" (E2 82 AC) split over three fragments
+	splitEuro := frames(frame(false, 0, wswire.OpText, "a\xE2"), frame(false, 0, wswire.OpContinuation, "\x82"), frame(true, 0, wswire.OpContinuation, "\xACb"))
+	valid := "Hello-µ@ßöäüàá-UTF-8!!"
+
+	cases = append(cases, []conformanceCase{
+		// 2 Pings and pongs
+		{id: "2.1", name: "ping, no payload", send: frames(msg(wswire.OpPing, ""), bye), want: []reply{pong("")}, close: 1000},
+		{id: "2.2", name: "ping, text payload", send: frames(msg(wswire.OpPing, "Hello, world!"), bye), want: []reply{pong("Hello, world!")}, close: 1000},
+		{id: "2.3", name: "ping, binary payload", send: frames(msg(wswire.OpPing, "\x00\xff\xfe\xfd\xfc\xfb\x00\xff"), bye), want: []reply{pong("\x00\xff\xfe\xfd\xfc\xfb\x00\xff")}, close: 1000},
+		{id: "2.4", name: "ping, 125-byte payload", send: frames(msg(wswire.OpPing, strings.Repeat("\xfe", 125)), bye), want: []reply{pong(strings.Repeat("\xfe", 125))}, close: 1000},
+		{id: "2.5", name: "ping, 126-byte payload", send: msg(wswire.OpPing, strings.Repeat("\xfe", 126)), close: 1002},
+		{id: "2.6", name: "unsolicited pong is ignored", send: frames(msg(wswire.OpPong, "unsolicited"), msg(wswire.OpPing, "solicited"), bye), want: []reply{pong("solicited")}, close: 1000},
+		{id: "2.10", name: "10 pings, 10 pongs in order", send: frames(tenPings, bye), want: tenPongs, close: 1000},
+
+		// 3 Reserved bits: no extension is negotiated, so any set bit fails
+		{id: "3.1", name: "RSV1 on text", send: frame(true, 0x40, wswire.OpText, "Hello"), close: 1002},
+		{id: "3.2", name: "text, then RSV2 on text", send: frames(msg(wswire.OpText, "Hello"), frame(true, 0x20, wswire.OpText, "Hello")), want: []reply{textReply("Hello")}, close: 1002},
+		{id: "3.4", name: "RSV1+RSV3 on binary", send: frame(true, 0x50, wswire.OpBinary, "\x00\xff"), close: 1002},
+		{id: "3.6", name: "RSV2+RSV3 on ping", send: frame(true, 0x30, wswire.OpPing, "Hello"), close: 1002},
+		{id: "3.7", name: "all RSV bits on close", send: frame(true, 0x70, wswire.OpClose, ""), close: 1002},
+
+		// 4 Opcodes: 3-7 are reserved data opcodes, B-F reserved control opcodes
+		{id: "4.1.1", name: "opcode 3", send: msg(3, ""), close: 1002},
+		{id: "4.1.2", name: "opcode 4 with payload", send: msg(4, "reserved"), close: 1002},
+		{id: "4.1.3", name: "text, opcode 5", send: frames(msg(wswire.OpText, "Hello"), msg(5, "")), want: []reply{textReply("Hello")}, close: 1002},
+		{id: "4.1.5", name: "opcode 7", send: msg(7, ""), close: 1002},
+		{id: "4.2.1", name: "opcode B", send: msg(0xB, ""), close: 1002},
+		{id: "4.2.3", name: "text, opcode D", send: frames(msg(wswire.OpText, "Hello"), msg(0xD, "")), want: []reply{textReply("Hello")}, close: 1002},
+		{id: "4.2.5", name: "opcode F", send: msg(0xF, "reserved"), close: 1002},
+
+		// 5 Fragmentation
+		{id: "5.1", name: "fragmented ping", send: frames(frame(false, 0, wswire.OpPing, "frag"), frame(true, 0, wswire.OpContinuation, "ment")), close: 1002},
+		{id: "5.2", name: "fragmented pong", send: frames(frame(false, 0, wswire.OpPong, "frag"), frame(true, 0, wswire.OpContinuation, "ment")), close: 1002},
+		{id: "5.3", name: "text in two fragments", send: frames(fragments(wswire.OpText, "fragment1fragment2", 9), bye), want: []reply{textReply("fragment1fragment2")}, close: 1000},
+		{id: "5.4", name: "binary in two fragments", send: frames(fragments(wswire.OpBinary, "\x00\x01\x02\x03", 2), bye), want: []reply{binReply("\x00\x01\x02\x03")}, close: 1000},
+		{
+			id: "5.6", name: "ping between text fragments",
+			send: frames(frame(false, 0, wswire.OpText, "fragment1"), msg(wswire.OpPing, "ping"), frame(true, 0, wswire.OpContinuation, "fragment2"), bye),
+			want: []reply{pong("ping"), textReply("fragment1fragment2")}, close: 1000,
+		},
+		{
+			id: "5.8", name: "pong between text fragments",
+			send: frames(frame(false, 0, wswire.OpText, "fragment1"), msg(wswire.OpPong, "pong"), frame(true, 0, wswire.OpContinuation, "fragment2"), bye),
+			want: []reply{textReply("fragment1fragment2")}, close: 1000,
+		},
+		{id: "5.9", name: "continuation with nothing to continue", send: frame(true, 0, wswire.OpContinuation, "fragment"), close: 1002},
+		{id: "5.10", name: "unfinished continuation with nothing to continue", send: frame(false, 0, wswire.OpContinuation, "fragment"), close: 1002},
+		{
+			id: "5.15", name: "new message before the final fragment",
+			send:  frames(frame(false, 0, wswire.OpText, "fragment1"), frame(true, 0, wswire.OpText, "fragment2")),
+			close: 1002,
+		},
+		{
+			id: "5.19", name: "many fragments with pings between",
+			send: frames(
+				frame(false, 0, wswire.OpText, "f1"), frame(false, 0, wswire.OpContinuation, "f2"), msg(wswire.OpPing, "p1"),
+				frame(false, 0, wswire.OpContinuation, "f3"), frame(false, 0, wswire.OpContinuation, "f4"), msg(wswire.OpPing, "p2"),
+				frame(true, 0, wswire.OpContinuation, "f5"), bye),
+			want:  []reply{pong("p1"), pong("p2"), textReply("f1f2f3f4f5")},
+			close: 1000,
+		},
+		{
+			id: "5.x", name: "empty fragments",
+			send: frames(frame(false, 0, wswire.OpText, ""), frame(false, 0, wswire.OpContinuation, "middle"), frame(true, 0, wswire.OpContinuation, ""), bye),
+			want: []reply{textReply("middle")}, close: 1000,
+		},
+		{id: "5.x", name: "text in 1-byte fragments", send: frames(fragments(wswire.OpText, valid, 1), bye), want: []reply{textReply(valid)}, close: 1000},
+
+		// 6 UTF-8 handling
+		{id: "6.1.1", name: "empty text", send: frames(msg(wswire.OpText, ""), bye), want: []reply{textReply("")}, close: 1000},
+		{id: "6.2.1", name: "valid UTF-8, one frame", send: frames(msg(wswire.OpText, valid), bye), want: []reply{textReply(valid)}, close: 1000},
+		{id: "6.2.3", name: "valid UTF-8, code point split across fragments", send: frames(splitEuro, bye), want: []reply{textReply("a€b")}, close: 1000},
+		{id: "6.2.x", name: "4-byte code point and U+FFFD itself", send: frames(msg(wswire.OpText, "\U0001F600 � \U0010FFFF"), bye), want: []reply{textReply("\U0001F600 � \U0010FFFF")}, close: 1000},
+		{id: "6.3.1", name: "UTF-16 surrogate", send: msg(wswire.OpText, "κόσμε\xED\xA0\x80edited"), close: 1007},
+		{id: "6.3.2", name: "invalid UTF-8 in 1-byte fragments", send: fragments(wswire.OpText, "κόσμε\xED\xA0\x80edited", 1), close: 1007},
+		{id: "6.4.1", name: "fail fast: bad first fragment, rest never sent", send: frame(false, 0, wswire.OpText, "κόσμε\xF4\x90\x80\x80"), close: 1007},
+		{id: "6.4.2", name: "fail fast: bad byte in a middle fragment", send: frames(frame(false, 0, wswire.OpText, "κόσμε"), frame(false, 0, wswire.OpContinuation, "\xF5")), close: 1007},
+		{id: "6.5", name: "valid text, then invalid", send: frames(msg(wswire.OpText, valid), msg(wswire.OpText, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80")), want: []reply{textReply(valid)}, close: 1007},
+		{id: "6.6", name: "truncated sequence at the end of the message", send: msg(wswire.OpText, "euro \xE2\x82"), close: 1007},
+		{id: "6.8", name: "above U+10FFFF", send: msg(wswire.OpText, "\xF7\xBF\xBF\xBF"), close: 1007},
+		{id: "6.9", name: "overlong encoding of /", send: msg(wswire.OpText, "\xC0\xAF"), close: 1007},
+		{id: "6.10", name: "bytes FE and FF", send: msg(wswire.OpText, "\xFE\xFF"), close: 1007},
+		{id: "6.11", name: "lone continuation byte", send: msg(wswire.OpText, "\x80"), close: 1007},
+		{id: "6.x", name: "binary is not UTF-8 checked", send: frames(msg(wswire.OpBinary, "\xFE\xFF"), bye), want: []reply{binReply("\xFE\xFF")}, close: 1000},
+
+		// 7 Close handling
+		{id: "7.1.1", name: "text, then close", send: frames(msg(wswire.OpText, "Hello"), bye), want: []reply{textReply("Hello")}, close: 1000},
+		{id: "7.1.2", name: "nothing is read after a close", send: frames(bye, msg(wswire.OpText, "Hello")), close: 1000},
+		{id: "7.3.1", name: "close without a payload", send: msg(wswire.OpClose, ""), close: wswire.CloseNoStatus},
+		{id: "7.3.2", name: "close with a 1-byte payload", send: msg(wswire.OpClose, "\x03"), close: 1002},
+		{id: "7.3.4", name: "close with a reason", send: closeFrame(1000, "Normal close"), close: 1000},
+		{id: "7.3.5", name: "close with a 123-byte reason", send: closeFrame(1000, strings.Repeat("*", 123)), close: 1000},
+		{id: "7.3.6", name: "close with a 124-byte reason", send: closeFrame(1000, strings.Repeat("*", 124)), close: 1002},
+		{id: "7.5.1", name: "close reason not UTF-8", send: closeFrame(1000, "κόσμε\xED\xA0\x80edited"), close: 1007},
+
+		// Idling past the write timeout after an echo: the writer's deadline
+		// must not outlive its message, or later pongs and close frames fail
+		{id: "7.x", name: "ping after idling past the write timeout", send: msg(wswire.OpText, "Hello"), idle: 2 * suiteWriteTimeout, later: frames(msg(wswire.OpPing, "late"), bye), want: []reply{textReply("Hello"), pong("late")}, close: 1000},
+		{id: "7.x", name: "close after idling past the write timeout", send: msg(wswire.OpText, "Hello"), idle: 2 * suiteWriteTimeout, later: closeFrame(1001, ""), want: []reply{textReply("Hello")}, close: 1001},
+		{id: "7.x", name: "protocol error after idling past the write timeout", send: msg(wswire.OpText, "Hello"), idle: 2 * suiteWriteTimeout, later: unmasked(wswire.OpText, "Hello"), want: []reply{textReply("Hello")}, close: 1002},
+
+		// Masking (RFC 6455 5.1): the server must fail an unmasked frame
+		{id: "5.1*", name: "unmasked text", send: unmasked(wswire.OpText, "Hello"), close: 1002},
+		{id: "5.1*", name: "unmasked ping", send: unmasked(wswire.OpPing, "Hello"), close: 1002},
+		{id: "5.1*", name: "masked, then unmasked", send: frames(msg(wswire.OpText, "Hello"), unmasked(wswire.OpText, "Hello")), want: []reply{textReply("Hello")}, close: 1002},
+
+		// 9 Limits: the whole message is checked, fragments added up
+		{id: "9.x", name: "text at the limit", send: frames(msg(wswire.OpText, strings.Repeat("*", suiteMaxMessageSize)), bye), want: []reply{textReply(strings.Repeat("*", suiteMaxMessageSize))}, close: 1000},
+		{id: "9.x", name: "text one byte over the limit", send: msg(wswire.OpText, strings.Repeat("*", suiteMaxMessageSize+1)), close: 1009},
+		{id: "9.x", name: "fragments adding up to over the limit", send: fragments(wswire.OpBinary, strings.Repeat("*", suiteMaxMessageSize+1), suiteMaxMessageSize/2), close: 1009},
+	}...)
+
+	// 12 / 13 permessage-deflate. The server takes the offer as is, so the
+	// offer is also what both sides compress with.
+	takeover := &wswire.DeflateParams{}
+	noTakeover := &wswire.DeflateParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}
+	window9 := &wswire.DeflateParams{ServerMaxWindowBits: 9, ClientMaxWindowBits: 9}
+	chat := []string{
+		`{"type":"message","room":"lobby","from":"alice","text":"has anyone tried the new build yet?"}`,
+		`{"type":"message","room":"lobby","from":"bob","text":"yes, the new build fixed the reconnect bug for me"}`,
+		`{"type":"message","room":"lobby","from":"alice","text":"great, has anyone seen the reconnect bug since?"}`,
+	}
+	long := strings.Repeat("the quick brown fox jumps over the lazy dog; ", 50) // Over a 512-byte window
+	var chatReplies []reply
+	for _, m := range chat {
+		chatReplies = append(chatReplies, textReply(m))
+	}
+	bigSame := strings.Repeat("*", suiteMaxMessageSize+1)
+
+	cases = append(cases, []conformanceCase{
+		{id: "12.1", name: "chat text, context takeover", deflate: takeover, send: frames(deflated(*takeover, 0, wswire.OpText, chat...), bye), want: chatReplies, close: 1000},
+		{id: "12.2", name: "binary, context takeover", deflate: takeover, send: frames(deflated(*takeover, 0, wswire.OpBinary, "\x00\x01\x02\x00\x01\x02\x00\x01\x02"), bye), want: []reply{binReply("\x00\x01\x02\x00\x01\x02\x00\x01\x02")}, close: 1000},
+		{id: "12.x", name: "empty text, compressed", deflate: takeover, send: frames(deflated(*takeover, 0, wswire.OpText, ""), bye), want: []reply{textReply("")}, close: 1000},
+		{id: "12.x", name: "compressed in 8-byte fragments", deflate: takeover, send: frames(deflated(*takeover, 8, wswire.OpText, chat...), bye), want: chatReplies, close: 1000},
+		{id: "12.x", name: "uncompressed message in a compressed session", deflate: takeover, send: frames(msg(wswire.OpText, "plain"), bye), want: []reply{textReply("plain")}, close: 1000},
+		{id: "13.3", name: "chat text, no context takeover", deflate: noTakeover, send: frames(deflated(*noTakeover, 0, wswire.OpText, chat...), bye), want: chatReplies, close: 1000},
+		{id: "13.5", name: "window bits 9 both ways", deflate: window9, send: frames(deflated(*window9, 0, wswire.OpText, long, long), bye), want: []reply{textReply(long), textReply(long)}, close: 1000},
+		{id: "13.x", name: "at the limit once inflated", deflate: takeover, send: frames(deflated(*takeover, 0, wswire.OpText, bigSame[1:]), bye), want: []reply{textReply(bigSame[1:])}, close: 1000},
+		{id: "13.x", name: "inflates past the limit", deflate: takeover, send: deflated(*takeover, 0, wswire.OpText, bigSame), close: 1009},
+		{id: "13.x", name: "RSV1 on a continuation frame", deflate: takeover, send: frames(frame(false, 0x40, wswire.OpText, "\x00"), frame(true, 0x40, wswire.OpContinuation, "")), close: 1002},
+		{id: "13.x", name: "RSV1 on a ping", deflate: takeover, send: frame(true, 0x40, wswire.OpPing, "\x00"), close: 1002},
+		{id: "13.x", name: "RSV2 in a compressed session", deflate: takeover, send: frame(true, 0x20, wswire.OpText, "Hello"), close: 1002},
+		{id: "13.x", name: "corrupt compressed data", deflate: takeover, send: frame(true, 0x40, wswire.OpText, "\xff\xff\xff"), close: 1007},
+		{id: "13.x", name: "invalid UTF-8, compressed", deflate: takeover, send: deflated(*takeover, 0, wswire.OpText, "κόσμε\xED\xA0\x80edited"), close: 1007},
+	}...)
+
+	// 7.7 / 7.9 / 7.13: codes allowed on the wire are echoed, the rest fail
+	for _, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		cases = append(cases, conformanceCase{id: "7.7", name: fmt.Sprintf("close code %d echoed", code), send: closeFrame(code, ""), close: code})
+	}
+	for _, code := range []int{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999, 5000, 65535} {
+		cases = append(cases, conformanceCase{id: "7.9", name: fmt.Sprintf("close code %d rejected", code), send: closeFrame(code, ""), close: 1002})
+	}
+	return cases
+}
+
+type handshakeCase struct {
+	name       string
+	request    string // Sec-WebSocket-Key and the blank line are added unless it has "\r\n\r\n"
+	want       int
+	extensions string // Sec-WebSocket-Extensions expected in a 101
+}
+
+const upgradeLines = "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"
+
+var handshakeCases = []handshakeCase{
+	{name: "valid upgrade", request: upgradeLines + "Sec-WebSocket-Version: 13\r\n", want: 101},
+	{name: "Connection lists upgrade among others", request: "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: WebSocket\r\nConnection: keep-alive, Upgrade\r\nSec-WebSocket-Version: 13\r\n", want: 101},
+	{name: "version 8", request: upgradeLines + "Sec-WebSocket-Version: 8\r\n", want: 426},
+	{name: "no version", request: upgradeLines, want: 426},
+	{name: "two versions", request: upgradeLines + "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Version: 8\r\n", want: 426},
+	{name: "POST", request: "POST / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\n", want: 400},
+	{name: "HTTP/1.0", request: "GET / HTTP/1.0\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n", want: 400},
+	{name: "no Upgrade", request: "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n", want: 400},
+	{name: "no Connection: upgrade", request: "GET / HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: keep-alive\r\nSec-WebSocket-Version: 13\r\n", want: 400},
+	{name: "no key", request: upgradeLines + "Sec-WebSocket-Version: 13\r\n\r\n", want: 400},
+	{name: "key not 16 bytes", request: upgradeLines + "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: c2hvcnQ=\r\n\r\n", want: 400},
+
+	// permessage-deflate negotiation
+	{name: "deflate offered", request: deflateOffer("permessage-deflate"), want: 101, extensions: "permessage-deflate"},
+	{
+		name:    "deflate with parameters",
+		request: deflateOffer("permessage-deflate; server_max_window_bits=10; client_no_context_takeover; client_max_window_bits"), want: 101,
+		extensions: "permessage-deflate; client_no_context_takeover; server_max_window_bits=10",
+	},
+	{name: "quoted window bits", request: deflateOffer(`permessage-deflate; client_max_window_bits="12"`), want: 101, extensions: "permessage-deflate; client_max_window_bits=12"},
+	{name: "bad offer skipped for the next", request: deflateOffer("permessage-deflate; server_max_window_bits=7, permessage-deflate; server_no_context_takeover"), want: 101, extensions: "permessage-deflate; server_no_context_takeover"},
+	{name: "unknown parameter declined", request: deflateOffer("permessage-deflate; foo=1"), want: 101},
+	{name: "duplicate parameter declined", request: deflateOffer("permessage-deflate; server_no_context_takeover; server_no_context_takeover"), want: 101},
+	{name: "window bits without a value declined", request: deflateOffer("permessage-deflate; server_max_window_bits"), want: 101},
+	{name: "unknown extension ignored", request: deflateOffer("x-webkit-deflate-frame"), want: 101},
+}
+
+func deflateOffer(extensions string) string {
+	return upgradeLines + "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Extensions: " + extensions + "\r\n"
+}
+
+func main() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("Error starting server: %v\n", err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+	server := &wsserver.Server{
+		Open:           func(*http.Request) wsserver.Session { return newEcho() },
+		Deflate:        &wswire.DeflateParams{},
+		MaxMessageSize: suiteMaxMessageSize,
+		FragmentSize:   fragmentSize,
+		WriteTimeout:   suiteWriteTimeout,
+	}
+	go serve(listener, server.ServeConn)
+	addr := listener.Addr().String()
+
+	failures := 0
+	report := func(label string, err error) {
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", label, err)
+			failures++
+		} else {
+			fmt.Printf("ok   %s\n", label)
+		}
+	}
+
+	fmt.Printf("=== Opening handshake against %s ===\n", addr)
+	for _, tc := range handshakeCases {
+		report(tc.name, runHandshakeCase(addr, tc))
+	}
+
+	fmt.Printf("\n=== Frames against %s ===\n", addr)
+	for _, tc := range conformanceCases() {
+		report(fmt.Sprintf("%-6s %s", tc.id, tc.name), runCase(addr, tc))
+	}
+
+	if failures > 0 {
+		fmt.Printf("\n%d failure(s)\n", failures)
+		os.Exit(1)
+	}
+	fmt.Println("\nAll checks passed")
+}
+
+func serve(listener net.Listener, handle func(conn net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go handle(conn)
+	}
+}
+
+// echoQueueSize bounds the echoes waiting for the writer; the largest
+// case sends far fewer
+const echoQueueSize = 256
+
+// echo is the suite's session: every data message goes back as it came
+type echo struct {
+	send chan wsserver.Message
+}
+
+func newEcho() *echo {
+	return &echo{send: make(chan wsserver.Message, echoQueueSize)}
+}
+
+func (e *echo) Name() string                  { return "echo" }
+func (e *echo) Send() <-chan wsserver.Message { return e.send }
+func (e *echo) Dropped() <-chan struct{}      { return nil }
+func (e *echo) Close()                        {}
+
+func (e *echo) Receive(opcode byte, data []byte) (int, string) {
+	select {
+	case e.send <- wsserver.Message{Opcode: opcode, Data: data}:
+		return 0, ""
+	default:
+		return wswire.ClosePolicyViolation, "echo queue full"
+	}
+}
+
+// runCase upgrades, sends the frames, and reads until the server's close
+// frame, which must be followed by the server hanging up
+func runCase(addr string, tc conformanceCase) error {
+	conn, reader, agreed, err := dialUpgraded(addr, tc.deflate)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if tc.deflate != nil && agreed != *tc.deflate {
+		return fmt.Errorf("agreed to %s, offered %s", agreed, tc.deflate)
+	}
+
+	if _, err := conn.Write(tc.send); err != nil {
+		return err
+	}
+	if tc.later != nil {
+		time.Sleep(tc.idle)
+		if _, err := conn.Write(tc.later); err != nil {
+			return err
+		}
+	}
+
+	// A client-side Conn checks the server's frames in turn: unmasked,
+	// no reserved bits but a negotiated RSV1, text that is UTF-8
+	ws := wswire.NewConn(reader, conn, true)
+	ws.MaxMessageSize = suiteMaxMessageSize
+	if tc.deflate != nil {
+		ws.EnableDeflate(agreed)
+	}
+	var got []reply
+	for {
+		opcode, message, err := ws.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("after %s: no close frame: %v", describe(got), err)
+		}
+		if opcode != wswire.OpClose {
+			got = append(got, reply{opcode, string(message)})
+			continue
+		}
+
+		if !slices.Equal(got, tc.want) {
+			return fmt.Errorf("got %s, want %s", describe(got), describe(tc.want))
+		}
+		code, _, err := wswire.ParseClose(message)
+		if err != nil {
+			return fmt.Errorf("server's close frame: %v", err)
+		}
+		if code != tc.close {
+			return fmt.Errorf("closed with %d, want %d", code, tc.close)
+		}
+		break
+	}
+
+	if _, err := reader.Peek(1); err != io.EOF && !isReset(err) {
+		return fmt.Errorf("connection still open after the close frame (%v)", err)
+	}
+	return nil
+}
+
+// dialUpgraded connects and completes a valid opening handshake, offering
+// permessage-deflate if offer is set, which the server must accept
+func dialUpgraded(addr string, offer *wswire.DeflateParams) (net.Conn, *bufio.Reader, wswire.DeflateParams, error) {
+	var agreed wswire.DeflateParams
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, agreed, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := newKey()
+	var extensions string
+	if offer != nil {
+		extensions = "Sec-WebSocket-Extensions: " + offer.Offer() + "\r\n"
+	}
+	fmt.Fprintf(conn, "%sSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\n%s\r\n", upgradeLines, key, extensions)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, agreed, fmt.Errorf("handshake: %v", err)
+	}
+	if resp.StatusCode != 101 || resp.Header.Get("Sec-WebSocket-Accept") != wswire.AcceptKey(key) {
+		conn.Close()
+		return nil, nil, agreed, fmt.Errorf("handshake: %s, accept %q", resp.Status, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	fields := resp.Header.Values("Sec-WebSocket-Extensions")
+	if offer == nil {
+		if len(fields) > 0 {
+			conn.Close()
+			return nil, nil, agreed, fmt.Errorf("handshake: extensions %q not offered", fields)
+		}
+		return conn, reader, agreed, nil
+	}
+	agreed, ok, err := wswire.AcceptedDeflate(fields, *offer)
+	if err == nil && !ok {
+		err = errors.New("permessage-deflate declined")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, agreed, fmt.Errorf("handshake: %v", err)
+	}
+	return conn, reader, agreed, nil
+}
+
+func runHandshakeCase(addr string, tc handshakeCase) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := newKey()
+	request := tc.request
+	if !strings.HasSuffix(request, "\r\n\r\n") {
+		request += "Sec-WebSocket-Key: " + key + "\r\n\r\n"
+	}
+	if _, err := io.WriteString(conn, request); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return fmt.Errorf("reading response: %v", err)
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode != tc.want:
+		return fmt.Errorf("got %s, want %d", resp.Status, tc.want)
+	case tc.want == 101 && resp.Header.Get("Sec-WebSocket-Accept") != wswire.AcceptKey(key):
+		return fmt.Errorf("Sec-WebSocket-Accept %q, want %q", resp.Header.Get("Sec-WebSocket-Accept"), wswire.AcceptKey(key))
+	case tc.want == 426 && resp.Header.Get("Sec-WebSocket-Version") != wswire.Version:
+		return fmt.Errorf("426 without Sec-WebSocket-Version: %s", wswire.Version)
+	case resp.Header.Get("Sec-WebSocket-Extensions") != tc.extensions:
+		return fmt.Errorf("Sec-WebSocket-Extensions %q, want %q", resp.Header.Get("Sec-WebSocket-Extensions"), tc.extensions)
+	}
+	return nil
+}
+
+func newKey() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(nonce)
+}
+
+// describe lists replies briefly; payloads over 32 bytes show as a length
+func describe(replies []reply) string {
+	names := map[byte]string{wswire.OpText: "text", wswire.OpBinary: "binary", wswire.OpPong: "pong"}
+	parts := make([]string, len(replies))
+	for i, r := range replies {
+		if len(r.data) > 32 {
+			parts[i] = fmt.Sprintf("%s(%d bytes)", names[r.opcode], len(r.data))
+		} else {
+			parts[i] = fmt.Sprintf("%s(%q)", names[r.opcode], r.data)
+		}
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
+
+// isReset reports a connection reset, which the server's close can cause
+// when unread frames are still queued on its side
+func isReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && strings.Contains(opErr.Err.Error(), "connection reset")
+}
@@ -0,0 +1,61 @@
+// Package chat is the message layer of the raw WebSocket server: named
+// rooms, join/leave, broadcast to a room's members and presence lists,
+// all as JSON envelopes in text messages.
+//
+// Client to server:
+//
+//	{"type":"join","room":"lobby"}
+//	{"type":"leave","room":"lobby"}
+//	{"type":"message","room":"lobby","text":"hi"}
+//	{"type":"who","room":"lobby"}          presence list of one room
+//	{"type":"rooms"}                       every room and its member count
+//
+// Server to client:
+//
+//	{"type":"welcome","from":"alice"}                      the name given on connect
+//	{"type":"joined","room":"lobby","from":"bob"}          to every member, bob included
+//	{"type":"left","room":"lobby","from":"bob","text":"too slow"}
+//	{"type":"message","room":"lobby","from":"bob","text":"hi","id":7,"time":"..."}
+//	{"type":"presence","room":"lobby","members":["alice","bob"]}
+//	{"type":"rooms","rooms":[{"name":"lobby","members":2}]}
+//	{"type":"error","error":"not in room \"dev\""}
+//
+// The Hub never waits on a client: each has a bounded send queue, and one
+// that falls a full queue behind is dropped from every room (its rooms
+// see it leave with "too slow"), the way sse.Broker cuts off a slow
+// subscriber.
+package chat
+
+// Envelope types
+const (
+	TypeJoin     = "join"
+	TypeLeave    = "leave"
+	TypeMessage  = "message"
+	TypeWho      = "who"
+	TypeRooms    = "rooms"
+	TypeWelcome  = "welcome"
+	TypeJoined   = "joined"
+	TypeLeft     = "left"
+	TypePresence = "presence"
+	TypeError    = "error"
+)
+
+// Envelope is every message in either direction; Type says which other
+// fields are set
+type Envelope struct {
+	Type    string     `json:"type"`
+	Room    string     `json:"room,omitempty"`
+	From    string     `json:"from,omitempty"`
+	Text    string     `json:"text,omitempty"`
+	ID      uint64     `json:"id,omitempty"`   // Hub-wide sequence number of a message
+	Time    string     `json:"time,omitempty"` // RFC 3339, when the hub relayed it
+	Members []string   `json:"members,omitempty"`
+	Rooms   []RoomInfo `json:"rooms,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// RoomInfo is one entry of a rooms listing
+type RoomInfo struct {
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+}
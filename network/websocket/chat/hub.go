@@ -0,0 +1,321 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"claude-go/network/websocket/wsserver"
+	"claude-go/network/websocket/wswire"
+)
+
+const (
+	maxNameLen        = 32   // Client and room names
+	maxTextBytes      = 4096 // One chat message's text
+	maxRoomsPerClient = 16
+)
+
+// HubStats counts a Hub's traffic
+type HubStats struct {
+	Clients   int    `json:"clients"`
+	Rooms     int    `json:"rooms"`
+	Messages  uint64 `json:"messages"`  // Chat messages relayed, also the last message ID
+	Delivered uint64 `json:"delivered"` // Envelopes queued to clients
+	Dropped   uint64 `json:"dropped"`   // Clients cut off for falling behind
+}
+
+// Hub routes envelopes between clients and rooms
+type Hub struct {
+	queueSize int
+
+	mu        sync.Mutex
+	clients   map[string]*Client              // By name
+	rooms     map[string]map[*Client]struct{} // Removed when the last member leaves
+	lastID    uint64
+	delivered uint64
+	dropped   uint64
+	pending   []*Client // Dropped mid-broadcast, still to be removed from their rooms
+	guests    int
+}
+
+// NewHub returns a Hub that queues up to queueSize envelopes per client
+func NewHub(queueSize int) *Hub {
+	return &Hub{
+		queueSize: queueSize,
+		clients:   make(map[string]*Client),
+		rooms:     make(map[string]map[*Client]struct{}),
+	}
+}
+
+// Client is one connection's membership in the hub, and its
+// wsserver.Session. The connection's writer drains Send; the hub never
+// blocks on it.
+type Client struct {
+	hub     *Hub
+	name    string
+	send    chan wsserver.Message
+	dropped chan struct{}
+
+	// Guarded by the hub's mu
+	rooms map[string]struct{}
+	gone  bool // Unregistered or dropped
+}
+
+func (c *Client) Name() string {
+	return c.name
+}
+
+// Send yields the envelopes queued for the client, already encoded
+func (c *Client) Send() <-chan wsserver.Message {
+	return c.send
+}
+
+// Dropped is closed when the hub cuts the client off for falling behind.
+// The connection should be closed: nothing more will be queued.
+func (c *Client) Dropped() <-chan struct{} {
+	return c.dropped
+}
+
+// Receive hands a text message to the hub as an envelope. Binary
+// messages close the connection with 1003.
+func (c *Client) Receive(opcode byte, data []byte) (code int, reason string) {
+	if opcode != wswire.OpText {
+		return wswire.CloseUnsupportedData, "text envelopes only"
+	}
+	c.hub.Handle(c, data)
+	return 0, ""
+}
+
+// Close unregisters the client
+func (c *Client) Close() {
+	c.hub.Unregister(c)
+}
+
+// Register adds a client under name, or the first free "name-2",
+// "name-3"...; an empty or invalid name gets "guest-N". The client's
+// queue starts with a welcome carrying the name it got.
+func (h *Hub) Register(name string) *Client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !validName(name) {
+		h.guests++
+		name = "guest-" + strconv.Itoa(h.guests)
+	}
+	base := name
+	for i := 2; h.clients[name] != nil; i++ {
+		name = base + "-" + strconv.Itoa(i)
+	}
+
+	c := &Client{
+		hub:     h,
+		name:    name,
+		send:    make(chan wsserver.Message, h.queueSize),
+		dropped: make(chan struct{}),
+		rooms:   make(map[string]struct{}),
+	}
+	h.clients[name] = c
+	h.queue(c, Envelope{Type: TypeWelcome, From: name})
+	return c
+}
+
+// Unregister removes c from the hub and its rooms, whose members see it
+// leave. Unregistering a dropped client does nothing.
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.gone {
+		return
+	}
+	c.gone = true
+	h.remove(c, "")
+	h.flushDrops()
+}
+
+// Handle acts on one envelope from c. Invalid input is answered with an
+// error envelope to c alone.
+func (h *Hub) Handle(c *Client, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c.gone {
+		return
+	}
+	defer h.flushDrops()
+
+	var in Envelope
+	if err := json.Unmarshal(data, &in); err != nil {
+		h.fail(c, "invalid envelope: %v", err)
+		return
+	}
+
+	switch in.Type {
+	case TypeJoin:
+		switch _, member := c.rooms[in.Room]; {
+		case !validName(in.Room):
+			h.fail(c, "invalid room name %q", in.Room)
+		case member:
+			h.queue(c, h.presence(in.Room))
+		case len(c.rooms) >= maxRoomsPerClient:
+			h.fail(c, "in %d rooms already", maxRoomsPerClient)
+		default:
+			if h.rooms[in.Room] == nil {
+				h.rooms[in.Room] = make(map[*Client]struct{})
+			}
+			h.rooms[in.Room][c] = struct{}{}
+			c.rooms[in.Room] = struct{}{}
+			h.broadcast(in.Room, Envelope{Type: TypeJoined, Room: in.Room, From: c.name})
+			h.queue(c, h.presence(in.Room))
+		}
+
+	case TypeLeave:
+		if _, member := c.rooms[in.Room]; !member {
+			h.fail(c, "not in room %q", in.Room)
+			return
+		}
+		// Told before leaving, so the leaver hears it too
+		h.broadcast(in.Room, Envelope{Type: TypeLeft, Room: in.Room, From: c.name})
+		h.leave(c, in.Room)
+
+	case TypeMessage:
+		switch _, member := c.rooms[in.Room]; {
+		case !member:
+			h.fail(c, "not in room %q", in.Room)
+		case in.Text == "":
+			h.fail(c, "empty message")
+		case len(in.Text) > maxTextBytes:
+			h.fail(c, "message over %d bytes", maxTextBytes)
+		default:
+			h.lastID++
+			h.broadcast(in.Room, Envelope{
+				Type: TypeMessage,
+				Room: in.Room,
+				From: c.name,
+				Text: in.Text,
+				ID:   h.lastID,
+				Time: time.Now().UTC().Format(time.RFC3339),
+			})
+		}
+
+	case TypeWho:
+		h.queue(c, h.presence(in.Room))
+
+	case TypeRooms:
+		rooms := make([]RoomInfo, 0, len(h.rooms))
+		for name, members := range h.rooms {
+			rooms = append(rooms, RoomInfo{Name: name, Members: len(members)})
+		}
+		slices.SortFunc(rooms, func(a, b RoomInfo) int { return strings.Compare(a.Name, b.Name) })
+		h.queue(c, Envelope{Type: TypeRooms, Rooms: rooms})
+
+	default:
+		h.fail(c, "unknown type %q", in.Type)
+	}
+}
+
+func (h *Hub) Stats() HubStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HubStats{
+		Clients:   len(h.clients),
+		Rooms:     len(h.rooms),
+		Messages:  h.lastID,
+		Delivered: h.delivered,
+		Dropped:   h.dropped,
+	}
+}
+
+// presence lists a room's members by name. Called with h.mu held.
+func (h *Hub) presence(room string) Envelope {
+	members := make([]string, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		members = append(members, c.name)
+	}
+	slices.Sort(members)
+	return Envelope{Type: TypePresence, Room: room, Members: members}
+}
+
+// leave takes c out of room, removing the room once empty. Called with
+// h.mu held.
+func (h *Hub) leave(c *Client, room string) {
+	delete(c.rooms, room)
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// remove takes a gone client out of the hub, telling the members of each
+// of its rooms. Called with h.mu held.
+func (h *Hub) remove(c *Client, reason string) {
+	for room := range c.rooms {
+		h.leave(c, room)
+		h.broadcast(room, Envelope{Type: TypeLeft, Room: room, From: c.name, Text: reason})
+	}
+	delete(h.clients, c.name)
+}
+
+// flushDrops removes the clients dropped by the last broadcasts. Telling
+// their rooms can drop more, hence the loop. Called with h.mu held.
+func (h *Hub) flushDrops() {
+	for len(h.pending) > 0 {
+		c := h.pending[0]
+		h.pending = h.pending[1:]
+		h.remove(c, "too slow")
+	}
+}
+
+func (h *Hub) fail(c *Client, format string, args ...any) {
+	h.queue(c, Envelope{Type: TypeError, Error: fmt.Sprintf(format, args...)})
+}
+
+// queue sends one client an envelope. Called with h.mu held.
+func (h *Hub) queue(c *Client, env Envelope) {
+	data, _ := json.Marshal(env)
+	h.deliver(c, data)
+}
+
+// broadcast sends an envelope to every member of room, encoded once.
+// Called with h.mu held.
+func (h *Hub) broadcast(room string, env Envelope) {
+	data, _ := json.Marshal(env)
+	for c := range h.rooms[room] {
+		h.deliver(c, data)
+	}
+}
+
+// deliver queues data for c without blocking. A full queue drops c: it
+// would only fall further behind. Its removal from its rooms waits for
+// flushDrops, as the caller may be iterating over one. Called with h.mu
+// held.
+func (h *Hub) deliver(c *Client, data []byte) {
+	if c.gone {
+		return
+	}
+	select {
+	case c.send <- wsserver.Message{Opcode: wswire.OpText, Data: data}:
+		h.delivered++
+	default:
+		c.gone = true
+		close(c.dropped)
+		h.dropped++
+		h.pending = append(h.pending, c)
+	}
+}
+
+// validName allows 1-32 letters, digits, '-', '_' and '.'
+func validName(name string) bool {
+	if name == "" || len(name) > maxNameLen {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
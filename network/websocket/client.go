@@ -1,25 +1,62 @@
 // WebSocket Client Example
-// Demonstrates connecting to a WebSocket server
+// Demonstrates connecting to a WebSocket server: a terminal chat client
+// for the hub in server.go
+//
+// Run: go run client.go [-name alice] [-room lobby] [-fragment 16] [-deflate=false] [-no-context-takeover] [-window-bits 10]
+// -fragment sends each message as continuation frames of that many bytes.
+// permessage-deflate is offered unless -deflate=false; -no-context-takeover
+// asks both sides to compress each message on its own, -window-bits for
+// smaller LZ77 windows both ways.
+// Plain text lines go to the current room (-room, joined on connect).
+// Commands:
+//   /join ROOM    join a room and make it current
+//   /leave [ROOM] leave a room (default: the current one)
+//   /who [ROOM]   list a room's members
+//   /rooms        list rooms
+//   /ping         send a ping
+//   /big N        send an N-byte message (over 4KB the hub refuses it,
+//                 over 1MB the server closes with 1009)
 
 package main
 
 import (
 	"bufio"
+	"cmp"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/base64"
-	"encoding/binary"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
-)
 
-const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	"claude-go/network/websocket/chat"
+	"claude-go/network/websocket/wswire"
+)
 
 func main() {
+	name := flag.String("name", "", "name in the chat (default: one the server picks)")
+	room := flag.String("room", "lobby", "room to join on connect")
+	fragment := flag.Int("fragment", 0, "split sent messages into frames of this many bytes (0 = one frame)")
+	compress := flag.Bool("deflate", true, "offer permessage-deflate")
+	noTakeover := flag.Bool("no-context-takeover", false, "ask for no context takeover on both sides")
+	windowBits := flag.Int("window-bits", 0, "ask for LZ77 windows of this many bits on both sides, 8-15 (0 = default)")
+	flag.Parse()
+
+	var offer *wswire.DeflateParams
+	if *compress {
+		offer = &wswire.DeflateParams{
+			ServerNoContextTakeover: *noTakeover,
+			ClientNoContextTakeover: *noTakeover,
+			ServerMaxWindowBits:     *windowBits,
+			ClientMaxWindowBits:     *windowBits,
+		}
+	}
+
 	// Connect to server
 	conn, err := net.DialTimeout("tcp", "localhost:8082", 5*time.Second)
 	if err != nil {
@@ -29,16 +66,34 @@ func main() {
 	defer conn.Close()
 
 	// Perform WebSocket handshake
-	if err := performHandshake(conn); err != nil {
+	reader := bufio.NewReader(conn)
+	agreed, err := performHandshake(conn, reader, "/?name="+url.QueryEscape(*name), offer)
+	if err != nil {
 		fmt.Printf("Handshake failed: %v\n", err)
 		return
 	}
+	ws := wswire.NewConn(reader, conn, true)
+	ws.FragmentSize = *fragment
 
 	fmt.Println("WebSocket connection established!")
+	if agreed != nil {
+		ws.EnableDeflate(*agreed)
+		fmt.Printf("Compression: %s\n", agreed)
+	}
 	fmt.Println("Type messages (or 'quit' to exit):")
 
 	// Start goroutine to read server responses
-	go readMessages(conn)
+	go readMessages(ws)
+
+	send := func(env chat.Envelope) error {
+		data, _ := json.Marshal(env)
+		return ws.WriteMessage(wswire.OpText, data)
+	}
+	current := *room
+	if err := send(chat.Envelope{Type: chat.TypeJoin, Room: current}); err != nil {
+		fmt.Printf("Send error: %v\n", err)
+		return
+	}
 
 	// Read user input and send
 	stdinReader := bufio.NewReader(os.Stdin)
@@ -56,14 +111,41 @@ func main() {
 
 		if input == "quit" {
 			// Send close frame
-			writeFrame(conn, []byte{}, 0x8)
+			ws.WriteClose(wswire.CloseNormal, "")
 			fmt.Println("Closing connection...")
 			time.Sleep(500 * time.Millisecond)
 			return
 		}
 
-		// Send text frame
-		err = writeFrame(conn, []byte(input), 0x1)
+		// Everything goes out as a text message, fragmented if -fragment is set
+		command, arg, _ := strings.Cut(input, " ")
+		arg = strings.TrimSpace(arg)
+		switch command {
+		case "/join":
+			if arg == "" {
+				fmt.Println("usage: /join ROOM")
+				continue
+			}
+			current = arg
+			err = send(chat.Envelope{Type: chat.TypeJoin, Room: arg})
+		case "/leave":
+			err = send(chat.Envelope{Type: chat.TypeLeave, Room: cmp.Or(arg, current)})
+		case "/who":
+			err = send(chat.Envelope{Type: chat.TypeWho, Room: cmp.Or(arg, current)})
+		case "/rooms":
+			err = send(chat.Envelope{Type: chat.TypeRooms})
+		case "/ping":
+			err = ws.WriteControl(wswire.OpPing, []byte("ping"))
+		case "/big":
+			n, convErr := strconv.Atoi(arg)
+			if convErr != nil || n < 0 {
+				fmt.Println("usage: /big N")
+				continue
+			}
+			err = send(chat.Envelope{Type: chat.TypeMessage, Room: current, Text: strings.Repeat("x", n)})
+		default:
+			err = send(chat.Envelope{Type: chat.TypeMessage, Room: current, Text: input})
+		}
 		if err != nil {
 			fmt.Printf("Send error: %v\n", err)
 			return
@@ -71,165 +153,154 @@ func main() {
 	}
 }
 
-func performHandshake(conn net.Conn) error {
+// performHandshake upgrades the connection, offering permessage-deflate if
+// offer is set, and returns the parameters the server agreed to (nil if
+// it declined)
+func performHandshake(conn net.Conn, reader *bufio.Reader, target string, offer *wswire.DeflateParams) (*wswire.DeflateParams, error) {
 	// Generate random key
 	keyBytes := make([]byte, 16)
 	rand.Read(keyBytes)
 	key := base64.StdEncoding.EncodeToString(keyBytes)
 
+	var extensions string
+	if offer != nil {
+		extensions = "Sec-WebSocket-Extensions: " + offer.Offer() + "\r\n"
+	}
+
 	// Send upgrade request
 	request := fmt.Sprintf(
-		"GET / HTTP/1.1\r\n"+
+		"GET %s HTTP/1.1\r\n"+
 			"Host: localhost:8082\r\n"+
 			"Upgrade: websocket\r\n"+
 			"Connection: Upgrade\r\n"+
 			"Sec-WebSocket-Key: %s\r\n"+
 			"Sec-WebSocket-Version: 13\r\n"+
+			"%s"+
 			"\r\n",
-		key,
+		target, key, extensions,
 	)
 	_, err := conn.Write([]byte(request))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Read response
-	reader := bufio.NewReader(conn)
 	statusLine, err := reader.ReadString('\n')
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !strings.Contains(statusLine, "101") {
-		return fmt.Errorf("expected 101 Switching Protocols, got: %s", statusLine)
+		return nil, fmt.Errorf("expected 101 Switching Protocols, got: %s", statusLine)
 	}
 
 	// Read headers
 	var acceptKey string
+	var agreedExtensions []string
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			return err
+			return nil, err
 		}
 		line = strings.TrimSpace(line)
 		if line == "" {
 			break
 		}
-		if strings.HasPrefix(strings.ToLower(line), "sec-websocket-accept:") {
-			acceptKey = strings.TrimSpace(strings.SplitN(line, ":", 2)[1])
+		name, value, _ := strings.Cut(line, ":")
+		switch strings.ToLower(name) {
+		case "sec-websocket-accept":
+			acceptKey = strings.TrimSpace(value)
+		case "sec-websocket-extensions":
+			agreedExtensions = append(agreedExtensions, strings.TrimSpace(value))
 		}
 	}
 
 	// Verify accept key
-	expectedKey := computeAcceptKey(key)
+	expectedKey := wswire.AcceptKey(key)
 	if acceptKey != expectedKey {
-		return fmt.Errorf("invalid accept key: got %s, expected %s", acceptKey, expectedKey)
+		return nil, fmt.Errorf("invalid accept key: got %s, expected %s", acceptKey, expectedKey)
 	}
 
-	return nil
-}
-
-func computeAcceptKey(key string) string {
-	h := sha1.New()
-	h.Write([]byte(key + websocketGUID))
-	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+	// Extensions: only what we offered may come back
+	if offer == nil {
+		if len(agreedExtensions) > 0 {
+			return nil, fmt.Errorf("extensions %q not offered", agreedExtensions)
+		}
+		return nil, nil
+	}
+	agreed, ok, err := wswire.AcceptedDeflate(agreedExtensions, *offer)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &agreed, nil
 }
 
-func readMessages(conn net.Conn) {
-	reader := bufio.NewReader(conn)
+func readMessages(ws *wswire.Conn) {
 	for {
-		message, opcode, err := readFrame(reader)
+		opcode, message, err := ws.ReadMessage()
 		if err != nil {
-			return
+			fmt.Printf("\nRead error: %v\n", err)
+			os.Exit(1)
 		}
 
 		switch opcode {
-		case 0x1: // Text
-			fmt.Printf("\n< %s\n> ", string(message))
-		case 0x8: // Close
-			fmt.Println("\nServer closed connection")
-			return
-		case 0x9: // Ping
-			writeFrame(conn, message, 0xA)
+		case wswire.OpText:
+			fmt.Printf("\n%s\n> ", render(message))
+		case wswire.OpClose:
+			// Payload: 2-byte status code + optional UTF-8 reason
+			if code, reason, _ := wswire.ParseClose(message); code != wswire.CloseNoStatus {
+				fmt.Printf("\nServer closed connection (%d: %s)\n", code, reason)
+			} else {
+				fmt.Println("\nServer closed connection")
+			}
+			// Complete the closing handshake by echoing the status code
+			ws.WriteControl(wswire.OpClose, message[:min(len(message), 2)])
+			os.Exit(0)
+		case wswire.OpPing:
+			ws.WriteControl(wswire.OpPong, message)
+		case wswire.OpPong:
+			fmt.Printf("\n< pong %q\n> ", message)
 		}
 	}
 }
 
-func readFrame(reader *bufio.Reader) ([]byte, byte, error) {
-	header := make([]byte, 2)
-	_, err := io.ReadFull(reader, header)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	opcode := header[0] & 0x0F
-	masked := (header[1] & 0x80) != 0
-	length := uint64(header[1] & 0x7F)
-
-	if length == 126 {
-		extended := make([]byte, 2)
-		io.ReadFull(reader, extended)
-		length = uint64(binary.BigEndian.Uint16(extended))
-	} else if length == 127 {
-		extended := make([]byte, 8)
-		io.ReadFull(reader, extended)
-		length = binary.BigEndian.Uint64(extended)
-	}
-
-	var maskKey []byte
-	if masked {
-		maskKey = make([]byte, 4)
-		io.ReadFull(reader, maskKey)
-	}
-
-	payload := make([]byte, length)
-	_, err = io.ReadFull(reader, payload)
-	if err != nil {
-		return nil, 0, err
+// render formats an envelope from the hub as a line of chat
+func render(message []byte) string {
+	var env chat.Envelope
+	if err := json.Unmarshal(message, &env); err != nil {
+		return "< " + preview(message)
 	}
-
-	if masked {
-		for i := range payload {
-			payload[i] ^= maskKey[i%4]
+	switch env.Type {
+	case chat.TypeWelcome:
+		return "* connected as " + env.From
+	case chat.TypeJoined:
+		return fmt.Sprintf("* %s joined #%s", env.From, env.Room)
+	case chat.TypeLeft:
+		if env.Text != "" {
+			return fmt.Sprintf("* %s left #%s (%s)", env.From, env.Room, env.Text)
 		}
-	}
-
-	return payload, opcode, nil
-}
-
-// writeFrame writes a masked WebSocket frame (client -> server must be masked)
-func writeFrame(conn net.Conn, payload []byte, opcode byte) error {
-	var frame []byte
-
-	// First byte: FIN + opcode
-	frame = append(frame, 0x80|opcode)
-
-	// Second byte: MASK bit (1) + payload length
-	length := len(payload)
-	if length < 126 {
-		frame = append(frame, 0x80|byte(length))
-	} else if length < 65536 {
-		frame = append(frame, 0x80|126)
-		frame = append(frame, byte(length>>8), byte(length))
-	} else {
-		frame = append(frame, 0x80|127)
-		for i := 7; i >= 0; i-- {
-			frame = append(frame, byte(length>>(i*8)))
+		return fmt.Sprintf("* %s left #%s", env.From, env.Room)
+	case chat.TypeMessage:
+		return fmt.Sprintf("[#%s] %s: %s", env.Room, env.From, preview([]byte(env.Text)))
+	case chat.TypePresence:
+		return fmt.Sprintf("* #%s: %s", env.Room, strings.Join(env.Members, ", "))
+	case chat.TypeRooms:
+		rooms := make([]string, len(env.Rooms))
+		for i, r := range env.Rooms {
+			rooms[i] = fmt.Sprintf("#%s (%d)", r.Name, r.Members)
 		}
+		return "* rooms: " + strings.Join(rooms, ", ")
+	case chat.TypeError:
+		return "! " + env.Error
 	}
+	return "< " + preview(message)
+}
 
-	// Generate and append mask key
-	maskKey := make([]byte, 4)
-	rand.Read(maskKey)
-	frame = append(frame, maskKey...)
-
-	// Mask and append payload
-	maskedPayload := make([]byte, length)
-	for i := range payload {
-		maskedPayload[i] = payload[i] ^ maskKey[i%4]
+// preview shortens a message for the terminal
+func preview(message []byte) string {
+	const max = 80
+	if len(message) <= max {
+		return string(message)
 	}
-	frame = append(frame, maskedPayload...)
-
-	_, err := conn.Write(frame)
-	return err
+	return fmt.Sprintf("%s... (%d bytes)", message[:max], len(message))
 }
@@ -0,0 +1,267 @@
+// Benchmark: permessage-deflate on text-heavy chat traffic
+// Runs an echo server and client over loopback in one process and sends
+// the same stream of JSON chat messages under each compression setting,
+// then compares bytes on the wire and CPU time (both sides together,
+// from getrusage) against sending them uncompressed.
+//
+// Chat is where context takeover pays off: each message is short, so on
+// its own it barely compresses, but it repeats field names, room names,
+// user names and words from the messages before it. Keeping the window
+// between messages lets the compressor refer back to them.
+//
+// Run: go run deflate_bench.go [-n 20000]
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"claude-go/network/websocket/wswire"
+)
+
+type benchConfig struct {
+	name    string
+	deflate *wswire.DeflateParams // nil: no compression offered
+}
+
+var benchConfigs = []benchConfig{
+	{name: "none"},
+	{name: "deflate, no context takeover", deflate: &wswire.DeflateParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true}},
+	{name: "deflate, context takeover", deflate: &wswire.DeflateParams{}},
+	{name: "deflate, takeover, 10-bit window", deflate: &wswire.DeflateParams{ServerMaxWindowBits: 10, ClientMaxWindowBits: 10}},
+}
+
+type benchResult struct {
+	payload int64 // Message bytes, both directions
+	wire    int64 // Bytes on the TCP connection, both directions
+	cpu     time.Duration
+	alloc   uint64
+}
+
+func main() {
+	n := flag.Int("n", 20000, "messages per configuration")
+	flag.Parse()
+
+	messages := chatMessages(*n)
+	fmt.Printf("%d chat messages, %d bytes average, echoed back\n\n", *n, averageLen(messages))
+	fmt.Printf("%-34s %12s %12s %8s %10s %10s %12s\n", "Compression", "Payload", "Wire", "Ratio", "CPU", "CPU/msg", "Alloc/msg")
+	fmt.Println(strings.Repeat("-", 104))
+
+	var baseline benchResult
+	for i, cfg := range benchConfigs {
+		res, err := run(cfg, messages)
+		if err != nil {
+			fmt.Printf("%-34s error: %v\n", cfg.name, err)
+			continue
+		}
+		if i == 0 {
+			baseline = res
+		}
+		fmt.Printf("%-34s %12d %12d %7.1f%% %10s %8.1fµs %11dB\n",
+			cfg.name, res.payload, res.wire,
+			100*float64(res.wire)/float64(baseline.wire),
+			res.cpu.Round(time.Millisecond),
+			float64(res.cpu.Microseconds())/float64(len(messages)),
+			res.alloc/uint64(len(messages)))
+	}
+	fmt.Println("\nRatio is wire bytes against no compression; CPU covers client and server.")
+}
+
+// chatMessages builds a reproducible stream of chat envelopes: a few rooms
+// and users, text drawn from a small vocabulary, the odd presence update
+func chatMessages(n int) []string {
+	rng := mathrand.New(mathrand.NewSource(1))
+	rooms := []string{"lobby", "general", "random", "dev", "support"}
+	users := []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"}
+	words := strings.Fields(`the a to and of is it that in for on you this with have
+		be are not was but so what can just if about all do we they deploy build
+		test release branch merge review bug fix issue server client latency
+		cache memory query index today tomorrow meeting looks good thanks sure
+		yes no maybe later lunch coffee weekend again please check logs error`)
+
+	messages := make([]string, n)
+	start := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	for i := range messages {
+		room, user := rooms[rng.Intn(len(rooms))], users[rng.Intn(len(users))]
+		ts := start.Add(time.Duration(i) * 1700 * time.Millisecond).Format(time.RFC3339)
+		if rng.Intn(20) == 0 {
+			messages[i] = fmt.Sprintf(`{"type":"presence","room":%q,"user":%q,"status":"joined","time":%q}`, room, user, ts)
+			continue
+		}
+		text := make([]string, 4+rng.Intn(20))
+		for j := range text {
+			text[j] = words[rng.Intn(len(words))]
+		}
+		messages[i] = fmt.Sprintf(`{"type":"message","room":%q,"from":%q,"text":%q,"time":%q}`, room, user, strings.Join(text, " "), ts)
+	}
+	return messages
+}
+
+func averageLen(messages []string) int {
+	total := 0
+	for _, m := range messages {
+		total += len(m)
+	}
+	return total / len(messages)
+}
+
+// run echoes every message through a fresh connection with cfg's offer
+func run(cfg benchConfig, messages []string) (benchResult, error) {
+	var res benchResult
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return res, err
+	}
+	defer listener.Close()
+	go echoServer(listener)
+
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	allocBefore := mem.TotalAlloc
+	cpuBefore := cpuTime()
+	tcp, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return res, err
+	}
+	conn := &countingConn{Conn: tcp}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	agreed, err := handshake(conn, reader, cfg.deflate)
+	if err != nil {
+		return res, err
+	}
+	ws := wswire.NewConn(reader, conn, true)
+	if agreed != nil {
+		ws.EnableDeflate(*agreed)
+	}
+
+	for _, m := range messages {
+		if err := ws.WriteMessage(wswire.OpText, []byte(m)); err != nil {
+			return res, err
+		}
+		opcode, echo, err := ws.ReadMessage()
+		if err != nil {
+			return res, err
+		}
+		if opcode != wswire.OpText || string(echo) != m {
+			return res, fmt.Errorf("echo mismatch")
+		}
+		res.payload += int64(2 * len(m))
+	}
+	ws.WriteClose(wswire.CloseNormal, "")
+	ws.ReadMessage()
+
+	res.cpu = cpuTime() - cpuBefore
+	runtime.ReadMemStats(&mem)
+	res.alloc = mem.TotalAlloc - allocBefore
+	res.wire = conn.read + conn.written
+	return res, nil
+}
+
+// echoServer answers one connection the way server.go does, minus the
+// logging and prefix: whatever the client offers is agreed to
+func echoServer(listener net.Listener) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	agreed, err := wswire.Accept(conn, request, &wswire.DeflateParams{})
+	if err != nil {
+		return
+	}
+	ws := wswire.NewConn(reader, conn, false)
+	if agreed != nil {
+		ws.EnableDeflate(*agreed)
+	}
+
+	for {
+		opcode, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wswire.OpText, wswire.OpBinary:
+			if err := ws.WriteMessage(opcode, message); err != nil {
+				return
+			}
+		case wswire.OpClose:
+			ws.WriteControl(wswire.OpClose, message[:min(len(message), 2)])
+			return
+		}
+	}
+}
+
+// handshake upgrades, offering permessage-deflate if offer is set
+func handshake(conn net.Conn, reader *bufio.Reader, offer *wswire.DeflateParams) (*wswire.DeflateParams, error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	var extensions string
+	if offer != nil {
+		extensions = "Sec-WebSocket-Extensions: " + offer.Offer() + "\r\n"
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: bench\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n%s\r\n", key, extensions)
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wswire.AcceptKey(key) {
+		return nil, fmt.Errorf("handshake: %s", resp.Status)
+	}
+	if offer == nil {
+		return nil, nil
+	}
+	agreed, ok, err := wswire.AcceptedDeflate(resp.Header.Values("Sec-WebSocket-Extensions"), *offer)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("permessage-deflate not agreed: %v", err)
+	}
+	return &agreed, nil
+}
+
+// countingConn counts the bytes through the client's side of the
+// connection, which is everything on the wire in both directions
+type countingConn struct {
+	net.Conn
+	read, written int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	return n, err
+}
+
+// cpuTime is the user plus system CPU the process has used
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
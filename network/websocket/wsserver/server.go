@@ -0,0 +1,292 @@
+// Package wsserver is the server side of a WebSocket connection on raw
+// TCP, shared by server.go and the conformance suite so that the suite
+// runs the code the server ships: the opening handshake, the read loop
+// with its ping, close and protocol-error handling, and a writer
+// goroutine per connection draining the application's send queue.
+//
+// The application plugs in through Open, which starts a Session for each
+// upgraded connection. Data messages go to Session.Receive; whatever the
+// session queues on Send is written out in order, each write bounded by
+// WriteTimeout. A session that cuts its client off for falling behind
+// closes Dropped, and the connection is closed with 1008.
+package wsserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"claude-go/network/graceful"
+	"claude-go/network/websocket/wswire"
+)
+
+// DefaultWriteTimeout bounds one queued message's write when
+// Server.WriteTimeout is 0
+const DefaultWriteTimeout = 10 * time.Second
+
+// droppedCloseTimeout bounds the 1008 close frame to a client that has
+// fallen behind; it may not be reading at all
+const droppedCloseTimeout = time.Second
+
+// Message is one data message for a session's client
+type Message struct {
+	Opcode byte // wswire.OpText or wswire.OpBinary
+	Data   []byte
+}
+
+// Session is the application's side of one connection
+type Session interface {
+	// Name identifies the session in the log
+	Name() string
+
+	// Send yields the messages to write, in order. The connection's
+	// writer drains it; the session should never block on it.
+	Send() <-chan Message
+
+	// Dropped is closed when the session cuts its client off. Nothing
+	// more is written, bar a 1008 close frame. nil if it never does.
+	Dropped() <-chan struct{}
+
+	// Receive handles one data message from the client. A non-zero code
+	// closes the connection with that status and reason.
+	Receive(opcode byte, data []byte) (code int, reason string)
+
+	// Close is called once the connection is done with the session
+	Close()
+}
+
+// Server serves WebSocket connections handed to ServeConn
+type Server struct {
+	// Open starts the session of a connection that completed the
+	// opening handshake
+	Open func(req *http.Request) Session
+
+	// Deflate, if not nil, is the server's side of permessage-deflate
+	// negotiation (see wswire.Accept)
+	Deflate *wswire.DeflateParams
+
+	MaxMessageSize int64         // See wswire.Conn; 0 is its default
+	FragmentSize   int           // See wswire.Conn; 0 writes whole messages
+	WriteTimeout   time.Duration // Per queued message, 0 is DefaultWriteTimeout
+
+	// Graceful, if set, is the graceful.Server running ServeConn: an idle
+	// connection is woken on shutdown and sent a 1001 close frame
+	Graceful *graceful.Server
+
+	// Logf, if set, receives a line per connection event, like log.Printf
+	Logf func(format string, args ...any)
+}
+
+// ServeConn runs one connection from its opening handshake to its close,
+// and closes it
+func (s *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	clientAddr := conn.RemoteAddr().String()
+	s.logf("[%s] Connection received", clientAddr)
+
+	reader := bufio.NewReader(conn)
+
+	// Step 1: Read HTTP Upgrade request
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		s.logf("[%s] Failed to read request: %v", clientAddr, err)
+		return
+	}
+
+	// Step 2: Validate the upgrade request and send 101 Switching Protocols
+	// (Sec-WebSocket-Accept: base64 SHA-1 of the key + GUID). Anything else
+	// gets 400, or 426 for a Sec-WebSocket-Version other than 13.
+	// Sec-WebSocket-Extensions: permessage-deflate, if offered, is agreed to.
+	agreed, err := wswire.Accept(conn, request, s.Deflate)
+	if err != nil {
+		s.logf("[%s] %v", clientAddr, err)
+		return
+	}
+
+	// Step 3: Now communicate using WebSocket messages
+	ws := wswire.NewConn(reader, conn, false)
+	ws.MaxMessageSize = s.MaxMessageSize
+	ws.FragmentSize = s.FragmentSize
+	if agreed != nil {
+		ws.EnableDeflate(*agreed)
+		s.logf("[%s] WebSocket connection established (%s)", clientAddr, agreed)
+	} else {
+		s.logf("[%s] WebSocket connection established", clientAddr)
+	}
+
+	// Step 4: Open the session. Close frames go out only after stopWriter,
+	// so no message follows one.
+	session := s.Open(request)
+	s.logf("[%s] Session opened: %s", clientAddr, session.Name())
+	stopWriter := s.startWriter(conn, ws, session)
+	defer session.Close()
+	defer stopWriter()
+
+	for s.idle(conn) {
+		// Wait for the next frame to start; shutdown interrupts only this wait
+		if _, err := reader.Peek(1); err != nil && s.shuttingDown() {
+			break
+		}
+		s.active(conn)
+
+		// Read a whole message, however many frames it came in, or a
+		// control frame (which may arrive between a message's fragments)
+		opcode, message, err := ws.ReadMessage()
+		if err != nil {
+			if code := wswire.CloseCode(err); code != 0 {
+				s.logf("[%s] %v, closing with %d", clientAddr, err, code)
+				stopWriter()
+				ws.WriteClose(code, "")
+				return
+			}
+			s.logf("[%s] Read error: %v", clientAddr, err)
+			return
+		}
+
+		switch opcode {
+		case wswire.OpText, wswire.OpBinary:
+			if opcode == wswire.OpText {
+				s.logf("[%s] %s: %s", clientAddr, session.Name(), preview(message))
+			} else {
+				s.logf("[%s] %s: %d binary bytes", clientAddr, session.Name(), len(message))
+			}
+			// Replies arrive through the send queue
+			if code, reason := session.Receive(opcode, message); code != 0 {
+				s.logf("[%s] Closing with %d (%s)", clientAddr, code, reason)
+				stopWriter()
+				ws.WriteClose(code, reason)
+				return
+			}
+
+		case wswire.OpClose:
+			// ReadMessage has checked the code and reason already
+			code, reason, _ := wswire.ParseClose(message)
+			s.logf("[%s] Close frame received (%d %q)", clientAddr, code, reason)
+			// Echo the status code back; a close without one gets an empty one
+			stopWriter()
+			ws.WriteControl(wswire.OpClose, message[:min(len(message), 2)])
+			return
+
+		case wswire.OpPing:
+			s.logf("[%s] Ping received", clientAddr)
+			// Respond with pong
+			ws.WriteControl(wswire.OpPong, message)
+
+		case wswire.OpPong:
+			s.logf("[%s] Pong received", clientAddr)
+		}
+	}
+
+	// Shutting down: start the closing handshake ourselves
+	s.logf("[%s] Sending close 1001 (going away)", clientAddr)
+	stopWriter()
+	sendGoingAway(conn, ws)
+}
+
+// startWriter drains the session's send queue onto the connection until
+// stop is called or the session drops its client. stop writes out what is
+// already queued, then returns once the writer has; it may be called
+// again.
+func (s *Server) startWriter(conn net.Conn, ws *wswire.Conn, session Session) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	timeout := s.WriteTimeout
+	if timeout == 0 {
+		timeout = DefaultWriteTimeout
+	}
+	// The deadline is cleared after each message: the read loop's pongs
+	// and close frames share the connection and must not inherit it
+	write := func(m Message) bool {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		err := ws.WriteMessage(m.Opcode, m.Data)
+		conn.SetWriteDeadline(time.Time{})
+		return err == nil
+	}
+
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-session.Dropped():
+				// A full queue behind: it gets a close frame if it is
+				// reading at all, and the connection goes either way,
+				// which ends the read loop too
+				s.logf("[%s] %s dropped: send queue full", conn.RemoteAddr(), session.Name())
+				conn.SetWriteDeadline(time.Now().Add(droppedCloseTimeout))
+				ws.WriteClose(wswire.ClosePolicyViolation, "too slow")
+				conn.Close()
+				return
+			case m := <-session.Send():
+				if !write(m) {
+					conn.Close()
+					return
+				}
+			case <-quit:
+				for {
+					select {
+					case m := <-session.Send():
+						if !write(m) {
+							return
+						}
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return sync.OnceFunc(func() {
+		close(quit)
+		<-done
+	})
+}
+
+// sendGoingAway sends a 1001 close frame and waits briefly for the client's
+// close reply, so the client sees a clean close instead of a reset
+func sendGoingAway(conn net.Conn, ws *wswire.Conn) {
+	if err := ws.WriteClose(wswire.CloseGoingAway, "server shutting down"); err != nil {
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		opcode, _, err := ws.ReadMessage()
+		if err != nil || opcode == wswire.OpClose {
+			return
+		}
+	}
+}
+
+func (s *Server) idle(conn net.Conn) bool {
+	return s.Graceful == nil || s.Graceful.Idle(conn)
+}
+
+func (s *Server) active(conn net.Conn) {
+	if s.Graceful != nil {
+		s.Graceful.Active(conn)
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.Graceful != nil && s.Graceful.ShuttingDown()
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// preview shortens a message for the log
+func preview(message []byte) string {
+	const max = 80
+	if len(message) <= max {
+		return string(message)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", message[:max], len(message))
+}
@@ -0,0 +1,269 @@
+package wswire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// DefaultMaxMessageSize bounds a message, all its fragments together
+const DefaultMaxMessageSize = 1 << 20 // 1MB
+
+// Conn reads and writes messages on one side of a WebSocket connection.
+// One goroutine may read while others write.
+type Conn struct {
+	// MaxMessageSize bounds a reassembled message; larger ones fail with
+	// ErrMessageTooBig as soon as a frame header announces them.
+	// 0 means DefaultMaxMessageSize.
+	MaxMessageSize int64
+
+	// FragmentSize, if set, splits written messages into frames of at most
+	// this many payload bytes
+	FragmentSize int
+
+	r      *bufio.Reader
+	w      io.Writer
+	client bool // Mask outgoing frames
+
+	// Read side: the message being reassembled
+	fragmented bool
+	msgOpcode  byte
+	compressed bool // RSV1 was set on the message's first frame
+	partial    []byte
+	checked    int // Bytes of a partial text message known to be valid UTF-8
+
+	// permessage-deflate, once EnableDeflate is called
+	compress   *compressor
+	decompress *decompressor
+
+	messageMu sync.Mutex // Held for a whole data message
+	frameMu   sync.Mutex // Held for one frame, so control frames fit between fragments
+}
+
+// NewConn wraps an upgraded connection. r must be the reader the
+// handshake was read with, since it may hold frames already. client
+// selects the client side, which masks what it sends.
+func NewConn(r *bufio.Reader, w io.Writer, client bool) *Conn {
+	return &Conn{r: r, w: w, client: client}
+}
+
+// EnableDeflate turns on permessage-deflate with the parameters agreed in
+// the handshake. Call it before the first read or write.
+func (c *Conn) EnableDeflate(p DeflateParams) {
+	sendTakeover, sendBits, recvTakeover := p.ServerNoContextTakeover, p.ServerMaxWindowBits, p.ClientNoContextTakeover
+	if c.client {
+		sendTakeover, sendBits, recvTakeover = p.ClientNoContextTakeover, p.ClientMaxWindowBits, p.ServerNoContextTakeover
+	}
+	c.compress = newCompressor(sendTakeover, sendBits)
+	c.decompress = &decompressor{noContextTakeover: recvTakeover}
+}
+
+func (c *Conn) maxMessageSize() int64 {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return DefaultMaxMessageSize
+}
+
+// ReadMessage returns the next complete data message (OpText or
+// OpBinary) or control frame (OpClose, OpPing, OpPong). A control frame
+// that arrives between the fragments of a message is returned by itself;
+// the next call goes on assembling the message.
+//
+// Text must be valid UTF-8, checked fragment by fragment so a bad one
+// fails before the rest arrives. A close frame's payload is checked too:
+// empty, or a valid code and a UTF-8 reason (see ParseClose).
+//
+// With permessage-deflate, a message with RSV1 set is inflated once
+// complete; MaxMessageSize then bounds both its compressed and inflated
+// sizes.
+func (c *Conn) ReadMessage() (opcode byte, data []byte, err error) {
+	for {
+		h, err := readHeader(c.r)
+		if err != nil {
+			if c.fragmented {
+				err = noEOF(err)
+			}
+			return 0, nil, err
+		}
+
+		// RSV1 marks a compressed message, on its first frame only
+		compressed := h.rsv == rsv1 && c.decompress != nil && (h.opcode == OpText || h.opcode == OpBinary)
+		switch {
+		case h.rsv != 0 && !compressed:
+			return 0, nil, protocolErr(ErrReservedBits, "0x%02X on opcode 0x%X", h.rsv, h.opcode)
+		case !c.client && !h.masked:
+			return 0, nil, protocolErr(ErrUnmaskedFrame, "")
+		case c.client && h.masked:
+			return 0, nil, protocolErr(ErrMaskedFrame, "")
+		}
+
+		if IsControl(h.opcode) {
+			switch {
+			case h.opcode != OpClose && h.opcode != OpPing && h.opcode != OpPong:
+				return 0, nil, protocolErr(ErrUnknownOpcode, "0x%X", h.opcode)
+			case !h.fin:
+				return 0, nil, protocolErr(ErrFragmentedControl, "opcode 0x%X", h.opcode)
+			case h.length > 125:
+				return 0, nil, protocolErr(ErrControlTooLong, "%d bytes", h.length)
+			}
+			payload, err := readPayload(c.r, h)
+			if err != nil {
+				return 0, nil, err
+			}
+			if h.opcode == OpClose {
+				if _, _, err := ParseClose(payload); err != nil {
+					return 0, nil, err
+				}
+			}
+			return h.opcode, payload, nil
+		}
+
+		switch h.opcode {
+		case OpContinuation:
+			if !c.fragmented {
+				return 0, nil, protocolErr(ErrUnexpectedContinuation, "")
+			}
+		case OpText, OpBinary:
+			if c.fragmented {
+				return 0, nil, protocolErr(ErrInterruptedMessage, "opcode 0x%X", h.opcode)
+			}
+			c.fragmented, c.msgOpcode, c.compressed, c.partial = true, h.opcode, compressed, nil
+		default:
+			return 0, nil, protocolErr(ErrUnknownOpcode, "0x%X", h.opcode)
+		}
+
+		// Checked against the header, before reading the payload
+		if size := uint64(len(c.partial)) + h.length; size > uint64(c.maxMessageSize()) {
+			return 0, nil, protocolErr(ErrMessageTooBig, "%d bytes and counting, limit %d", size, c.maxMessageSize())
+		}
+		payload, err := readPayload(c.r, h)
+		if err != nil {
+			return 0, nil, err
+		}
+		if c.partial == nil {
+			c.partial = payload // The common case: a single frame, no copy
+		} else {
+			c.partial = append(c.partial, payload...)
+		}
+
+		if c.msgOpcode == OpText && !c.compressed {
+			// A code point may straddle fragments: only the bytes up to
+			// the last complete one are settled
+			n, ok := validUTF8Prefix(c.partial[c.checked:])
+			c.checked += n
+			if !ok || h.fin && c.checked != len(c.partial) {
+				return 0, nil, protocolErr(ErrInvalidUTF8, "at byte %d", c.checked)
+			}
+		}
+
+		if h.fin {
+			data, opcode := c.partial, c.msgOpcode
+			c.fragmented, c.partial, c.checked = false, nil, 0
+			if c.compressed {
+				if data, err = c.decompress.decompress(data, c.maxMessageSize()); err != nil {
+					return 0, nil, err
+				}
+				// Only checked whole: the fragments were compressed bytes
+				if opcode == OpText && !utf8.Valid(data) {
+					return 0, nil, protocolErr(ErrInvalidUTF8, "inflated message")
+				}
+			}
+			if data == nil {
+				data = []byte{}
+			}
+			return opcode, data, nil
+		}
+	}
+}
+
+// WriteMessage sends a data message (OpText or OpBinary), as fragments of
+// FragmentSize if it is larger. Control frames written by other
+// goroutines meanwhile go out between the fragments. With
+// permessage-deflate the message is compressed first, and FragmentSize
+// applies to the compressed bytes.
+func (c *Conn) WriteMessage(opcode byte, data []byte) error {
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+
+	var rsv byte
+	if c.compress != nil {
+		var err error
+		if data, err = c.compress.compress(data); err != nil {
+			return err
+		}
+		rsv = rsv1
+	}
+
+	size := c.FragmentSize
+	if size <= 0 || len(data) <= size {
+		return c.writeFrame(Frame{Fin: true, Rsv: rsv, Opcode: opcode, Payload: data})
+	}
+	for off := 0; off < len(data); off += size {
+		end := min(off+size, len(data))
+		f := Frame{Fin: end == len(data), Rsv: rsv, Opcode: opcode, Payload: data[off:end]}
+		if off > 0 {
+			f.Rsv, f.Opcode = 0, OpContinuation
+		}
+		if err := c.writeFrame(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteControl sends a ping, pong or close frame. It doesn't wait for a
+// data message being written, only for its current fragment.
+func (c *Conn) WriteControl(opcode byte, payload []byte) error {
+	return c.writeFrame(Frame{Fin: true, Opcode: opcode, Payload: payload})
+}
+
+// WriteClose sends a close frame with a status code and reason
+func (c *Conn) WriteClose(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.WriteControl(OpClose, append(payload, reason...))
+}
+
+// ParseClose splits a close frame's payload into its status code and
+// reason. An empty payload has no code: it reads as CloseNoStatus. One
+// byte, a code not allowed on the wire, or a reason that isn't UTF-8 is
+// a *ProtocolError.
+func ParseClose(payload []byte) (code int, reason string, err error) {
+	switch {
+	case len(payload) == 0:
+		return CloseNoStatus, "", nil
+	case len(payload) == 1:
+		return 0, "", protocolErr(ErrBadClosePayload, "1-byte payload")
+	}
+	code = int(binary.BigEndian.Uint16(payload))
+	if !validCloseCode(code) {
+		return 0, "", protocolErr(ErrBadClosePayload, "code %d", code)
+	}
+	if !utf8.Valid(payload[2:]) {
+		return 0, "", protocolErr(ErrInvalidUTF8, "close reason")
+	}
+	return code, string(payload[2:]), nil
+}
+
+// validUTF8Prefix returns how many bytes of b are complete, valid UTF-8.
+// ok is false if the rest can't be the start of a valid sequence either.
+func validUTF8Prefix(b []byte) (n int, ok bool) {
+	for n < len(b) {
+		r, size := utf8.DecodeRune(b[n:])
+		if r == utf8.RuneError && size == 1 {
+			// FullRune is false only for a truncated but so far valid
+			// sequence, which the next fragment may complete
+			return n, !utf8.FullRune(b[n:])
+		}
+		n += size
+	}
+	return n, true
+}
+
+func (c *Conn) writeFrame(f Frame) error {
+	c.frameMu.Lock()
+	defer c.frameMu.Unlock()
+	return WriteFrame(c.w, f, c.client)
+}
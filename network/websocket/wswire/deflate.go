@@ -0,0 +1,315 @@
+package wswire
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// permessage-deflate (RFC 7692) compresses each data message's payload as
+// raw DEFLATE, ended with a sync flush whose last 4 bytes (00 00 FF FF)
+// are left off the wire, and sets RSV1 on the message's first frame.
+//
+// With context takeover (the default) a side keeps its LZ77 window from
+// one message to the next, so a message can refer back to text sent
+// earlier: repetitive traffic like chat shrinks far more, at the cost of
+// a compressor and 32KB of history held per connection. Either side's
+// takeover can be turned off, and its window narrowed, in the handshake.
+
+const (
+	deflateExtension = "permessage-deflate"
+	minWindowBits    = 8
+	maxWindowBits    = 15
+
+	// compressionLevel favours CPU: most of the gain on chat-sized
+	// messages comes from the shared window, not a harder search
+	compressionLevel = flate.BestSpeed
+)
+
+var (
+	// deflateTail is stripped from each compressed message by the sender
+	// and put back by the receiver
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+	// finalBlock is an empty final stored block, so flate's reader ends
+	// on io.EOF instead of waiting for more input
+	finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+)
+
+// DeflateParams are permessage-deflate parameters: a client's offer, a
+// server's preferences, or what the two agreed on. A window of 0 means
+// the default of 15 bits (32KB).
+type DeflateParams struct {
+	ServerNoContextTakeover bool // The server resets its compressor after each message
+	ClientNoContextTakeover bool // Likewise the client
+	ServerMaxWindowBits     int  // LZ77 window the server compresses with, 8-15
+	ClientMaxWindowBits     int  // LZ77 window the client compresses with, 8-15
+}
+
+// String renders p as an element of Sec-WebSocket-Extensions, as a server
+// sends it in its response
+func (p DeflateParams) String() string {
+	s := deflateExtension
+	if p.ServerNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.ClientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	if p.ServerMaxWindowBits != 0 {
+		s += "; server_max_window_bits=" + strconv.Itoa(p.ServerMaxWindowBits)
+	}
+	if p.ClientMaxWindowBits != 0 {
+		s += "; client_max_window_bits=" + strconv.Itoa(p.ClientMaxWindowBits)
+	}
+	return s
+}
+
+// Offer renders p as a client's offer. client_max_window_bits is always
+// included, without a value if ClientMaxWindowBits is 0: it tells the
+// server it may narrow the client's window.
+func (p DeflateParams) Offer() string {
+	if p.ClientMaxWindowBits != 0 {
+		return p.String()
+	}
+	return p.String() + "; client_max_window_bits"
+}
+
+// deflateOffer is DeflateParams as parsed, which also has to tell a
+// client_max_window_bits without a value from none at all
+type deflateOffer struct {
+	DeflateParams
+	clientWindowOffered bool
+}
+
+// parseDeflate reads the parameters of one permessage-deflate element.
+// Unknown, duplicate or out-of-range parameters are an error.
+func parseDeflate(params []string) (deflateOffer, error) {
+	var o deflateOffer
+	seen := make(map[string]bool)
+	for _, param := range params {
+		name, value, hasValue := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.Trim(strings.TrimSpace(value), `"`)
+		if seen[name] {
+			return o, fmt.Errorf("duplicate %s", name)
+		}
+		seen[name] = true
+
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if hasValue {
+				return o, fmt.Errorf("%s takes no value", name)
+			}
+			if name == "server_no_context_takeover" {
+				o.ServerNoContextTakeover = true
+			} else {
+				o.ClientNoContextTakeover = true
+			}
+		case "server_max_window_bits", "client_max_window_bits":
+			if name == "client_max_window_bits" {
+				o.clientWindowOffered = true
+				if !hasValue {
+					break
+				}
+			}
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < minWindowBits || bits > maxWindowBits {
+				return o, fmt.Errorf("%s=%q, want %d-%d", name, value, minWindowBits, maxWindowBits)
+			}
+			if name == "server_max_window_bits" {
+				o.ServerMaxWindowBits = bits
+			} else {
+				o.ClientMaxWindowBits = bits
+			}
+		default:
+			return o, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+	return o, nil
+}
+
+// extensions splits Sec-WebSocket-Extensions fields into elements, each
+// its name followed by its parameters
+func extensions(fields []string) [][]string {
+	var exts [][]string
+	for _, field := range fields {
+		for _, element := range strings.Split(field, ",") {
+			parts := strings.Split(element, ";")
+			parts[0] = strings.TrimSpace(parts[0])
+			if parts[0] != "" {
+				exts = append(exts, parts)
+			}
+		}
+	}
+	return exts
+}
+
+// negotiateDeflate accepts the first permessage-deflate offer in a
+// client's Sec-WebSocket-Extensions that is valid, narrowed by the
+// server's own preferences
+func negotiateDeflate(fields []string, prefs DeflateParams) (DeflateParams, bool) {
+	for _, ext := range extensions(fields) {
+		if !strings.EqualFold(ext[0], deflateExtension) {
+			continue
+		}
+		o, err := parseDeflate(ext[1:])
+		if err != nil {
+			continue // Declined; a later offer may do
+		}
+		agreed := DeflateParams{
+			ServerNoContextTakeover: o.ServerNoContextTakeover || prefs.ServerNoContextTakeover,
+			ClientNoContextTakeover: o.ClientNoContextTakeover || prefs.ClientNoContextTakeover,
+			ServerMaxWindowBits:     narrower(o.ServerMaxWindowBits, prefs.ServerMaxWindowBits),
+		}
+		// The client's window may only be narrowed if it offered to
+		if o.clientWindowOffered {
+			agreed.ClientMaxWindowBits = narrower(o.ClientMaxWindowBits, prefs.ClientMaxWindowBits)
+		}
+		return agreed, true
+	}
+	return DeflateParams{}, false
+}
+
+// narrower returns the smaller of two window sizes, where 0 is unset
+func narrower(a, b int) int {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// AcceptedDeflate checks a server's Sec-WebSocket-Extensions against the
+// client's offer. ok is false if the server declined compression. An
+// error means the server answered with something not offered, and the
+// client must fail the connection.
+func AcceptedDeflate(fields []string, offer DeflateParams) (agreed DeflateParams, ok bool, err error) {
+	exts := extensions(fields)
+	switch {
+	case len(exts) == 0:
+		return DeflateParams{}, false, nil
+	case len(exts) > 1 || !strings.EqualFold(exts[0][0], deflateExtension):
+		return DeflateParams{}, false, fmt.Errorf("wswire: extensions %q not offered", strings.Join(fields, ", "))
+	}
+
+	o, err := parseDeflate(exts[0][1:])
+	switch {
+	case err != nil:
+		return DeflateParams{}, false, fmt.Errorf("wswire: %s response: %v", deflateExtension, err)
+	case o.clientWindowOffered && o.ClientMaxWindowBits == 0:
+		return DeflateParams{}, false, fmt.Errorf("wswire: %s response: client_max_window_bits without a value", deflateExtension)
+	case offer.ServerNoContextTakeover && !o.ServerNoContextTakeover:
+		return DeflateParams{}, false, fmt.Errorf("wswire: %s response dropped server_no_context_takeover", deflateExtension)
+	case offer.ServerMaxWindowBits != 0 && (o.ServerMaxWindowBits == 0 || o.ServerMaxWindowBits > offer.ServerMaxWindowBits):
+		return DeflateParams{}, false, fmt.Errorf("wswire: %s response widened server_max_window_bits", deflateExtension)
+	case offer.ClientMaxWindowBits != 0 && o.ClientMaxWindowBits > offer.ClientMaxWindowBits:
+		return DeflateParams{}, false, fmt.Errorf("wswire: %s response widened client_max_window_bits", deflateExtension)
+	}
+	return o.DeflateParams, true, nil
+}
+
+// writerPool recycles compressors between messages on connections without
+// context takeover, which need one only while writing
+var writerPool sync.Pool
+
+// compressor deflates one side's outgoing messages. Conn's messageMu
+// keeps it to one message at a time.
+type compressor struct {
+	noContextTakeover bool
+	window            int // Input bytes per window, 0 for flate's own 32KB
+
+	fw      *flate.Writer // Kept between messages only with context takeover
+	written int           // Input since fw was last reset
+	buf     bytes.Buffer
+}
+
+func newCompressor(noContextTakeover bool, windowBits int) *compressor {
+	c := &compressor{noContextTakeover: noContextTakeover}
+	if windowBits != 0 && windowBits < maxWindowBits {
+		c.window = 1 << windowBits
+	}
+	return c
+}
+
+func (c *compressor) compress(data []byte) ([]byte, error) {
+	if c.fw == nil && c.noContextTakeover {
+		if fw, ok := writerPool.Get().(*flate.Writer); ok {
+			fw.Reset(&c.buf)
+			c.fw = fw
+		}
+	}
+	if c.fw == nil {
+		c.fw, _ = flate.NewWriter(&c.buf, compressionLevel)
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if c.window > 0 {
+			// flate can't be given a window under 32KB, so keep its
+			// references short by starting afresh every window bytes:
+			// a sync flush, then a reset, which forgets what came before
+			if c.written == c.window {
+				if err := c.fw.Flush(); err != nil {
+					return nil, err
+				}
+				c.fw.Reset(&c.buf)
+				c.written = 0
+			}
+			n = min(n, c.window-c.written)
+		}
+		if _, err := c.fw.Write(data[:n]); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		c.written += n
+	}
+	if err := c.fw.Flush(); err != nil {
+		return nil, err
+	}
+
+	out := bytes.Clone(bytes.TrimSuffix(c.buf.Bytes(), deflateTail))
+	c.buf.Reset()
+	if c.noContextTakeover {
+		writerPool.Put(c.fw)
+		c.fw, c.written = nil, 0
+	}
+	return out, nil
+}
+
+// decompressor inflates one side's incoming messages
+type decompressor struct {
+	noContextTakeover bool
+	history           []byte // Up to 32KB of earlier output, the next message's dictionary
+	fr                io.ReadCloser
+}
+
+// decompress inflates a message's payload, failing with ErrMessageTooBig
+// as soon as the output passes limit
+func (d *decompressor) decompress(payload []byte, limit int64) ([]byte, error) {
+	in := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail), bytes.NewReader(finalBlock))
+	if d.fr == nil {
+		d.fr = flate.NewReaderDict(in, d.history)
+	} else {
+		d.fr.(flate.Resetter).Reset(in, d.history)
+	}
+
+	out, err := io.ReadAll(io.LimitReader(d.fr, limit+1))
+	if err != nil {
+		return nil, protocolErr(ErrBadCompression, "%v", err)
+	}
+	if int64(len(out)) > limit {
+		return nil, protocolErr(ErrMessageTooBig, "inflates past %d bytes", limit)
+	}
+
+	if !d.noContextTakeover {
+		d.history = append(d.history, out...)
+		if excess := len(d.history) - 1<<maxWindowBits; excess > 0 {
+			d.history = append(d.history[:0], d.history[excess:]...)
+		}
+	}
+	return out, nil
+}
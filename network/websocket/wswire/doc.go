@@ -0,0 +1,23 @@
+// Package wswire reads and writes WebSocket frames (RFC 6455) on raw
+// connections, for the socket-level server and client in network/websocket.
+//
+// ReadFrame and WriteFrame handle single frames. Conn works in messages:
+// ReadMessage reassembles a message sent as a first frame plus
+// continuation frames, and returns control frames (ping, pong, close) as
+// they arrive, even between the fragments of a message, which it keeps
+// assembling on the next call. WriteMessage splits messages larger than
+// FragmentSize, and control frames written meanwhile go out between the
+// fragments.
+//
+// ReadMessage also enforces the rest of RFC 6455's rules for a peer:
+// masking in the right direction, no reserved bits, control frames of at
+// most 125 bytes, UTF-8 text, and well-formed close frames. Input that
+// breaks them is reported as a *ProtocolError wrapping one of the Err*
+// sentinels, which CloseCode maps to the status code to close the
+// connection with (1002, or 1007 for bad UTF-8, 1009 for size).
+//
+// Accept handles the server's side of the opening handshake, including
+// negotiating permessage-deflate (RFC 7692); AcceptedDeflate checks the
+// server's answer on the client side. Conn.EnableDeflate then compresses
+// outgoing data messages and inflates incoming ones marked with RSV1.
+package wswire
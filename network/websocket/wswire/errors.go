@@ -0,0 +1,105 @@
+package wswire
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Close status codes (RFC 6455 7.4.1)
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseNoStatus        = 1005 // Never sent: a close frame without a code
+	CloseAbnormal        = 1006 // Never sent: the connection dropped without one
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	CloseTLSHandshake    = 1015 // Never sent
+)
+
+// validCloseCode reports whether code may appear in a close frame: the
+// codes RFC 6455 and IANA define for use on the wire, and the 3000-4999
+// ranges for libraries and applications
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// HandshakeError is an upgrade request Accept turned down
+type HandshakeError struct {
+	Status int // HTTP status sent in reply
+	Reason string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("wswire: handshake rejected (%d): %s", e.Status, e.Reason)
+}
+
+// Sentinel errors for input that breaks the framing rules. Conn wraps
+// them in a *ProtocolError, so use errors.Is to test for a particular one.
+var (
+	ErrMessageTooBig          = errors.New("message too big")
+	ErrUnknownOpcode          = errors.New("unknown opcode")
+	ErrUnexpectedContinuation = errors.New("continuation frame without a message to continue")
+	ErrInterruptedMessage     = errors.New("new message before the previous one's final fragment")
+	ErrFragmentedControl      = errors.New("fragmented control frame")
+	ErrControlTooLong         = errors.New("control frame payload over 125 bytes")
+	ErrReservedBits           = errors.New("reserved bits set without an extension")
+	ErrUnmaskedFrame          = errors.New("unmasked frame from client")
+	ErrMaskedFrame            = errors.New("masked frame from server")
+	ErrBadClosePayload        = errors.New("invalid close frame payload")
+	ErrInvalidUTF8            = errors.New("invalid UTF-8 in text")
+	ErrBadCompression         = errors.New("compressed message does not inflate")
+)
+
+// ProtocolError is input the peer should not have sent
+type ProtocolError struct {
+	Err    error // One of the sentinel errors above
+	Detail string
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Detail == "" {
+		return "wswire: " + e.Err.Error()
+	}
+	return fmt.Sprintf("wswire: %s: %s", e.Err, e.Detail)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func protocolErr(err error, format string, args ...any) error {
+	return &ProtocolError{Err: err, Detail: fmt.Sprintf(format, args...)}
+}
+
+// CloseCode maps a read error to the status to close the connection with.
+// Returns 0 for errors that are not the peer's fault (I/O, EOF), in which
+// case the connection should just be closed.
+func CloseCode(err error) int {
+	switch {
+	case errors.Is(err, ErrMessageTooBig):
+		return CloseMessageTooBig
+	case errors.Is(err, ErrInvalidUTF8), errors.Is(err, ErrBadCompression):
+		return CloseInvalidPayload
+	case errors.Is(err, ErrUnknownOpcode),
+		errors.Is(err, ErrUnexpectedContinuation),
+		errors.Is(err, ErrInterruptedMessage),
+		errors.Is(err, ErrFragmentedControl),
+		errors.Is(err, ErrControlTooLong),
+		errors.Is(err, ErrReservedBits),
+		errors.Is(err, ErrUnmaskedFrame),
+		errors.Is(err, ErrMaskedFrame),
+		errors.Is(err, ErrBadClosePayload):
+		return CloseProtocolError
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package wswire
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// Opcodes
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// rsv1 is the first reserved bit, which permessage-deflate uses to mark
+// a compressed message
+const rsv1 = 0x40
+
+// IsControl reports whether opcode is a control frame (close, ping, pong)
+func IsControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// Frame is one WebSocket frame, its payload unmasked
+//
+//	0                   1                   2                   3
+//	0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-------+-+-------------+-------------------------------+
+//	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+//	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+//	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+//	| |1|2|3|       |K|             |                               |
+//	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+//	|     Extended payload length continued, if payload len == 127  |
+//	+ - - - - - - - - - - - - - - - +-------------------------------+
+//	|                               |Masking-key, if MASK set to 1  |
+//	+-------------------------------+-------------------------------+
+//	| Masking-key (continued)       |          Payload Data         |
+//	+-------------------------------- - - - - - - - - - - - - - - - +
+type Frame struct {
+	Fin     bool // Final fragment of its message
+	Rsv     byte // RSV1-3 as they sit in the first byte (0x70 mask)
+	Opcode  byte
+	Masked  bool // Was masked on the wire (set by ReadFrame)
+	Payload []byte
+}
+
+// header is the part of a frame before the payload
+type header struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	masked  bool
+	length  uint64
+	maskKey [4]byte
+}
+
+func readHeader(r *bufio.Reader) (header, error) {
+	var h header
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return h, err
+	}
+	h.fin = b[0]&0x80 != 0
+	h.rsv = b[0] & 0x70
+	h.opcode = b[0] & 0x0F
+	h.masked = b[1]&0x80 != 0
+	h.length = uint64(b[1] & 0x7F)
+
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return h, noEOF(err)
+		}
+		h.length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err := io.ReadFull(r, b[:8]); err != nil {
+			return h, noEOF(err)
+		}
+		h.length = binary.BigEndian.Uint64(b[:8])
+	}
+
+	if h.masked {
+		if _, err := io.ReadFull(r, h.maskKey[:]); err != nil {
+			return h, noEOF(err)
+		}
+	}
+	return h, nil
+}
+
+func readPayload(r *bufio.Reader, h header) ([]byte, error) {
+	payload := make([]byte, h.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, noEOF(err)
+	}
+	if h.masked {
+		mask(payload, h.maskKey)
+	}
+	return payload, nil
+}
+
+// ReadFrame reads one frame. A payload over maxPayload bytes fails with
+// ErrMessageTooBig before any of it is read.
+func ReadFrame(r *bufio.Reader, maxPayload int64) (Frame, error) {
+	h, err := readHeader(r)
+	if err != nil {
+		return Frame{}, err
+	}
+	if h.length > uint64(maxPayload) {
+		return Frame{}, protocolErr(ErrMessageTooBig, "%d-byte frame, limit %d", h.length, maxPayload)
+	}
+	payload, err := readPayload(r, h)
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{Fin: h.fin, Rsv: h.rsv, Opcode: h.opcode, Masked: h.masked, Payload: payload}, nil
+}
+
+// WriteFrame writes f in one Write. Clients must mask their frames with a
+// fresh random key; servers must not mask.
+func WriteFrame(w io.Writer, f Frame, masked bool) error {
+	frame := make([]byte, 0, 14+len(f.Payload))
+
+	first := f.Rsv&0x70 | f.Opcode&0x0F
+	if f.Fin {
+		first |= 0x80
+	}
+	frame = append(frame, first)
+
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	length := len(f.Payload)
+	switch {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length < 65536:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if !masked {
+		frame = append(frame, f.Payload...)
+	} else {
+		var key [4]byte
+		rand.Read(key[:])
+		frame = append(frame, key[:]...)
+		start := len(frame)
+		frame = append(frame, f.Payload...)
+		mask(frame[start:], key)
+	}
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// mask XORs b with key; masking and unmasking are the same operation
+func mask(b []byte, key [4]byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// noEOF turns an EOF inside a frame into io.ErrUnexpectedEOF: only an
+// EOF between frames is a clean end of stream
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package wswire
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GUID is appended to the client's key to derive Sec-WebSocket-Accept
+const GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Version is the only protocol version a server speaks (RFC 6455 4.4)
+const Version = "13"
+
+// AcceptKey derives Sec-WebSocket-Accept from Sec-WebSocket-Key: the
+// base64 SHA-1 of the key and GUID
+func AcceptKey(key string) string {
+	h := sha1.Sum([]byte(key + GUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Accept checks an opening handshake (RFC 6455 4.2.1) and writes the 101
+// response. A request that isn't a valid upgrade gets 400, one for another
+// protocol version 426 listing the version we speak; either way Accept
+// returns a *HandshakeError and the connection should be closed.
+//
+// deflate, if not nil, enables permessage-deflate for clients that offer
+// it, narrowed by the server's preferences in deflate (a no-takeover flag
+// or window set there applies even if the client didn't ask). The agreed
+// parameters are returned for Conn.EnableDeflate; nil means the
+// connection is uncompressed.
+func Accept(w io.Writer, req *http.Request, deflate *DeflateParams) (*DeflateParams, error) {
+	if err := checkUpgrade(req); err != nil {
+		reject(w, err)
+		return nil, err
+	}
+
+	var agreed *DeflateParams
+	var extensionLine string
+	if deflate != nil {
+		if p, ok := negotiateDeflate(req.Header.Values("Sec-WebSocket-Extensions"), *deflate); ok {
+			agreed = &p
+			extensionLine = "Sec-WebSocket-Extensions: " + p.String() + "\r\n"
+		}
+	}
+
+	_, err := fmt.Fprintf(w,
+		"HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n"+
+			"%s"+
+			"\r\n",
+		AcceptKey(req.Header.Get("Sec-WebSocket-Key")), extensionLine)
+	return agreed, err
+}
+
+func checkUpgrade(req *http.Request) *HandshakeError {
+	bad := func(reason string) *HandshakeError {
+		return &HandshakeError{Status: http.StatusBadRequest, Reason: reason}
+	}
+	switch {
+	case req.Method != http.MethodGet:
+		return bad("method " + req.Method + ", want GET")
+	case !req.ProtoAtLeast(1, 1):
+		return bad("HTTP/1.1 or later required")
+	case req.Host == "":
+		return bad("missing Host")
+	case !hasToken(req.Header, "Upgrade", "websocket"):
+		return bad("Upgrade does not list websocket")
+	case !hasToken(req.Header, "Connection", "upgrade"):
+		return bad("Connection does not list upgrade")
+	}
+
+	// Checked before the key: a client of another version may build its
+	// key differently, and 426 tells it which version to retry with
+	if v := req.Header.Values("Sec-WebSocket-Version"); len(v) != 1 || strings.TrimSpace(v[0]) != Version {
+		return &HandshakeError{
+			Status: http.StatusUpgradeRequired,
+			Reason: fmt.Sprintf("Sec-WebSocket-Version %q, want %s", strings.Join(v, ", "), Version),
+		}
+	}
+
+	keys := req.Header.Values("Sec-WebSocket-Key")
+	if len(keys) != 1 {
+		return bad(fmt.Sprintf("%d Sec-WebSocket-Key fields", len(keys)))
+	}
+	if nonce, err := base64.StdEncoding.DecodeString(keys[0]); err != nil || len(nonce) != 16 {
+		return bad("Sec-WebSocket-Key is not a base64 16-byte nonce")
+	}
+	return nil
+}
+
+func reject(w io.Writer, err *HandshakeError) {
+	var extra string
+	if err.Status == http.StatusUpgradeRequired {
+		extra = "Sec-WebSocket-Version: " + Version + "\r\n"
+	}
+	body := err.Reason + "\n"
+	fmt.Fprintf(w,
+		"HTTP/1.1 %d %s\r\n"+
+			"%s"+
+			"Content-Type: text/plain; charset=utf-8\r\n"+
+			"Content-Length: %d\r\n"+
+			"Connection: close\r\n"+
+			"\r\n%s",
+		err.Status, http.StatusText(err.Status), extra, len(body), body)
+}
+
+// hasToken reports whether a comma-separated header lists token, ignoring
+// case, across all its fields
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}